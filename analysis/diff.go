@@ -0,0 +1,204 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+const (
+	DIFF_MIN_SCORE = 0.2 // Differences scoring less are left out
+)
+
+// IdCount is an ArbID and how many frames of it a capture has
+type IdCount struct {
+	ArbID string
+	Count int
+}
+
+// ByteDiff is a byte whose values are distributed differently in the two
+// captures.  Distance is the total variation distance between the two value
+// distributions, 1 when no value is seen in both.  Score weighs it by how
+// settled the byte is, the root of the smaller of ShareA and ShareB, so
+// noise and counters rank below bytes that hold a different state
+type ByteDiff struct {
+	ArbID     string
+	Byte      int
+	Score     float64
+	Distance  float64
+	ValueA    string  // Most common value, hex
+	ShareA    float64 // Fraction of frames with ValueA
+	DistinctA int     // Number of different values
+	ValueB    string
+	ShareB    float64
+	DistinctB int
+	Samples   int // Frames in the smaller capture, ties rank by it
+}
+
+// BitDiff is a bit set in a different share of the frames of each capture.
+// Bits are numbered as in IdStats
+type BitDiff struct {
+	ArbID   string
+	Bit     int
+	Score   float64 // Difference of SetA and SetB
+	SetA    float64 // Fraction of frames with the bit set
+	SetB    float64
+	Samples int
+}
+
+// DiffReport is what tells two captures apart, most significant first
+type DiffReport struct {
+	OnlyA []IdCount
+	OnlyB []IdCount
+	Bytes []ByteDiff
+	Bits  []BitDiff
+}
+
+// byteValues counts the values seen in each byte position of one ArbID
+type byteValues struct {
+	frames int
+	counts [8]map[byte]int
+	totals [8]int
+	set    [64]int
+}
+
+func collect(pkts []api.CanData) map[string]*byteValues {
+	ids := map[string]*byteValues{}
+	for i := range pkts {
+		id, ok := ids[pkts[i].ArbID]
+		if !ok {
+			id = &byteValues{}
+			ids[pkts[i].ArbID] = id
+		}
+		id.frames += 1
+		if pkts[i].Remote {
+			continue
+		}
+		for n, b := range pkts[i].Data() {
+			if id.counts[n] == nil {
+				id.counts[n] = map[byte]int{}
+			}
+			id.counts[n][b] += 1
+			id.totals[n] += 1
+			for bit := uint(0); bit < 8; bit++ {
+				if b&(1<<bit) != 0 {
+					id.set[n*8+int(bit)] += 1
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// mostCommon returns the most frequent value, the lowest on a tie
+func mostCommon(counts map[byte]int) (byte, int) {
+	var value byte
+	best := -1
+	for v, n := range counts {
+		if n > best || n == best && v < value {
+			value, best = v, n
+		}
+	}
+	return value, best
+}
+
+func sortedIds(ids map[string]*byteValues, other map[string]*byteValues) []IdCount {
+	only := []IdCount{}
+	for arbId, id := range ids {
+		if _, ok := other[arbId]; !ok {
+			only = append(only, IdCount{ArbID: arbId, Count: id.frames})
+		}
+	}
+	sort.Slice(only, func(i, j int) bool { return idLess(only[i].ArbID, only[j].ArbID) })
+	return only
+}
+
+// round keeps floating point noise from deciding the ranking
+func round(score float64) float64 {
+	return math.Round(score*10000) / 10000
+}
+
+// idLess orders ArbIDs as numbers, standard IDs before extended ones
+func idLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// Diff compares two captures, such as one with a door locked and one with
+// it unlocked.  Bytes and bits scoring under minScore are left out
+func Diff(a []api.CanData, b []api.CanData, minScore float64) DiffReport {
+	idsA := collect(a)
+	idsB := collect(b)
+	report := DiffReport{OnlyA: sortedIds(idsA, idsB), OnlyB: sortedIds(idsB, idsA), Bytes: []ByteDiff{}, Bits: []BitDiff{}}
+	for arbId, va := range idsA {
+		vb, ok := idsB[arbId]
+		if !ok {
+			continue
+		}
+		for n := 0; n < 8; n++ {
+			if va.totals[n] == 0 || vb.totals[n] == 0 {
+				continue
+			}
+			ta, tb := float64(va.totals[n]), float64(vb.totals[n])
+			samples := va.totals[n]
+			if vb.totals[n] < samples {
+				samples = vb.totals[n]
+			}
+			distance := 0.0
+			for v, c := range va.counts[n] {
+				distance += math.Abs(float64(c)/ta - float64(vb.counts[n][v])/tb)
+			}
+			for v, c := range vb.counts[n] {
+				if _, seen := va.counts[n][v]; !seen {
+					distance += float64(c) / tb
+				}
+			}
+			diff := ByteDiff{ArbID: arbId, Byte: n, Distance: round(distance / 2), DistinctA: len(va.counts[n]), DistinctB: len(vb.counts[n]), Samples: samples}
+			value, count := mostCommon(va.counts[n])
+			diff.ValueA, diff.ShareA = fmt.Sprintf("%02X", value), float64(count)/ta
+			value, count = mostCommon(vb.counts[n])
+			diff.ValueB, diff.ShareB = fmt.Sprintf("%02X", value), float64(count)/tb
+			diff.Score = round(diff.Distance * math.Sqrt(math.Min(diff.ShareA, diff.ShareB)))
+			if diff.Score >= minScore {
+				report.Bytes = append(report.Bytes, diff)
+			}
+			for bit := n * 8; bit < n*8+8; bit++ {
+				setA, setB := float64(va.set[bit])/ta, float64(vb.set[bit])/tb
+				if score := round(math.Abs(setA - setB)); score >= minScore {
+					report.Bits = append(report.Bits, BitDiff{ArbID: arbId, Bit: bit, Score: score, SetA: setA, SetB: setB, Samples: samples})
+				}
+			}
+		}
+	}
+	sort.Slice(report.Bytes, func(i, j int) bool {
+		x, y := report.Bytes[i], report.Bytes[j]
+		if x.Score != y.Score {
+			return x.Score > y.Score
+		}
+		if x.Samples != y.Samples {
+			return x.Samples > y.Samples
+		}
+		if x.ArbID != y.ArbID {
+			return idLess(x.ArbID, y.ArbID)
+		}
+		return x.Byte < y.Byte
+	})
+	sort.Slice(report.Bits, func(i, j int) bool {
+		x, y := report.Bits[i], report.Bits[j]
+		if x.Score != y.Score {
+			return x.Score > y.Score
+		}
+		if x.Samples != y.Samples {
+			return x.Samples > y.Samples
+		}
+		if x.ArbID != y.ArbID {
+			return idLess(x.ArbID, y.ArbID)
+		}
+		return x.Bit < y.Bit
+	})
+	return report
+}
@@ -0,0 +1,261 @@
+package analysis
+
+const (
+	INTEGRITY_MIN_FRAMES = 8 // Distinct payloads needed before guessing
+)
+
+// Checksum algorithms, each computed over the payload without the checksum
+// byte and then XORed with a per ArbID constant.  The constant absorbs the
+// CRC init and final XOR, a sum's seed and data IDs hashed in first
+const (
+	CHECKSUM_XOR          = "XOR"
+	CHECKSUM_SUM          = "SUM"
+	CHECKSUM_CRC8_J1850   = "CRC8_SAE_J1850"
+	CHECKSUM_CRC8_AUTOSAR = "CRC8_AUTOSAR" // CRC8H2F
+)
+
+// ChecksumAlgorithms are tried in order, the first that fits wins
+var ChecksumAlgorithms = []string{CHECKSUM_XOR, CHECKSUM_SUM, CHECKSUM_CRC8_J1850, CHECKSUM_CRC8_AUTOSAR}
+
+var crcPolys = map[string]uint8{
+	CHECKSUM_CRC8_J1850:   0x1D,
+	CHECKSUM_CRC8_AUTOSAR: 0x2F,
+}
+
+// Counter is a rolling counter in a nibble or byte of the payload
+type Counter struct {
+	Byte   int
+	Shift  uint // 0 for the low nibble or whole byte, 4 for the high nibble
+	Bits   int  // 4 or 8
+	Modulo int  // Values run from 0 to Modulo-1
+	Step   int
+}
+
+// Value reads the counter from a payload
+func (c *Counter) Value(data []byte) int {
+	return int(data[c.Byte]>>c.Shift) & (1<<uint(c.Bits) - 1)
+}
+
+// Set writes value into the counter's bits
+func (c *Counter) Set(data []byte, value int) {
+	mask := byte(1<<uint(c.Bits)-1) << c.Shift
+	data[c.Byte] = data[c.Byte]&^mask | byte(value<<c.Shift)&mask
+}
+
+// Next returns the value that follows the one in data
+func (c *Counter) Next(data []byte) int {
+	return (c.Value(data) + c.Step) % c.Modulo
+}
+
+// Checksum is a byte computed from the rest of the payload
+type Checksum struct {
+	Byte      int
+	Algorithm string
+	Constant  uint8
+}
+
+func crc8(poly uint8, data []byte) uint8 {
+	crc := uint8(0)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// raw computes an algorithm over every byte but skip
+func raw(algorithm string, data []byte, skip int) uint8 {
+	var rest []byte
+	for i := range data {
+		if i != skip {
+			rest = append(rest, data[i])
+		}
+	}
+	switch algorithm {
+	case CHECKSUM_XOR:
+		var x uint8
+		for _, b := range rest {
+			x ^= b
+		}
+		return x
+	case CHECKSUM_SUM:
+		var sum uint8
+		for _, b := range rest {
+			sum += b
+		}
+		return sum
+	}
+	return crc8(crcPolys[algorithm], rest)
+}
+
+// constant is what ties the checksum byte to the raw value
+func constant(algorithm string, raw uint8, chk uint8) uint8 {
+	if algorithm == CHECKSUM_SUM {
+		return chk - raw
+	}
+	return chk ^ raw
+}
+
+// Compute returns the checksum byte for a payload
+func (c *Checksum) Compute(data []byte) uint8 {
+	r := raw(c.Algorithm, data, c.Byte)
+	if c.Algorithm == CHECKSUM_SUM {
+		return r + c.Constant
+	}
+	return r ^ c.Constant
+}
+
+// Integrity is the counter and checksum found on an ArbID, either may be nil
+type Integrity struct {
+	ArbID    string
+	Frames   int // Payloads looked at
+	Counter  *Counter
+	Checksum *Checksum
+}
+
+// Fill sets the counter to follow the one in last and then the checksum
+func (in *Integrity) Fill(data []byte, last []byte) {
+	if in.Counter != nil && in.Counter.Byte < len(data) && in.Counter.Byte < len(last) {
+		in.Counter.Set(data, in.Counter.Next(last))
+	}
+	if in.Checksum != nil && in.Checksum.Byte < len(data) {
+		data[in.Checksum.Byte] = in.Checksum.Compute(data)
+	}
+}
+
+// distinct drops repeated payloads and those of another length than the
+// last one
+func distinct(history [][]byte) [][]byte {
+	if len(history) == 0 {
+		return nil
+	}
+	length := len(history[len(history)-1])
+	seen := map[string]bool{}
+	var frames [][]byte
+	for _, data := range history {
+		if len(data) == length && !seen[string(data)] {
+			seen[string(data)] = true
+			frames = append(frames, data)
+		}
+	}
+	return frames
+}
+
+// detectChecksum tries the last byte, then the first, then the rest
+func detectChecksum(frames [][]byte) *Checksum {
+	length := len(frames[0])
+	positions := []int{length - 1}
+	for i := 0; i < length-1; i++ {
+		positions = append(positions, i)
+	}
+	for _, pos := range positions {
+		values := map[uint8]bool{}
+		for _, data := range frames {
+			values[data[pos]] = true
+		}
+		if len(values) < 2 {
+			continue // A constant byte fits anything
+		}
+		for _, algorithm := range ChecksumAlgorithms {
+			k := constant(algorithm, raw(algorithm, frames[0], pos), frames[0][pos])
+			fits := true
+			for _, data := range frames[1:] {
+				if constant(algorithm, raw(algorithm, data, pos), data[pos]) != k {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				return &Checksum{Byte: pos, Algorithm: algorithm, Constant: k}
+			}
+		}
+	}
+	return nil
+}
+
+// counterMisses checks a sequence counts by a fixed step modulo n and
+// returns the step and how many values break it.  A frame or two may have
+// been missed
+func counterMisses(values []int, n int) (int, int, bool) {
+	if n < 3 || len(values) < 2 {
+		return 0, 0, false
+	}
+	step := ((values[1]-values[0])%n + n) % n
+	if step == 0 {
+		return 0, 0, false
+	}
+	misses := 0
+	for i := 1; i < len(values); i++ {
+		if values[i] >= n || ((values[i]-values[i-1])%n+n)%n != step {
+			misses += 1
+		}
+	}
+	return step, misses, misses <= 1+len(values)/50
+}
+
+// detectCounter looks at whole bytes and nibbles, keeping the one with the
+// fewest misses.  A nibble counter under a constant nibble also counts as a
+// byte until it wraps, and on a tie the whole byte wins.  Counters are
+// checked in capture order, so the history must not be deduplicated
+func detectCounter(history [][]byte, skip int) *Counter {
+	length := len(history[len(history)-1])
+	fields := []Counter{}
+	for pos := 0; pos < length; pos++ {
+		if pos != skip {
+			fields = append(fields, Counter{Byte: pos, Bits: 8})
+		}
+	}
+	for pos := 0; pos < length; pos++ {
+		if pos != skip {
+			fields = append(fields, Counter{Byte: pos, Bits: 4}, Counter{Byte: pos, Shift: 4, Bits: 4})
+		}
+	}
+	var best *Counter
+	fewest := 0
+	for _, field := range fields {
+		var values []int
+		max := 0
+		for _, data := range history {
+			if len(data) != length {
+				continue
+			}
+			v := field.Value(data)
+			values = append(values, v)
+			if v > max {
+				max = v
+			}
+		}
+		for _, n := range []int{1 << uint(field.Bits), max + 1} {
+			step, misses, ok := counterMisses(values, n)
+			if ok && (best == nil || misses < fewest) {
+				c := field
+				c.Modulo, c.Step = n, step
+				best, fewest = &c, misses
+			}
+		}
+	}
+	return best
+}
+
+// DetectIntegrity looks for a rolling counter and a checksum in the recent
+// payloads of an ArbID, oldest first
+func DetectIntegrity(arbId string, history [][]byte) Integrity {
+	in := Integrity{ArbID: arbId, Frames: len(history)}
+	frames := distinct(history)
+	if len(frames) < INTEGRITY_MIN_FRAMES || len(frames[0]) == 0 {
+		return in
+	}
+	in.Checksum = detectChecksum(frames)
+	skip := -1
+	if in.Checksum != nil {
+		skip = in.Checksum.Byte
+	}
+	in.Counter = detectCounter(history, skip)
+	return in
+}
@@ -0,0 +1,259 @@
+// Package analysis works out what changes in sniffed traffic
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+const (
+	STATS_POLL    = 10 * time.Millisecond // How often the packet buffer is read
+	STATS_HISTORY = 128                   // Payloads kept per ArbID for DetectIntegrity
+)
+
+// IdStats is what has been seen on one ArbID.  Bit n of the payload is bit
+// n%8 of byte n/8, counting from the LSB as DBC little endian start bits do
+type IdStats struct {
+	ArbID       string
+	Extended    bool
+	Count       int
+	DLC         int     // Of the last packet
+	DLCChanged  bool    // Packets were seen with different lengths
+	MeanPeriod  float64 // Milliseconds between packets
+	MinPeriod   float64
+	MaxPeriod   float64
+	Data        string      // Last payload, hex
+	Flips       [64]int     // Times each bit changed
+	Heat        [64]float64 // Flips over the number of packets compared
+	ByteChanges [8]int      // Times each byte changed
+	Changed     [8]bool     // Bytes the last packet changed
+	last        []byte
+	history     [][]byte
+	filled      []byte // Last payload Fill made, it may not echo back
+	filledCount int    // Count when it was made
+	compared    int
+	seen        time.Time
+	periodSum   float64
+}
+
+// Stats keeps per ArbID counts, timing and bit flips of a device's traffic
+type Stats struct {
+	since     time.Time
+	ids       map[string]*IdStats
+	pktIdx    int
+	following bool
+	clock     time.Time
+	stop      chan bool
+	lock      sync.Mutex
+}
+
+func (s *Stats) add(pkt api.CanData, now time.Time) {
+	if s.ids == nil {
+		s.ids = map[string]*IdStats{}
+		s.since = now
+	}
+	id, ok := s.ids[pkt.ArbID]
+	if !ok {
+		id = &IdStats{ArbID: pkt.ArbID, Extended: pkt.Extended}
+		s.ids[pkt.ArbID] = id
+	}
+	if id.Count > 0 {
+		period := float64(now.Sub(id.seen)) / float64(time.Millisecond)
+		if id.Count == 1 || period < id.MinPeriod {
+			id.MinPeriod = period
+		}
+		if period > id.MaxPeriod {
+			id.MaxPeriod = period
+		}
+		id.periodSum += period
+		id.MeanPeriod = id.periodSum / float64(id.Count)
+	}
+	id.seen = now
+	id.Count += 1
+	if pkt.Remote {
+		return
+	}
+	data := pkt.Data()
+	if id.last != nil {
+		id.compared += 1
+		if len(data) != len(id.last) {
+			id.DLCChanged = true
+		}
+		for i := 0; i < 8; i++ {
+			var old, cur byte
+			if i < len(id.last) {
+				old = id.last[i]
+			}
+			if i < len(data) {
+				cur = data[i]
+			}
+			diff := old ^ cur
+			id.Changed[i] = diff != 0
+			if diff == 0 {
+				continue
+			}
+			id.ByteChanges[i] += 1
+			for b := uint(0); b < 8; b++ {
+				if diff&(1<<b) != 0 {
+					id.Flips[i*8+int(b)] += 1
+				}
+			}
+		}
+	}
+	id.DLC = len(data)
+	id.last = data
+	id.history = append(id.history, data)
+	if len(id.history) > STATS_HISTORY {
+		id.history = id.history[len(id.history)-STATS_HISTORY:]
+	}
+	id.Data = fmt.Sprintf("% X", data)
+}
+
+// Add counts one packet seen at t
+func (s *Stats) Add(pkt api.CanData, t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.add(pkt, t)
+}
+
+// Follow feeds in every packet the device recorded since the last call.
+// Packets with a RelTime from the capture are timed with it, the rest by
+// the RxTime the driver stamped them with.  The first call only marks where
+// to start
+func (s *Stats) Follow(dev api.CanDevice) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if !s.following {
+		s.pktIdx = dev.GetPacketIdx()
+		s.following = true
+		s.clock = now
+		return
+	}
+	var pkts []api.CanData
+	pkts, s.pktIdx = dev.GetPacketsFrom(s.pktIdx)
+	for i := range pkts {
+		rel, err := strconv.ParseFloat(strings.TrimSpace(pkts[i].RelTime), 64)
+		if err == nil && rel >= 0 {
+			s.clock = s.clock.Add(time.Duration(rel * float64(time.Second)))
+		} else if pkts[i].RxTime != 0 {
+			s.clock = time.Unix(0, pkts[i].RxTime)
+		} else {
+			s.clock = now
+		}
+		s.add(pkts[i], s.clock)
+	}
+}
+
+// Start follows the device in the background until Stop
+func (s *Stats) Start(dev api.CanDevice) {
+	s.lock.Lock()
+	if s.stop != nil {
+		s.lock.Unlock()
+		return
+	}
+	stop := make(chan bool)
+	s.stop = stop
+	s.lock.Unlock()
+	go func() {
+		for {
+			s.Follow(dev)
+			select {
+			case <-stop:
+				return
+			case <-time.After(STATS_POLL):
+			}
+		}
+	}()
+}
+
+// Stop ends background following, the counts are kept
+func (s *Stats) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+		s.following = false
+	}
+}
+
+// Running reports whether the device is being followed
+func (s *Stats) Running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stop != nil
+}
+
+// Reset forgets everything counted so far
+func (s *Stats) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ids = nil
+	s.since = time.Time{}
+}
+
+// GetStats returns a copy of every ArbID's stats ordered by ID, and when
+// the first of them was seen
+func (s *Stats) GetStats() ([]IdStats, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := []IdStats{}
+	for _, id := range s.ids {
+		copied := *id
+		if id.compared > 0 {
+			for i := range copied.Heat {
+				copied.Heat[i] = float64(id.Flips[i]) / float64(id.compared)
+			}
+		}
+		stats = append(stats, copied)
+	}
+	sort.Slice(stats, func(i, j int) bool { return idLess(stats[i].ArbID, stats[j].ArbID) })
+	return stats, s.since
+}
+
+// Fill sets the counter and checksum found on an ArbID in a payload about
+// to be sent.  The counter follows on from the last payload filled, unless
+// another has been seen since.  It returns false when there is nothing to fill
+func (s *Stats) Fill(arbId string, data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id, ok := s.ids[arbId]
+	if !ok {
+		return false
+	}
+	in := DetectIntegrity(arbId, id.history)
+	if in.Counter == nil && in.Checksum == nil {
+		return false
+	}
+	last := id.last
+	if id.filled != nil && id.filledCount == id.Count {
+		last = id.filled
+	}
+	in.Fill(data, last)
+	id.filled = append([]byte{}, data...)
+	id.filledCount = id.Count
+	return true
+}
+
+// GetIntegrity returns every ArbID a counter or checksum was found on,
+// ordered by ID
+func (s *Stats) GetIntegrity() []Integrity {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	found := []Integrity{}
+	for arbId, id := range s.ids {
+		in := DetectIntegrity(arbId, id.history)
+		if in.Counter != nil || in.Checksum != nil {
+			found = append(found, in)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return idLess(found[i].ArbID, found[j].ArbID) })
+	return found
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/ghetzel/canibus/logger"
 )
@@ -54,19 +55,22 @@ type HackSession interface {
 	IsActiveUser(User) bool
 	GetPackets(User) []CanData
 	InjectPacket(User, TransmitPacket) error
+	Close()
 }
 
 type TransmitPacket struct {
-	ArbId   string
-	Network string
-	B1      string
-	B2      string
-	B3      string
-	B4      string
-	B5      string
-	B6      string
-	B7      string
-	B8      string
+	ArbId    string
+	Extended bool // 29 bit ID, needed for extended IDs that fit in 11 bits
+	Network  string
+	B1       string
+	B2       string
+	B3       string
+	B4       string
+	B5       string
+	B6       string
+	B7       string
+	B8       string
+	DLC      string // Optional, all 8 bytes are sent when empty
 }
 
 type CanData struct {
@@ -74,6 +78,7 @@ type CanData struct {
 	SeqNo    int
 	AbsTime  string
 	RelTime  string
+	RxTime   int64 // Unix nanoseconds when the driver read the packet
 	Status   string
 	Error    string
 	Transmit string
@@ -94,6 +99,32 @@ type CanData struct {
 	Value    string
 	Trigger  string
 	Signals  string
+	DLC      int  // Payload length when HasDLC is set
+	HasDLC   bool // Packets built from B1-B8 alone carry all 8 bytes
+}
+
+// Data returns the payload bytes of the packet honoring DLC
+func (c *CanData) Data() []byte {
+	data := []byte{c.B1, c.B2, c.B3, c.B4, c.B5, c.B6, c.B7, c.B8}
+	if c.HasDLC && c.DLC >= 0 && c.DLC < 8 {
+		data = data[:c.DLC]
+	}
+	return data
+}
+
+// SetDLC sets the payload length, 0 is an empty frame
+func (c *CanData) SetDLC(dlc int) {
+	c.DLC = dlc
+	c.HasDLC = true
+}
+
+// SetData copies up to 8 bytes into B1-B8 and sets the DLC
+func (c *CanData) SetData(data []byte) {
+	b := make([]byte, 8)
+	n := copy(b, data)
+	c.B1, c.B2, c.B3, c.B4 = b[0], b[1], b[2], b[3]
+	c.B5, c.B6, c.B7, c.B8 = b[4], b[5], b[6], b[7]
+	c.SetDLC(n)
 }
 
 type CanibusAPIVersion struct {
@@ -146,10 +177,31 @@ func InitAPI() {
 
 func Hextoui8(s string) (n uint8, err error) {
 	bnum, err := hex.DecodeString(s)
+	if err != nil {
+		return
+	}
+	if len(bnum) == 0 {
+		return 0, logger.Err("No hex byte in " + s)
+	}
 	n = bnum[0]
 	return
 }
 
+// Hextoui32 converts a hex arbitration ID such as "7DF" to a number
+func Hextoui32(s string) (n uint32, err error) {
+	n64, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(s), "0x"), 16, 32)
+	n = uint32(n64)
+	return
+}
+
+// FormatArbId converts an arbitration ID to the hex string used in CanData
+func FormatArbId(id uint32, extended bool) string {
+	if extended {
+		return fmt.Sprintf("%08X", id)
+	}
+	return fmt.Sprintf("%03X", id)
+}
+
 func Atoui8(s string) (n uint8, err error) {
 	if s == "" {
 		return 0, nil
@@ -0,0 +1,297 @@
+package candevice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	CANNELLONI_PORT     = 20000
+	CANNELLONI_VERSION  = 2
+	CANNELLONI_OP_DATA  = 0
+	CANNELLONI_HDR_SIZE = 5
+	CANNELLONI_FD_FLAG  = 0x80 // Set in the length byte of CAN FD frames
+	CANNELLONI_MAX_PKT  = 1500
+)
+
+// Cannelloni bridges to a remote CAN interface tunnelled over UDP
+type Cannelloni struct {
+	PeerHost     string
+	PeerPort     int
+	LocalPort    int
+	Desc         string
+	HackSession  api.HackSession
+	Packets      [MAX_BUFFER]api.CanData
+	conn         *net.UDPConn
+	peer         *net.UDPAddr
+	txSeq        uint8
+	id           int
+	sniffEnabled bool
+	packetIdx    int
+	seqNo        int
+}
+
+func (c *Cannelloni) SetHost(host string) {
+	c.PeerHost = host
+}
+
+func (c *Cannelloni) SetPort(port int) {
+	c.PeerPort = port
+}
+
+func (c *Cannelloni) SetLocalPort(port int) {
+	c.LocalPort = port
+}
+
+func (c *Cannelloni) Init() bool {
+	if c.PeerPort == 0 {
+		c.PeerPort = CANNELLONI_PORT
+	}
+	if c.LocalPort == 0 {
+		c.LocalPort = CANNELLONI_PORT
+	}
+	c.Desc = "Not connected"
+	peer, err := net.ResolveUDPAddr("udp", net.JoinHostPort(c.PeerHost, strconv.Itoa(c.PeerPort)))
+	if err != nil {
+		logger.Log("Could not resolve cannelloni peer: " + err.Error())
+		return false
+	}
+	c.peer = peer
+	logger.Log(fmt.Sprintf("Starting cannelloni on port %d, peer %s", c.LocalPort, peer))
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.LocalPort})
+	if err != nil {
+		logger.Log("Could not bind cannelloni port: " + err.Error())
+		return false
+	}
+	c.conn = conn
+	c.Desc = fmt.Sprintf("Peer %s, local port %d", peer, c.LocalPort)
+	go c.readPackets()
+	return true
+}
+
+func (c *Cannelloni) readPackets() {
+	buf := make([]byte, CANNELLONI_MAX_PKT)
+	for {
+		n, src, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Log("cannelloni read error: " + err.Error())
+			return
+		}
+		if !c.fromPeer(src) {
+			logger.Log(fmt.Sprintf("cannelloni: dropped packet from %s", src))
+			continue
+		}
+		pkts, err := DecodeCannelloni(buf[:n])
+		if err != nil {
+			logger.Log("cannelloni: " + err.Error())
+			continue
+		}
+		if !c.sniffEnabled {
+			continue
+		}
+		for i := range pkts {
+			pkts[i].Src = "Cannelloni"
+			c.addPacket(pkts[i])
+		}
+	}
+}
+
+// fromPeer checks a datagram came from the configured peer.  A peer
+// without a host matches any address on the peer port
+func (c *Cannelloni) fromPeer(src *net.UDPAddr) bool {
+	if src == nil || src.Port != c.peer.Port {
+		return false
+	}
+	return c.peer.IP == nil || c.peer.IP.IsUnspecified() || c.peer.IP.Equal(src.IP)
+}
+
+// DecodeCannelloni unpacks every frame in a cannelloni data packet.
+// CAN FD frames are skipped since CanData only holds 8 bytes
+func DecodeCannelloni(buf []byte) ([]api.CanData, error) {
+	var pkts []api.CanData
+	if len(buf) < CANNELLONI_HDR_SIZE {
+		return nil, logger.Err("Short cannelloni packet")
+	}
+	if buf[0] != CANNELLONI_VERSION {
+		return nil, logger.Err(fmt.Sprintf("Unsupported cannelloni version %d", buf[0]))
+	}
+	if buf[1] != CANNELLONI_OP_DATA {
+		return nil, nil
+	}
+	count := int(binary.BigEndian.Uint16(buf[3:5]))
+	pos := CANNELLONI_HDR_SIZE
+	for i := 0; i < count; i++ {
+		if pos+5 > len(buf) {
+			return pkts, logger.Err("Truncated cannelloni packet")
+		}
+		canId := binary.BigEndian.Uint32(buf[pos : pos+4])
+		length := int(buf[pos+4])
+		pos += 5
+		fd := length&CANNELLONI_FD_FLAG != 0
+		if fd {
+			length &^= CANNELLONI_FD_FLAG
+			pos += 1 // FD flags
+		}
+		if canId&CAN_RTR_FLAG == 0 {
+			if pos+length > len(buf) {
+				return pkts, logger.Err("Truncated cannelloni frame")
+			}
+			if !fd && length <= 8 {
+				pkt := canIdToPacket(canId)
+				pkt.SetData(buf[pos : pos+length])
+				pkts = append(pkts, pkt)
+			}
+			pos += length
+		} else {
+			pkt := canIdToPacket(canId)
+			pkt.SetDLC(length)
+			pkts = append(pkts, pkt)
+		}
+	}
+	return pkts, nil
+}
+
+// canIdToPacket fills in the ID fields from a Linux style can_id
+func canIdToPacket(canId uint32) api.CanData {
+	pkt := api.CanData{}
+	pkt.Extended = canId&CAN_EFF_FLAG != 0
+	pkt.Remote = canId&CAN_RTR_FLAG != 0
+	if pkt.Extended {
+		pkt.ArbID = api.FormatArbId(canId&CAN_EFF_MASK, true)
+	} else {
+		pkt.ArbID = api.FormatArbId(canId&CAN_SFF_MASK, false)
+	}
+	return pkt
+}
+
+// EncodeCannelloni builds a data packet holding a single frame
+func EncodeCannelloni(pkt api.CanData, seq uint8) ([]byte, error) {
+	canId, err := api.Hextoui32(pkt.ArbID)
+	if err != nil {
+		return nil, logger.Err("Invalid ArbID: " + pkt.ArbID)
+	}
+	if pkt.Extended || canId > CAN_SFF_MASK {
+		canId = (canId & CAN_EFF_MASK) | CAN_EFF_FLAG
+	}
+	if pkt.Remote {
+		canId |= CAN_RTR_FLAG
+	}
+	data := pkt.Data()
+	buf := []byte{CANNELLONI_VERSION, CANNELLONI_OP_DATA, seq, 0, 1}
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, canId)
+	buf = append(buf, id...)
+	buf = append(buf, uint8(len(data)))
+	if !pkt.Remote {
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+func (c *Cannelloni) DeviceType() string {
+	return "Cannelloni"
+}
+
+func (c *Cannelloni) DeviceDesc() string {
+	return c.Desc
+}
+
+func (c *Cannelloni) GetId() int {
+	return c.id
+}
+
+func (c *Cannelloni) SetId(id int) {
+	c.id = id
+}
+
+func (c *Cannelloni) GetHackSession() api.HackSession {
+	return c.HackSession
+}
+
+func (c *Cannelloni) SetHackSession(hax api.HackSession) {
+	c.HackSession = hax
+}
+
+func (c *Cannelloni) GetYear() string {
+	return ""
+}
+
+func (c *Cannelloni) GetMake() string {
+	return ""
+}
+
+func (c *Cannelloni) GetModel() string {
+	return ""
+}
+
+func (c *Cannelloni) StartSniffing() {
+	c.packetIdx = 0
+	c.seqNo = 0
+	c.sniffEnabled = true
+}
+
+func (c *Cannelloni) StopSniffing() {
+	c.sniffEnabled = false
+}
+
+func (c *Cannelloni) addPacket(canpkt api.CanData) {
+	pkt := canpkt
+	pkt.SeqNo = c.seqNo
+	c.seqNo += 1
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
+	c.Packets[c.packetIdx] = pkt
+	c.packetIdx += 1
+	if c.packetIdx >= MAX_BUFFER {
+		c.packetIdx = 0
+	}
+}
+
+func (c *Cannelloni) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	var pkts []api.CanData
+	done := false
+	appends := 0
+	for done != true {
+		if idx >= MAX_BUFFER || idx < 0 {
+			idx = 0
+		}
+		if idx == c.packetIdx {
+			return pkts, c.packetIdx
+		}
+		pkts = append(pkts, c.Packets[idx])
+		idx += 1
+		appends += 1
+		if appends > MAX_APPENDS {
+			done = true
+		}
+	}
+	return pkts, c.packetIdx
+}
+
+func (c *Cannelloni) GetPacketIdx() int {
+	return c.packetIdx
+}
+
+func (c *Cannelloni) InjectPacket(pkt api.CanData) error {
+	if c.conn == nil {
+		return logger.Err("Cannelloni not initialized")
+	}
+	buf, err := EncodeCannelloni(pkt, c.txSeq)
+	if err != nil {
+		return err
+	}
+	c.txSeq += 1
+	_, err = c.conn.WriteToUDP(buf, c.peer)
+	if err != nil {
+		return logger.Err("Could not send cannelloni packet: " + err.Error())
+	}
+	c.addPacket(pkt)
+	return nil
+}
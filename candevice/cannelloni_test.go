@@ -0,0 +1,133 @@
+package candevice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+func TestCannelloni(t *testing.T) {
+	remote := api.CanData{ArbID: "7DF", Remote: true}
+	remote.SetDLC(3)
+	tests := []struct {
+		name string
+		pkt  api.CanData
+		want []byte
+	}{
+		{"standard", packet("7E8", false, false, []byte{0x02, 0x50, 0x01}),
+			[]byte{CANNELLONI_VERSION, CANNELLONI_OP_DATA, 7, 0, 1, 0, 0, 0x07, 0xE8, 3, 0x02, 0x50, 0x01}},
+		{"extended", packet("18DAF110", true, false, []byte{0xAA}),
+			[]byte{CANNELLONI_VERSION, CANNELLONI_OP_DATA, 7, 0, 1, 0x98, 0xDA, 0xF1, 0x10, 1, 0xAA}},
+		{"empty", packet("123", false, false, nil),
+			[]byte{CANNELLONI_VERSION, CANNELLONI_OP_DATA, 7, 0, 1, 0, 0, 0x01, 0x23, 0}},
+		{"remote", remote,
+			[]byte{CANNELLONI_VERSION, CANNELLONI_OP_DATA, 7, 0, 1, 0x40, 0, 0x07, 0xDF, 3}},
+	}
+	for _, tt := range tests {
+		buf, err := EncodeCannelloni(tt.pkt, 7)
+		if err != nil || string(buf) != string(tt.want) {
+			t.Errorf("%s: got % X err %v, want % X", tt.name, buf, err, tt.want)
+			continue
+		}
+		pkts, err := DecodeCannelloni(buf)
+		if err != nil || len(pkts) != 1 || describe(pkts[0]) != describe(tt.pkt) {
+			t.Errorf("%s: decoded %v err %v, want %s", tt.name, pkts, err, describe(tt.pkt))
+		}
+	}
+}
+
+func TestDecodeCannelloni(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want []string
+		err  bool
+	}{
+		{"two frames", []byte{2, 0, 0, 0, 2,
+			0, 0, 0x07, 0xE0, 2, 0x3E, 0x00,
+			0x80, 0, 0x01, 0x00, 1, 0xFF},
+			[]string{"7E0 ext=false rtr=false [3E 00]", "00000100 ext=true rtr=false [FF]"}, false},
+		{"FD frame skipped", []byte{2, 0, 0, 0, 2,
+			0, 0, 0x01, 0x23, 0x80 | 2, 0x00, 0x11, 0x22,
+			0, 0, 0x04, 0x56, 1, 0x33},
+			[]string{"456 ext=false rtr=false [33]"}, false},
+		{"other opcode", []byte{2, 1, 0, 0, 0}, nil, false},
+		{"short", []byte{2, 0, 0}, nil, true},
+		{"bad version", []byte{1, 0, 0, 0, 0}, nil, true},
+		{"truncated header", []byte{2, 0, 0, 0, 1, 0, 0, 0x01}, nil, true},
+		{"truncated data", []byte{2, 0, 0, 0, 1, 0, 0, 0x01, 0x23, 4, 0xAA}, nil, true},
+	}
+	for _, tt := range tests {
+		pkts, err := DecodeCannelloni(tt.buf)
+		if tt.err != (err != nil) {
+			t.Errorf("%s: err %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, pkt := range pkts {
+			got = append(got, describe(pkt))
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+// freeUDPPort finds a loopback port nothing is bound to
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestCannelloniPeers(t *testing.T) {
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	a := &Cannelloni{}
+	a.SetHost("127.0.0.1")
+	a.SetPort(portB)
+	a.SetLocalPort(portA)
+	b := &Cannelloni{}
+	b.SetHost("127.0.0.1")
+	b.SetPort(portA)
+	b.SetLocalPort(portB)
+	if !a.Init() || !b.Init() {
+		t.Fatal("Init failed")
+	}
+	defer a.conn.Close()
+	defer b.conn.Close()
+	b.StartSniffing()
+	defer b.StopSniffing()
+	// A stranger on another port is ignored
+	stranger, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: portB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	buf, _ := EncodeCannelloni(packet("666", false, false, []byte{0x66}), 0)
+	stranger.Write(buf)
+	time.Sleep(50 * time.Millisecond)
+	pkt := packet("18DAF110", true, false, []byte{0x02, 0x10, 0x03})
+	if err := a.InjectPacket(pkt); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.GetPacketIdx() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	pkts, _ := b.GetPacketsFrom(0)
+	if len(pkts) != 1 || describe(pkts[0]) != describe(pkt) {
+		t.Errorf("Peer received %v, want only %s", pkts, describe(pkt))
+	}
+}
@@ -0,0 +1,429 @@
+package candevice
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+// Capture file formats understood by the Simulator
+const (
+	CAPTURE_JSON       = "json"
+	CAPTURE_CANDUMP    = "candump"
+	CAPTURE_ASC        = "asc"
+	CAPTURE_TRC        = "trc"
+	CAPTURE_VEHICLESPY = "vehiclespy"
+)
+
+// DetectCaptureFormat picks a capture format from the file extension,
+// falling back to looking at the contents
+func DetectCaptureFormat(file string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return CAPTURE_JSON
+	case ".log":
+		return CAPTURE_CANDUMP
+	case ".asc":
+		return CAPTURE_ASC
+	case ".trc":
+		return CAPTURE_TRC
+	case ".csv":
+		return CAPTURE_VEHICLESPY
+	}
+	text := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(text, "["):
+		return CAPTURE_JSON
+	case strings.HasPrefix(text, "("):
+		return CAPTURE_CANDUMP
+	case strings.HasPrefix(text, ";"):
+		return CAPTURE_TRC
+	case strings.HasPrefix(text, "date "), strings.HasPrefix(text, "base "),
+		strings.Contains(text, "Begin Triggerblock"), strings.Contains(text, "Begin TriggerBlock"):
+		return CAPTURE_ASC
+	case strings.Contains(firstLine(text), ","):
+		return CAPTURE_VEHICLESPY
+	}
+	return ""
+}
+
+// ParseCaptureFile decodes a capture in any of the supported formats
+func ParseCaptureFile(file string, data []byte) ([]api.CanData, error) {
+	switch DetectCaptureFormat(file, data) {
+	case CAPTURE_JSON:
+		var pkts []api.CanData
+		err := json.Unmarshal(data, &pkts)
+		if err != nil {
+			return nil, logger.Err("Problem with json unmarshal sim data: " + err.Error())
+		}
+		for i := range pkts {
+			if pkts[i].DLC > 0 && !pkts[i].HasDLC {
+				pkts[i].HasDLC = true // Saved before HasDLC, when 0 meant 8
+			}
+		}
+		return pkts, nil
+	case CAPTURE_CANDUMP:
+		return ParseCandumpLog(data)
+	case CAPTURE_ASC:
+		return ParseASC(data)
+	case CAPTURE_TRC:
+		return ParseTRC(data)
+	case CAPTURE_VEHICLESPY:
+		return ParseVehicleSpyCSV(data)
+	}
+	return nil, logger.Err("Unknown capture format: " + file)
+}
+
+func firstLine(text string) string {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
+
+func captureLines(data []byte) []string {
+	return strings.Split(strings.Replace(string(data), "\r", "", -1), "\n")
+}
+
+// setCaptureTime stores the capture timestamp in seconds as AbsTime and
+// the time since the previous packet as RelTime, which is what the
+// Simulator uses to space out the replay
+func setCaptureTime(pkts []api.CanData, pkt *api.CanData, ts float64) {
+	pkt.AbsTime = fmt.Sprintf("%.6f", ts)
+	pkt.RelTime = "0.00000"
+	if len(pkts) > 0 {
+		prev, err := strconv.ParseFloat(pkts[len(pkts)-1].AbsTime, 64)
+		if err == nil {
+			pkt.RelTime = fmt.Sprintf("%.5f", ts-prev)
+		}
+	}
+}
+
+// parseArbId reads a hex ID.  IDs wider than sffDigits or over 11 bits
+// are extended
+func parseArbId(field string, sffDigits int, pkt *api.CanData) error {
+	id, err := api.Hextoui32(field)
+	if err != nil {
+		return logger.Err("Bad ArbID: " + field)
+	}
+	pkt.Extended = pkt.Extended || len(field) > sffDigits || id > CAN_SFF_MASK
+	pkt.ArbID = api.FormatArbId(id&CAN_EFF_MASK, pkt.Extended)
+	return nil
+}
+
+// parseDataBytes decodes one byte per field, in hex or decimal
+func parseDataBytes(fields []string, base int) ([]byte, error) {
+	if len(fields) > 8 {
+		fields = fields[:8]
+	}
+	data := make([]byte, len(fields))
+	for i := range fields {
+		b, err := strconv.ParseUint(fields[i], base, 8)
+		if err != nil {
+			return nil, logger.Err("Bad data byte: " + fields[i])
+		}
+		data[i] = uint8(b)
+	}
+	return data, nil
+}
+
+// ParseCandumpLog reads "candump -l" logs:
+//
+//	(1436509052.249713) can0 123#DEADBEEF
+//
+// CAN FD frames (##) are skipped
+func ParseCandumpLog(data []byte) ([]api.CanData, error) {
+	var pkts []api.CanData
+	for n, line := range captureLines(data) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "(") {
+			continue
+		}
+		ts, err := strconv.ParseFloat(strings.Trim(fields[0], "()"), 64)
+		if err != nil {
+			return pkts, logger.Err(fmt.Sprintf("candump line %d: bad timestamp", n+1))
+		}
+		frame := strings.SplitN(fields[2], "#", 2)
+		if len(frame) != 2 {
+			return pkts, logger.Err(fmt.Sprintf("candump line %d: bad frame", n+1))
+		}
+		if strings.HasPrefix(frame[1], "#") {
+			continue
+		}
+		pkt := api.CanData{Network: fields[1]}
+		err = parseArbId(frame[0], 3, &pkt)
+		if err != nil {
+			return pkts, err
+		}
+		if strings.HasPrefix(strings.ToUpper(frame[1]), "R") {
+			pkt.Remote = true
+			dlc, _ := strconv.Atoi(frame[1][1:])
+			pkt.SetDLC(dlc)
+		} else {
+			payload, err := hex.DecodeString(strings.Replace(frame[1], ".", "", -1))
+			if err != nil || len(payload) > 8 {
+				return pkts, logger.Err(fmt.Sprintf("candump line %d: bad data", n+1))
+			}
+			pkt.SetData(payload)
+		}
+		setCaptureTime(pkts, &pkt, ts)
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+// ParseASC reads Vector ASC logs.  Only classic CAN frames are loaded:
+//
+//	0.012345 1  123             Rx   d 8 01 02 03 04 05 06 07 08
+//	0.020000 2  18FEF100x       Tx   r
+func ParseASC(data []byte) ([]api.CanData, error) {
+	var pkts []api.CanData
+	base := 16
+	relative := false
+	last := 0.0
+	for _, line := range captureLines(data) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "base" && len(fields) >= 4 {
+			if fields[1] == "dec" {
+				base = 10
+			}
+			relative = fields[3] == "relative"
+			continue
+		}
+		if len(fields) < 5 {
+			continue
+		}
+		ts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		if _, err = strconv.Atoi(fields[1]); err != nil {
+			continue // Events, CANFD and statistics lines
+		}
+		dir := strings.ToLower(fields[3])
+		if dir != "rx" && dir != "tx" {
+			continue
+		}
+		if relative {
+			ts += last
+		}
+		last = ts
+		pkt := api.CanData{Network: "CAN" + fields[1]}
+		if dir == "tx" {
+			pkt.Transmit = "T"
+		}
+		idField := fields[2]
+		if strings.HasSuffix(strings.ToLower(idField), "x") {
+			pkt.Extended = true
+			idField = idField[:len(idField)-1]
+		}
+		if base == 10 {
+			id, err := strconv.ParseUint(idField, 10, 32)
+			if err != nil {
+				continue
+			}
+			idField = strconv.FormatUint(id, 16)
+		}
+		err = parseArbId(idField, len(idField), &pkt)
+		if err != nil {
+			return pkts, err
+		}
+		switch strings.ToLower(fields[4]) {
+		case "r":
+			pkt.Remote = true
+			if len(fields) > 5 {
+				dlc, _ := strconv.Atoi(fields[5])
+				pkt.SetDLC(dlc)
+			}
+		case "d":
+			if len(fields) < 6 {
+				continue
+			}
+			dlc, err := strconv.Atoi(fields[5])
+			if err != nil || dlc > 8 || len(fields) < 6+dlc {
+				continue
+			}
+			payload, err := parseDataBytes(fields[6:6+dlc], base)
+			if err != nil {
+				return pkts, err
+			}
+			pkt.SetData(payload)
+		default:
+			continue
+		}
+		setCaptureTime(pkts, &pkt, ts)
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+// Default TRC columns for files without a $COLUMNS header
+var trcColumns = map[string]string{
+	"1.0": "N,O,I,L,D",
+	"1.1": "N,O,d,I,L,D",
+	"1.2": "N,O,B,d,I,L,D",
+	"1.3": "N,O,B,d,I,R,L,D",
+	"2.0": "N,O,T,I,d,L,D",
+	"2.1": "N,O,T,B,I,d,R,L,D",
+}
+
+// ParseTRC reads PEAK PCAN-View trace files, versions 1.0 to 2.1.  The
+// time offset column is in milliseconds from the start of the trace
+func ParseTRC(data []byte) ([]api.CanData, error) {
+	var pkts []api.CanData
+	version := "1.0"
+	columns := ""
+	for _, line := range captureLines(data) {
+		text := strings.TrimSpace(line)
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, ";") {
+			if strings.HasPrefix(text, ";$FILEVERSION=") {
+				version = strings.TrimPrefix(text, ";$FILEVERSION=")
+			} else if strings.HasPrefix(text, ";$COLUMNS=") {
+				columns = strings.TrimPrefix(text, ";$COLUMNS=")
+			}
+			continue
+		}
+		if columns == "" {
+			columns = trcColumns[version]
+			if columns == "" {
+				return nil, logger.Err("Unsupported TRC version " + version)
+			}
+		}
+		cols := strings.Split(columns, ",")
+		fields := strings.Fields(text)
+		pkt := api.CanData{}
+		ts := 0.0
+		dlc := -1
+		ok := true
+		for i := 0; i < len(cols) && ok; i++ {
+			if i >= len(fields) {
+				if cols[i] != "D" {
+					ok = false
+				}
+				break
+			}
+			field := fields[i]
+			switch cols[i] {
+			case "N":
+				pkt.SeqNo, _ = strconv.Atoi(strings.TrimSuffix(field, ")"))
+			case "O":
+				ms, err := strconv.ParseFloat(field, 64)
+				ok = err == nil
+				ts = ms / 1000.0
+			case "T":
+				switch field {
+				case "DT":
+				case "RR":
+					pkt.Remote = true
+				default:
+					ok = false // Error, status and CAN FD frames
+				}
+			case "B":
+				pkt.Network = "CAN" + field
+			case "I":
+				ok = parseArbId(field, 4, &pkt) == nil
+			case "d":
+				if strings.ToLower(field) == "tx" {
+					pkt.Transmit = "T"
+				}
+			case "L", "l":
+				dlc, _ = strconv.Atoi(field)
+				ok = dlc >= 0 && dlc <= 8
+			case "D":
+				if field == "RTR" {
+					pkt.Remote = true
+					break
+				}
+				if pkt.Remote {
+					break
+				}
+				end := len(fields)
+				if dlc >= 0 && i+dlc <= end {
+					end = i + dlc
+				}
+				payload, err := parseDataBytes(fields[i:end], 16)
+				if err != nil {
+					return pkts, err
+				}
+				pkt.SetData(payload)
+			}
+		}
+		if !ok || pkt.ArbID == "" {
+			continue
+		}
+		if pkt.Remote && dlc >= 0 {
+			pkt.SetDLC(dlc)
+		}
+		setCaptureTime(pkts, &pkt, ts)
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+// ParseVehicleSpyCSV reads VehicleSpy CSV exports.  Rows that do not start
+// with a message number, such as headers, are skipped
+func ParseVehicleSpyCSV(data []byte) ([]api.CanData, error) {
+	var pkts []api.CanData
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	for {
+		row, err := r.Read()
+		if err != nil {
+			break
+		}
+		if len(row) < 12 {
+			continue
+		}
+		seqNo, err := strconv.Atoi(strings.TrimSpace(row[0]))
+		if err != nil {
+			continue
+		}
+		pkt := api.CanData{SeqNo: seqNo}
+		pkt.AbsTime = row[1]
+		pkt.RelTime = row[2]
+		pkt.Status = row[3]
+		pkt.Error = row[4]
+		pkt.Transmit = row[5]
+		pkt.Desc = row[6]
+		pkt.Network = row[7]
+		pkt.Node = row[8]
+		pkt.ArbID = row[9]
+		pkt.Remote = row[10] != "F"
+		pkt.Extended = row[11] != "F"
+		var payload []byte
+		for i := 12; i < 20 && i < len(row); i++ {
+			b, err := strconv.ParseUint(strings.TrimSpace(row[i]), 16, 8)
+			if err != nil {
+				break
+			}
+			payload = append(payload, uint8(b))
+		}
+		pkt.SetData(payload)
+		if len(row) > 20 {
+			pkt.Value = row[20]
+		}
+		if len(row) > 21 {
+			pkt.Trigger = row[21]
+		}
+		if len(row) > 22 {
+			pkt.Signals = row[22]
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
@@ -3,15 +3,35 @@ package candevice
 import (
 	"encoding/hex"
 	"fmt"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/isotp"
 	"github.com/ghetzel/canibus/logger"
 	"github.com/ghetzel/canibus/obd"
 	"github.com/ghetzel/canibus/serialbuffer"
 )
 
+const (
+	ELM_POLL_RATE   = 1 * time.Second // Default time between polling cycles
+	ELM_MAX_LINES   = 5               // Lines SendCmd reads before giving up on a prompt
+	OBD_MAX_SAMPLES = MAX_BUFFER
+)
+
+// elmFrameRegexp matches a frame printed with headers on, status lines such
+// as CAN ERROR or BUFFER FULL do not
+var elmFrameRegexp = regexp.MustCompile(`^[0-9A-F]{3,8}( [0-9A-F]{2}){1,8}$`)
+
+// ObdSample is one decoded Mode 01 value read while polling
+type ObdSample struct {
+	obd.PIDValue
+	Time int64  // Unix milliseconds
+	ECU  string // ArbID of the responding ECU
+}
+
 type Elm327 struct {
 	Serial            serialbuffer.SerialBuffer
 	Type              string
@@ -28,12 +48,41 @@ type Elm327 struct {
 	packetIdx         int
 	sniffEnabled      bool
 	seqNo             int
+	PollPIDs          []uint8
+	PollRate          time.Duration
+	ObdSamples        [OBD_MAX_SAMPLES]ObdSample
+	obdIdx            int
+	polling           bool
+	cmdLock           sync.Mutex
 }
 
 func (e *Elm327) SetSerial(port string) {
 	e.Serial.SetSerial(port)
 }
 
+// SetPollPIDs sets the Mode 01 PIDs read in each polling cycle
+func (e *Elm327) SetPollPIDs(pids []uint8) {
+	e.PollPIDs = pids
+}
+
+// SetPollRate sets the time between polling cycles in milliseconds
+func (e *Elm327) SetPollRate(ms int) {
+	if ms <= 0 {
+		e.PollRate = ELM_POLL_RATE
+	} else {
+		e.PollRate = time.Duration(ms) * time.Millisecond
+	}
+}
+
+// SetPolling switches between polling PIDs and ATMA monitoring while sniffing
+func (e *Elm327) SetPolling(poll bool) {
+	e.polling = poll
+}
+
+func (e *Elm327) IsPolling() bool {
+	return e.polling
+}
+
 func (e *Elm327) GetYear() string {
 	return e.Year
 }
@@ -65,7 +114,7 @@ func (e *Elm327) Init() bool {
 	e.Type = resp[0]
 	fmt.Println("Turning off echo")
 	e.SendCmd("ATE0")
-	e.SendCmd("ATH0")
+	e.SendCmd("ATH1")
 	vin := e.GetVIN()
 	if len(vin) > 0 {
 		fmt.Println("got vin: ", vin)
@@ -75,7 +124,6 @@ func (e *Elm327) Init() bool {
 		e.VehicleAttributes = obd.GetModelFromVIN(vin)
 	}
 	e.GetProto()
-	e.SendCmd("ATH1")
 	e.SendCmd("ATR0") // Turn off responses
 	return true
 }
@@ -120,76 +168,40 @@ func (e *Elm327) GetProto() string {
 	return e.Protocol
 }
 
+// GetVIN requests the VIN once and remembers it
 func (e *Elm327) GetVIN() string {
 	if e.VIN != "" {
 		return e.VIN
 	}
-	e.SendCmd("ATR1")
-	e.SendCmd("ATSH 7DF")
-	cmdResp, vin_err := e.SendCmd("09 02")
-	if vin_err != nil {
-		return vin_err.Error()
-	}
-	// TODO do not hard code this :)
-	vin := make([]byte, 34)
-	fmt.Println("DEBUG: cmdResp1", cmdResp[1])
-	fmt.Println("DEBUG: cmdResp2", cmdResp[2])
-	fmt.Println("DEBUG: cmdResp3", cmdResp[3])
-	resp := []byte(cmdResp[1])
-	vin[0] = resp[12]
-	vin[1] = resp[13]
-	vin[2] = resp[15]
-	vin[3] = resp[16]
-	vin[4] = resp[18]
-	vin[5] = resp[19]
-	resp = []byte(cmdResp[2])
-	vin[6] = resp[3]
-	vin[7] = resp[4]
-	vin[8] = resp[6]
-	vin[9] = resp[7]
-	vin[10] = resp[9]
-	vin[11] = resp[10]
-	vin[12] = resp[12]
-	vin[13] = resp[13]
-	vin[14] = resp[15]
-	vin[15] = resp[16]
-	vin[16] = resp[18]
-	vin[17] = resp[19]
-	vin[18] = resp[21]
-	vin[19] = resp[22]
-	resp = []byte(cmdResp[3])
-	vin[20] = resp[3]
-	vin[21] = resp[4]
-	vin[22] = resp[6]
-	vin[23] = resp[7]
-	vin[24] = resp[9]
-	vin[25] = resp[10]
-	vin[26] = resp[12]
-	vin[27] = resp[13]
-	vin[28] = resp[15]
-	vin[29] = resp[16]
-	vin[30] = resp[18]
-	vin[31] = resp[19]
-	vin[32] = resp[21]
-	vin[33] = resp[22]
-	vinAscii := make([]byte, 17)
-	hex.Decode(vinAscii, vin)
-	e.VIN = string(vinAscii)
-	return string(vinAscii)
+	vin, err := obd.ReadVIN(e.OBDRequest)
+	if err != nil {
+		return ""
+	}
+	e.VIN = vin
+	return e.VIN
 }
 
 // Sends a command then polls until it recieves a prompt
 func (e *Elm327) SendCmd(line string) ([]string, error) {
-	fmt.Println("DEBUG: Sending command: ", line)
+	return e.sendCmd(line, ELM_MAX_LINES)
+}
+
+// sendCmd sends a command and reads at most maxlines lines of the answer.
+// With maxlines 0 every line up to the prompt is read, for requests many
+// ECUs or frames may answer
+func (e *Elm327) sendCmd(line string, maxlines int) ([]string, error) {
+	e.cmdLock.Lock()
+	defer e.cmdLock.Unlock()
 	e.Serial.Writeln(line)
 	timeout := 10
-	maxlines := 5
+	limited := maxlines > 0
 	var result []string
 	done := false
 	for timeout > 0 && !done {
-		timeout -= 1
+		if limited {
+			timeout -= 1
+		}
 		resp, gotLine := e.Serial.ReadLn()
-		fmt.Println("DEBUG: gotLine", gotLine)
 		if gotLine {
 			maxlines -= 1
 		} else {
@@ -198,18 +210,16 @@ func (e *Elm327) SendCmd(line string) ([]string, error) {
 				done = true
 			}
 		}
-		if maxlines == 0 {
+		if limited && maxlines == 0 {
 			done = true
 		}
 		// Ignore ECHO
 		if line != resp {
-			fmt.Println("DEBUG: SendCmd resp=", resp)
 			if len(resp) > 1 {
 				result = append(result, string(resp))
 			}
 		}
 	}
-	fmt.Println("SendCmd Results: ", result)
 	if len(result) > 1 && strings.Contains(result[1], "UNABLE TO CONNECT") {
 		return nil, logger.Err("Unable to Connect to ECU")
 	}
@@ -354,10 +364,22 @@ func (e *Elm327) parsePacket(data string) api.CanData {
 	return pkt
 }
 
+// processPackets owns the serial port while sniffing, switching between
+// ATMA monitoring and PID polling
 func (e *Elm327) processPackets() {
+	for e.sniffEnabled == true {
+		if e.polling {
+			e.pollPIDs()
+		} else {
+			e.monitorPackets()
+		}
+	}
+}
+
+func (e *Elm327) monitorPackets() {
 	sniffing := false
 	var resp string
-	for e.sniffEnabled == true {
+	for e.sniffEnabled == true && !e.polling {
 		if !sniffing {
 			//fmt.Println("Writing ATMA")
 			e.Writeln("ATMA")
@@ -375,15 +397,165 @@ func (e *Elm327) processPackets() {
 				// do nothing
 			} else if strings.Contains(resp, "BUFFER FULL") {
 				sniffing = false
-			} else { // Attempt to parse packet
-				pkt := e.parsePacket(resp)
-				if pkt.ArbID != "" {
-					pkt.Src = "Elm327"
-					e.addPacket(pkt)
-				}
+			} else if pkt, ok := e.parseResponseLine(resp); ok {
+				pkt.Src = "Elm327"
+				e.addPacket(pkt)
+			}
+		}
+	}
+	if sniffing {
+		e.stopMonitor()
+	}
+}
+
+// stopMonitor interrupts ATMA and waits for the prompt
+func (e *Elm327) stopMonitor() {
+	e.Writeln("")
+	for i := 0; i < 10; i++ {
+		e.Serial.ReadLn()
+		if e.Serial.GotPrompt {
+			return
+		}
+	}
+}
+
+// pollPIDs requests each PollPID in turn every PollRate until polling stops
+func (e *Elm327) pollPIDs() {
+	if e.PollRate == 0 {
+		e.PollRate = ELM_POLL_RATE
+	}
+	e.SendCmd("ATR1")
+	e.SendCmd("ATSH 7DF")
+	e.Header = "7DF"
+	for e.sniffEnabled == true && e.polling {
+		start := time.Now()
+		pids := e.PollPIDs
+		for i := range pids {
+			if !e.sniffEnabled || !e.polling {
+				break
 			}
+			resp, err := e.SendCmd(fmt.Sprintf("01 %02X", pids[i]))
+			if err != nil {
+				logger.Log("ELM327 poll error: " + err.Error())
+				continue
+			}
+			for j := range resp {
+				e.handlePollResponse(pids[i], resp[j])
+			}
+		}
+		if len(pids) == 0 || time.Since(start) < e.PollRate {
+			time.Sleep(e.PollRate - time.Since(start))
+		}
+	}
+	e.SendCmd("ATR0")
+}
+
+// parseResponseLine parses a frame printed with headers on.  Adapter status
+// lines and anything else that is not a frame are refused
+func (e *Elm327) parseResponseLine(line string) (api.CanData, bool) {
+	line = strings.TrimRight(line, "\x00")
+	if len(line) > 1 && line[0] == e.Serial.GetPromptChar() {
+		line = line[1:]
+	}
+	line = strings.TrimSpace(line)
+	if !elmFrameRegexp.MatchString(line) {
+		return api.CanData{}, false
+	}
+	pkt := e.parsePacket(line + "\r")
+	pkt.SetDLC(len(strings.Fields(line)) - 1)
+	return pkt, true
+}
+
+func (e *Elm327) handlePollResponse(pid uint8, line string) {
+	pkt, ok := e.parseResponseLine(line)
+	if !ok || !obd.IsResponseId(pkt.ArbID) {
+		return
+	}
+	pkt.Src = "Elm327"
+	data := pkt.Data()
+	if len(data) >= 3 && data[1] == obd.MODE_CURRENT_DATA+obd.MODE_RESPONSE && data[2] == pid && int(data[0]) < len(data) && data[0] >= 2 {
+		val, err := obd.DecodeMode01(pid, data[3:1+data[0]])
+		if err == nil {
+			pkt.Desc = val.Name
+			pkt.Value = val.String()
+			e.addObdSample(ObdSample{PIDValue: val, Time: time.Now().UnixNano() / int64(time.Millisecond), ECU: pkt.ArbID})
 		}
 	}
+	e.addPacket(pkt)
+}
+
+// OBDRequest sends a request to every ECU and reassembles the answers.
+// Headers are on so each line is a raw CAN frame, the ELM327 takes care of
+// flow control itself.  Cannot be used while ATMA monitoring is running
+func (e *Elm327) OBDRequest(req []byte) ([]obd.Response, error) {
+	if e.sniffEnabled && !e.polling {
+		return nil, logger.Err("ELM327 is monitoring, stop sniffing or switch to polling first")
+	}
+	e.SendCmd("ATR1")
+	e.SendCmd("ATSH 7DF")
+	e.Header = "7DF"
+	resp, err := e.sendCmd(strings.ToUpper(hex.EncodeToString(req)), 0)
+	if !e.polling {
+		e.SendCmd("ATR0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var order []string
+	answers := map[string]*isotp.Reassembler{}
+	for i := range resp {
+		pkt, ok := e.parseResponseLine(resp[i])
+		if !ok || !obd.IsResponseId(pkt.ArbID) {
+			continue
+		}
+		ans, ok := answers[pkt.ArbID]
+		if !ok {
+			ans = &isotp.Reassembler{}
+			answers[pkt.ArbID] = ans
+			order = append(order, pkt.ArbID)
+		}
+		_, _, err = ans.Add(pkt.Data())
+		if err != nil {
+			logger.Log(pkt.ArbID + ": " + err.Error())
+		}
+	}
+	var resps []obd.Response
+	for i := range order {
+		if answers[order[i]].Done() {
+			resps = append(resps, obd.Response{ECU: order[i], Data: answers[order[i]].Data})
+		}
+	}
+	if len(resps) == 0 {
+		return nil, logger.Err("No response from any ECU")
+	}
+	return resps, nil
+}
+
+func (e *Elm327) addObdSample(sample ObdSample) {
+	e.ObdSamples[e.obdIdx] = sample
+	e.obdIdx += 1
+	if e.obdIdx >= OBD_MAX_SAMPLES {
+		e.obdIdx = 0
+	}
+}
+
+// GetObdSamplesFrom returns the polled values recorded since idx and the
+// index to ask for next time
+func (e *Elm327) GetObdSamplesFrom(idx int) ([]ObdSample, int) {
+	var samples []ObdSample
+	appends := 0
+	for appends <= MAX_APPENDS {
+		if idx >= OBD_MAX_SAMPLES || idx < 0 {
+			idx = 0
+		}
+		if idx == e.obdIdx {
+			break
+		}
+		samples = append(samples, e.ObdSamples[idx])
+		idx += 1
+		appends += 1
+	}
+	return samples, idx
 }
 
 func (e *Elm327) addPacket(canpkt api.CanData) {
@@ -391,7 +563,9 @@ func (e *Elm327) addPacket(canpkt api.CanData) {
 	pkt.SeqNo = e.seqNo
 	e.seqNo += 1
 	pkt.Src = canpkt.Src
-	pkt.AbsTime = time.Now().Format("10:00:00pm (EST)")
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
 	pkt.RelTime = "TODO" // TODO
 	pkt.Status = canpkt.Status
 	pkt.Error = canpkt.Error
@@ -410,6 +584,8 @@ func (e *Elm327) addPacket(canpkt api.CanData) {
 	pkt.B6 = canpkt.B6
 	pkt.B7 = canpkt.B7
 	pkt.B8 = canpkt.B8
+	pkt.DLC = canpkt.DLC
+	pkt.HasDLC = canpkt.HasDLC
 	pkt.Value = canpkt.Value
 	pkt.Trigger = canpkt.Trigger
 	e.Packets[e.packetIdx] = pkt
@@ -3,24 +3,94 @@ package candevice
 import (
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
+	"github.com/ghetzel/canibus/api"
 	"github.com/ghetzel/canibus/logger"
 	serial "github.com/tarm/goserial"
 )
 
+// GoodFET apps and verbs
+const (
+	GOODFET_APP_MONITOR = 0x00
+	GOODFET_APP_SPI     = 0x01
+	GOODFET_APP_DEBUG   = 0xFF
+	GOODFET_VERB_XFER   = 0x00
+	GOODFET_VERB_PEEK   = 0x02
+	GOODFET_VERB_SETUP  = 0x10
+	GOODFET_VERB_READY  = 0x7F
+)
+
+// MCP2515 SPI instructions and registers
+const (
+	MCP_RESET       = 0xC0
+	MCP_READ        = 0x03
+	MCP_WRITE       = 0x02
+	MCP_READ_STATUS = 0xA0
+	MCP_READ_RXB0   = 0x90
+	MCP_READ_RXB1   = 0x94
+	MCP_LOAD_TXB0   = 0x40
+	MCP_RTS_TXB0    = 0x81
+	MCP_CANSTAT     = 0x0E
+	MCP_CANCTRL     = 0x0F
+	MCP_CNF3        = 0x28
+	MCP_CANINTE     = 0x2B
+	MCP_TXB0CTRL    = 0x30
+	MCP_RXB0CTRL    = 0x60
+	MCP_RXB1CTRL    = 0x70
+	MCP_MODE_NORMAL = 0x00
+	MCP_MODE_LISTEN = 0x60
+	MCP_MODE_CONFIG = 0x80
+)
+
+const (
+	GOODTHOPTER_BAUD       = 115200
+	GOODTHOPTER_OSC        = 16000000 // MCP2515 crystal
+	GOODTHOPTER_BITRATE    = 500000
+	GOODTHOPTER_READY_WAIT = 5 * time.Second
+	GOODTHOPTER_REPLY_WAIT = 1 * time.Second
+)
+
+// goodfetReply is one reply read from the board
+type goodfetReply struct {
+	app  uint8
+	verb uint8
+	data []byte
+	err  error
+}
+
+// GoodThopter drives an MCP2515 through the GoodFET SPI app
 type GoodThopter struct {
-	SerialPort string
-	Serial     io.ReadWriteCloser
-	App        uint8
-	Verb       uint8
+	SerialPort   string
+	Serial       io.ReadWriteCloser
+	App          uint8
+	Verb         uint8
+	Data         []byte
+	Bitrate      int
+	Oscillator   int
+	ListenOnly   bool
+	Desc         string
+	HackSession  api.HackSession
+	Packets      [MAX_BUFFER]api.CanData
+	id           int
+	sniffEnabled bool
+	packetIdx    int
+	seqNo        int
+	lock         sync.Mutex // One GoodFET transaction at a time
+	replies      chan goodfetReply
 }
 
 func (mcp *GoodThopter) SetSerial(port string) {
 	mcp.SerialPort = port
 }
 
+func (mcp *GoodThopter) SetBitrate(bitrate int) {
+	mcp.Bitrate = bitrate
+}
+
 func (mcp *GoodThopter) DeviceDesc() string {
-	return "TODO: VIN"
+	return mcp.Desc
 }
 
 func (mcp *GoodThopter) DeviceType() string {
@@ -28,69 +98,446 @@ func (mcp *GoodThopter) DeviceType() string {
 }
 
 func (mcp *GoodThopter) Init() bool {
-	c := &serial.Config{Name: "/dev/ttyUSB0", Baud: 115200}
-	c.Name = mcp.SerialPort
+	logger.Log("Initializing GoodThopter on " + mcp.SerialPort)
+	mcp.Desc = "Not connected"
+	if mcp.Bitrate == 0 {
+		mcp.Bitrate = GOODTHOPTER_BITRATE
+	}
+	if mcp.Oscillator == 0 {
+		mcp.Oscillator = GOODTHOPTER_OSC
+	}
+	c := &serial.Config{Name: mcp.SerialPort, Baud: GOODTHOPTER_BAUD}
 	s, err := serial.OpenPort(c)
 	if err != nil {
 		logger.Log("Could not init GoodThopter")
 		return false
 	}
 	mcp.Serial = s
-	// setRTS(1)
-	// setDTR(1)
-	// setDTR(0)
-	mcp.readCmd()
-	if mcp.Verb != 0x7f {
-		logger.Log("TODO: didn't get proper verb. retry")
+	mcp.replies = make(chan goodfetReply, 16)
+	go readReplies(s, mcp.replies)
+	// TODO: goserial can not toggle RTS/DTR so the board has to be
+	// reset by hand to get the ready banner
+	err = mcp.waitReady()
+	if err != nil {
+		logger.Log("GoodThopter: " + err.Error())
+		s.Close()
 		return false
 	}
-	// infostring()
-	// monitorclocking()
-	// mon_connected()
+	info := mcp.infostring()
+	err = mcp.setupMCP()
+	if err != nil {
+		logger.Log("GoodThopter: " + err.Error())
+		return false
+	}
+	mcp.Desc = fmt.Sprintf("GoodFET %s @ %dkbps", info, mcp.Bitrate/1000)
 	return true
 }
 
-func (mcp *GoodThopter) readCmd() {
-	mcp.App = mcp.readByte()
-	mcp.Verb = mcp.readByte()
+// waitReady waits for the monitor's ready verb sent at boot
+func (mcp *GoodThopter) waitReady() error {
+	deadline := time.Now().Add(GOODTHOPTER_READY_WAIT)
+	for {
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return logger.Err("Timed out waiting for GoodFET, try resetting the board")
+		}
+		err := mcp.readCmd(wait)
+		if err != nil {
+			return err
+		}
+		if mcp.App == GOODFET_APP_MONITOR && mcp.Verb == GOODFET_VERB_READY {
+			return nil
+		}
+	}
+}
+
+// readReplies is the only reader of the port.  It passes every reply on
+// and logs and skips debug messages.  replies is closed after a read error
+func readReplies(port io.Reader, replies chan goodfetReply) {
+	defer close(replies)
+	for {
+		hdr := make([]byte, 4)
+		_, err := io.ReadFull(port, hdr)
+		if err != nil {
+			replies <- goodfetReply{err: logger.Err("Could not read from Thopter")}
+			return
+		}
+		count := int(hdr[2]) | int(hdr[3])<<8
+		data := make([]byte, count)
+		_, err = io.ReadFull(port, data)
+		if err != nil {
+			replies <- goodfetReply{err: logger.Err("Could not read from Thopter")}
+			return
+		}
+		if hdr[0] == GOODFET_APP_DEBUG {
+			logger.Log(fmt.Sprintf("GoodFET debug: %q", data))
+			continue
+		}
+		replies <- goodfetReply{app: hdr[0], verb: hdr[1], data: data}
+	}
+}
+
+// readCmd waits up to timeout for the next reply and puts it in App, Verb
+// and Data
+func (mcp *GoodThopter) readCmd(timeout time.Duration) error {
+	select {
+	case reply, ok := <-mcp.replies:
+		if !ok {
+			return logger.Err("Thopter connection closed")
+		}
+		if reply.err != nil {
+			return reply.err
+		}
+		mcp.App = reply.app
+		mcp.Verb = reply.verb
+		mcp.Data = reply.data
+		return nil
+	case <-time.After(timeout):
+		return logger.Err("Timed out waiting for Thopter")
+	}
 }
 
-// TODO verify the data type, probably an array
-func (mcp *GoodThopter) writeCmd(app uint8, verb uint8, count uint16, data uint8) {
-	mcp.writeByte(app)
-	mcp.writeByte(verb)
-	mcp.writeByte((uint8)(count & 0xff))
-	mcp.writeByte((uint8)(count >> 8))
-	// TODO use count for data as size of data
-	mcp.writeByte(data)
+// writeCmd sends a command with a length prefixed payload
+func (mcp *GoodThopter) writeCmd(app uint8, verb uint8, data []byte) error {
+	count := len(data)
+	pkt := []byte{app, verb, uint8(count & 0xff), uint8(count >> 8)}
+	pkt = append(pkt, data...)
+	_, err := mcp.Serial.Write(pkt)
+	if err != nil {
+		return logger.Err("Could not write to Thopter")
+	}
+	return nil
+}
+
+// transact sends a command and returns the reply payload
+func (mcp *GoodThopter) transact(app uint8, verb uint8, data []byte) ([]byte, error) {
+	mcp.lock.Lock()
+	defer mcp.lock.Unlock()
+	err := mcp.writeCmd(app, verb, data)
+	if err != nil {
+		return nil, err
+	}
+	err = mcp.readCmd(GOODTHOPTER_REPLY_WAIT)
+	if err != nil {
+		return nil, err
+	}
+	return mcp.Data, nil
 }
 
 func (mcp *GoodThopter) infostring() string {
-	a := mcp.monPeek8(0xf0)
-	b := mcp.monPeek8(0xf1)
-	// TODO: convert return to a string
+	a := mcp.monPeek8(0x0ff0)
+	b := mcp.monPeek8(0x0ff1)
 	return fmt.Sprintf("%02x%02x", a, b)
 }
 
-func (mcp *GoodThopter) readByte() uint8 {
-	buf := make([]byte, 128)
-	_, err := mcp.Serial.Read(buf)
-	if err != nil {
-		logger.Err("Could not read from Thopter")
+func (mcp *GoodThopter) monPeek8(address uint16) uint8 {
+	data, err := mcp.transact(GOODFET_APP_MONITOR, GOODFET_VERB_PEEK, []byte{uint8(address & 0xff), uint8(address >> 8)})
+	if err != nil || len(data) == 0 {
 		return 0
 	}
-	return buf[0]
+	return data[0]
+}
+
+// spiTrans clocks data through the MCP2515 and returns what came back
+func (mcp *GoodThopter) spiTrans(data []byte) ([]byte, error) {
+	resp, err := mcp.transact(GOODFET_APP_SPI, GOODFET_VERB_XFER, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < len(data) {
+		return nil, logger.Err("Short SPI reply from Thopter")
+	}
+	return resp, nil
+}
+
+func (mcp *GoodThopter) readReg(reg uint8) (uint8, error) {
+	resp, err := mcp.spiTrans([]byte{MCP_READ, reg, 0})
+	if err != nil {
+		return 0, err
+	}
+	return resp[2], nil
+}
+
+func (mcp *GoodThopter) writeRegs(reg uint8, values ...uint8) error {
+	_, err := mcp.spiTrans(append([]byte{MCP_WRITE, reg}, values...))
+	return err
+}
+
+// setupMCP resets the MCP2515, sets the bitrate, opens the receive filters
+// and leaves it in normal (or listen only) mode
+func (mcp *GoodThopter) setupMCP() error {
+	_, err := mcp.transact(GOODFET_APP_SPI, GOODFET_VERB_SETUP, nil)
+	if err != nil {
+		return err
+	}
+	_, err = mcp.spiTrans([]byte{MCP_RESET})
+	if err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	err = mcp.setMode(MCP_MODE_CONFIG)
+	if err != nil {
+		return err
+	}
+	cnf1, cnf2, cnf3, err := MCP2515BitTiming(mcp.Oscillator, mcp.Bitrate)
+	if err != nil {
+		return err
+	}
+	// CNF3, CNF2 and CNF1 are consecutive registers
+	err = mcp.writeRegs(MCP_CNF3, cnf3, cnf2, cnf1)
+	if err != nil {
+		return err
+	}
+	// Receive everything, let RXB0 roll over into RXB1.  We poll
+	// CANINTF so the interrupt pin is left off
+	mcp.writeRegs(MCP_CANINTE, 0x00)
+	mcp.writeRegs(MCP_RXB0CTRL, 0x64)
+	mcp.writeRegs(MCP_RXB1CTRL, 0x60)
+	if mcp.ListenOnly {
+		return mcp.setMode(MCP_MODE_LISTEN)
+	}
+	return mcp.setMode(MCP_MODE_NORMAL)
+}
+
+func (mcp *GoodThopter) setMode(mode uint8) error {
+	err := mcp.writeRegs(MCP_CANCTRL, mode)
+	if err != nil {
+		return err
+	}
+	stat, err := mcp.readReg(MCP_CANSTAT)
+	if err != nil {
+		return err
+	}
+	if stat&0xE0 != mode {
+		return logger.Err(fmt.Sprintf("MCP2515 did not enter mode %02x (CANSTAT %02x)", mode, stat))
+	}
+	return nil
+}
+
+// MCP2515BitTiming works out CNF1-3 for a bitrate, sampling around 75%
+func MCP2515BitTiming(osc int, bitrate int) (uint8, uint8, uint8, error) {
+	for tq := 25; tq >= 8; tq-- {
+		if osc%(2*tq*bitrate) != 0 {
+			continue
+		}
+		brp := osc / (2 * tq * bitrate)
+		if brp < 1 || brp > 64 {
+			continue
+		}
+		ps2 := (tq + 2) / 4
+		if ps2 < 2 {
+			ps2 = 2
+		}
+		prop := (tq - 1 - ps2) / 2
+		ps1 := tq - 1 - ps2 - prop
+		if prop < 1 || prop > 8 || ps1 < 1 || ps1 > 8 || ps2 > 8 {
+			continue
+		}
+		cnf1 := uint8(brp - 1) // SJW = 1
+		cnf2 := uint8(0x80 | (ps1-1)<<3 | (prop - 1))
+		cnf3 := uint8(ps2 - 1)
+		return cnf1, cnf2, cnf3, nil
+	}
+	return 0, 0, 0, logger.Err(fmt.Sprintf("No MCP2515 timing for %d bps with a %d Hz crystal", bitrate, osc))
+}
+
+func (mcp *GoodThopter) GetId() int {
+	return mcp.id
+}
+
+func (mcp *GoodThopter) SetId(id int) {
+	mcp.id = id
+}
+
+func (mcp *GoodThopter) GetHackSession() api.HackSession {
+	return mcp.HackSession
 }
 
-func (mcp *GoodThopter) writeByte(b uint8) {
-	data := make([]byte, b)
-	_, err := mcp.Serial.Write(data)
+func (mcp *GoodThopter) SetHackSession(hax api.HackSession) {
+	mcp.HackSession = hax
+}
+
+func (mcp *GoodThopter) GetYear() string {
+	return ""
+}
+
+func (mcp *GoodThopter) GetMake() string {
+	return ""
+}
+
+func (mcp *GoodThopter) GetModel() string {
+	return ""
+}
+
+func (mcp *GoodThopter) StartSniffing() {
+	mcp.sniffEnabled = true
+	mcp.packetIdx = 0
+	mcp.seqNo = 0
+	go mcp.processPackets()
+}
+
+func (mcp *GoodThopter) StopSniffing() {
+	mcp.sniffEnabled = false
+}
+
+// processPackets polls the receive buffer flags and drains full buffers
+func (mcp *GoodThopter) processPackets() {
+	if mcp.Serial == nil {
+		logger.Log("GoodThopter not initialized")
+		return
+	}
+	for mcp.sniffEnabled == true {
+		resp, err := mcp.spiTrans([]byte{MCP_READ_STATUS, 0})
+		if err != nil {
+			logger.Log("GoodThopter: " + err.Error())
+			mcp.sniffEnabled = false
+			return
+		}
+		status := resp[1]
+		if status&0x03 == 0 {
+			time.Sleep(1 * time.Millisecond)
+			continue
+		}
+		if status&0x01 != 0 {
+			mcp.readRxBuffer(MCP_READ_RXB0)
+		}
+		if status&0x02 != 0 {
+			mcp.readRxBuffer(MCP_READ_RXB1)
+		}
+	}
+}
+
+// readRxBuffer reads a receive buffer, which also clears its interrupt flag
+func (mcp *GoodThopter) readRxBuffer(cmd uint8) {
+	resp, err := mcp.spiTrans(append([]byte{cmd}, make([]byte, 13)...))
+	if err != nil {
+		logger.Log("GoodThopter: " + err.Error())
+		return
+	}
+	pkt := DecodeMCP2515Frame(resp[1:])
+	pkt.Src = "GoodThopter"
+	mcp.addPacket(pkt)
+}
+
+// DecodeMCP2515Frame decodes SIDH, SIDL, EID8, EID0, DLC and data registers
+func DecodeMCP2515Frame(regs []byte) api.CanData {
+	pkt := api.CanData{}
+	sid := uint32(regs[0])<<3 | uint32(regs[1])>>5
+	if regs[1]&0x08 != 0 {
+		pkt.Extended = true
+		eid := sid<<18 | uint32(regs[1]&0x03)<<16 | uint32(regs[2])<<8 | uint32(regs[3])
+		pkt.ArbID = api.FormatArbId(eid, true)
+		pkt.Remote = regs[4]&0x40 != 0
+	} else {
+		pkt.ArbID = api.FormatArbId(sid, false)
+		pkt.Remote = regs[1]&0x10 != 0
+	}
+	dlc := int(regs[4] & 0x0F)
+	if dlc > 8 {
+		dlc = 8
+	}
+	pkt.SetData(regs[5 : 5+dlc])
+	return pkt
+}
+
+// EncodeMCP2515Frame builds the TX buffer registers for a packet
+func EncodeMCP2515Frame(pkt api.CanData) ([]byte, error) {
+	arbId, err := api.Hextoui32(pkt.ArbID)
 	if err != nil {
-		logger.Err("Could not write to Thopter")
+		return nil, logger.Err("Invalid ArbID: " + pkt.ArbID)
+	}
+	regs := make([]byte, 5)
+	if pkt.Extended || arbId > CAN_SFF_MASK {
+		arbId &= CAN_EFF_MASK
+		regs[0] = uint8(arbId >> 21)
+		regs[1] = uint8((arbId>>18)&0x07)<<5 | 0x08 | uint8((arbId>>16)&0x03)
+		regs[2] = uint8(arbId >> 8)
+		regs[3] = uint8(arbId)
+	} else {
+		regs[0] = uint8(arbId >> 3)
+		regs[1] = uint8(arbId&0x07) << 5
+	}
+	data := pkt.Data()
+	regs[4] = uint8(len(data))
+	if pkt.Remote {
+		regs[4] |= 0x40
+	} else {
+		regs = append(regs, data...)
+	}
+	return regs, nil
+}
+
+func (mcp *GoodThopter) addPacket(canpkt api.CanData) {
+	pkt := canpkt
+	pkt.SeqNo = mcp.seqNo
+	mcp.seqNo += 1
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
+	mcp.Packets[mcp.packetIdx] = pkt
+	mcp.packetIdx += 1
+	if mcp.packetIdx >= MAX_BUFFER {
+		mcp.packetIdx = 0
+	}
+}
+
+func (mcp *GoodThopter) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	var pkts []api.CanData
+	done := false
+	appends := 0
+	for done != true {
+		if idx >= MAX_BUFFER || idx < 0 {
+			idx = 0
+		}
+		if idx == mcp.packetIdx {
+			return pkts, mcp.packetIdx
+		}
+		pkts = append(pkts, mcp.Packets[idx])
+		idx += 1
+		appends += 1
+		if appends > MAX_APPENDS {
+			done = true
+		}
 	}
+	return pkts, mcp.packetIdx
 }
 
-func (mcp *GoodThopter) monPeek8(address uint8) uint8 {
-	mcp.writeCmd(0, 0x02, 2, address)
-	return address // TODO double check this function
+func (mcp *GoodThopter) GetPacketIdx() int {
+	return mcp.packetIdx
+}
+
+// InjectPacket loads TXB0 and requests to send once it is free
+func (mcp *GoodThopter) InjectPacket(pkt api.CanData) error {
+	if mcp.Serial == nil {
+		return logger.Err("GoodThopter not initialized")
+	}
+	regs, err := EncodeMCP2515Frame(pkt)
+	if err != nil {
+		return err
+	}
+	timeout := 100
+	for {
+		ctrl, err := mcp.readReg(MCP_TXB0CTRL)
+		if err != nil {
+			return err
+		}
+		if ctrl&0x08 == 0 { // TXREQ clear
+			break
+		}
+		timeout -= 1
+		if timeout == 0 {
+			return logger.Err("GoodThopter transmit buffer busy")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	_, err = mcp.spiTrans(append([]byte{MCP_LOAD_TXB0}, regs...))
+	if err != nil {
+		return err
+	}
+	_, err = mcp.spiTrans([]byte{MCP_RTS_TXB0})
+	if err != nil {
+		return err
+	}
+	mcp.addPacket(pkt)
+	return nil
 }
@@ -0,0 +1,123 @@
+package candevice
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGoodFET plays a GoodFET monitor with an MCP2515 on the SPI app.
+// rx holds the receive buffer registers handed out once
+type fakeGoodFET struct {
+	port *os.File
+	regs [256]byte
+	rx   []byte
+	sent [][]byte // TXB0 loads
+	rts  int
+	lock sync.Mutex
+}
+
+func (f *fakeGoodFET) reply(app uint8, verb uint8, data []byte) {
+	f.port.Write(append([]byte{app, verb, uint8(len(data)), uint8(len(data) >> 8)}, data...))
+}
+
+func (f *fakeGoodFET) run() {
+	f.reply(GOODFET_APP_DEBUG, 0xFF, []byte("booting"))
+	f.reply(GOODFET_APP_MONITOR, GOODFET_VERB_READY, []byte("http://goodfet.sf.net/"))
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(f.port, hdr); err != nil {
+			return
+		}
+		data := make([]byte, int(hdr[2])|int(hdr[3])<<8)
+		if _, err := io.ReadFull(f.port, data); err != nil {
+			return
+		}
+		switch {
+		case hdr[0] == GOODFET_APP_MONITOR && hdr[1] == GOODFET_VERB_PEEK:
+			f.reply(hdr[0], hdr[1], []byte{0xF2})
+		case hdr[0] == GOODFET_APP_SPI && hdr[1] == GOODFET_VERB_SETUP:
+			f.reply(hdr[0], hdr[1], nil)
+		case hdr[0] == GOODFET_APP_SPI && hdr[1] == GOODFET_VERB_XFER:
+			f.reply(hdr[0], hdr[1], f.spi(data))
+		}
+	}
+}
+
+// spi answers an MCP2515 instruction
+func (f *fakeGoodFET) spi(in []byte) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	out := make([]byte, len(in))
+	switch in[0] {
+	case MCP_WRITE:
+		copy(f.regs[in[1]:], in[2:])
+		if in[1] == MCP_CANCTRL {
+			f.regs[MCP_CANSTAT] = in[2] & 0xE0
+		}
+	case MCP_READ:
+		out[2] = f.regs[in[1]]
+	case MCP_READ_STATUS:
+		if f.rx != nil {
+			out[1] = 0x01
+		}
+	case MCP_READ_RXB0:
+		copy(out[1:], f.rx)
+		f.rx = nil
+	case MCP_LOAD_TXB0:
+		f.sent = append(f.sent, append([]byte{}, in[1:]...))
+	case MCP_RTS_TXB0:
+		f.rts += 1
+	}
+	return out
+}
+
+func TestGoodThopterFakeBoard(t *testing.T) {
+	m, name := openPty(t)
+	fake := &fakeGoodFET{port: m, rx: []byte{0xFD, 0x00, 0, 0, 3, 0x41, 0x0C, 0x1A}}
+	go fake.run()
+	g := &GoodThopter{}
+	g.SetSerial(name)
+	g.SetBitrate(250000)
+	if !g.Init() {
+		t.Fatal("Init failed")
+	}
+	if g.Desc != "GoodFET f2f2 @ 250kbps" {
+		t.Errorf("Desc %q", g.Desc)
+	}
+	cnf1, cnf2, cnf3, _ := MCP2515BitTiming(GOODTHOPTER_OSC, 250000)
+	fake.lock.Lock()
+	if cnf := fake.regs[MCP_CNF3 : MCP_CNF3+3]; !bytes.Equal(cnf, []byte{cnf3, cnf2, cnf1}) {
+		t.Errorf("CNF3-1 % X, want %02X %02X %02X", cnf, cnf3, cnf2, cnf1)
+	}
+	if mode := fake.regs[MCP_CANCTRL]; mode != MCP_MODE_NORMAL {
+		t.Errorf("CANCTRL %02X", mode)
+	}
+	fake.lock.Unlock()
+	g.StartSniffing()
+	defer g.StopSniffing()
+	deadline := time.Now().Add(2 * time.Second)
+	for g.GetPacketIdx() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pkts, _ := g.GetPacketsFrom(0)
+	if len(pkts) != 1 || describe(pkts[0]) != "7E8 ext=false rtr=false [41 0C 1A]" {
+		t.Fatalf("Sniffed %v", pkts)
+	}
+	pkt := packet("18DAF110", true, false, []byte{0x02, 0x10, 0x03})
+	if err := g.InjectPacket(pkt); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := EncodeMCP2515Frame(pkt)
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if len(fake.sent) != 1 || !bytes.Equal(fake.sent[0], want) || fake.rts != 1 {
+		t.Errorf("Loaded % X with %d RTS, want % X", fake.sent, fake.rts, want)
+	}
+	if pkts, _ = g.GetPacketsFrom(1); len(pkts) != 1 || describe(pkts[0]) != describe(pkt) {
+		t.Errorf("Injected packet not recorded: %v", pkts)
+	}
+}
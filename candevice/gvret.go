@@ -0,0 +1,371 @@
+package candevice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+	serial "github.com/tarm/goserial"
+)
+
+// GVRET binary protocol commands
+const (
+	GVRET_START_BINARY  = 0xE7
+	GVRET_CMD           = 0xF1
+	GVRET_CAN_FRAME     = 0x00
+	GVRET_TIME_SYNC     = 0x01
+	GVRET_SETUP_CANBUS  = 0x05
+	GVRET_GET_CANBUS    = 0x06
+	GVRET_GET_DEV_INFO  = 0x07
+	GVRET_KEEPALIVE     = 0x09
+	GVRET_GET_NUM_BUSES = 0x0C
+)
+
+const (
+	GVRET_BAUD      = 115200
+	GVRET_BITRATE   = 500000
+	GVRET_MAX_BUS   = 2
+	GVRET_INFO_WAIT = 1 * time.Second
+)
+
+// GVRET talks to Macchina M2, CANDue and ESP32RET boards in binary mode
+type GVRET struct {
+	SerialPort    string
+	Serial        io.ReadWriteCloser
+	BusSpeeds     [GVRET_MAX_BUS]int
+	NumBuses      int
+	Build         int
+	Desc          string
+	HackSession   api.HackSession
+	Packets       [MAX_BUFFER]api.CanData
+	id            int
+	sniffEnabled  bool
+	packetIdx     int
+	seqNo         int
+	lastTimestamp uint32
+	haveTimestamp bool
+	gotInfo       chan bool
+	writeLock     sync.Mutex
+}
+
+func (g *GVRET) SetSerial(port string) {
+	g.SerialPort = port
+}
+
+// SetBusSpeed sets the bitrate used for a bus when the device is initialized
+func (g *GVRET) SetBusSpeed(bus int, bitrate int) {
+	if bus >= 0 && bus < GVRET_MAX_BUS {
+		g.BusSpeeds[bus] = bitrate
+	}
+}
+
+func (g *GVRET) Init() bool {
+	logger.Log("Initializing GVRET on " + g.SerialPort)
+	g.Desc = "Not connected"
+	c := &serial.Config{Name: g.SerialPort, Baud: GVRET_BAUD}
+	s, err := serial.OpenPort(c)
+	if err != nil {
+		logger.Log("Could not open GVRET device")
+		return false
+	}
+	g.Serial = s
+	g.gotInfo = make(chan bool, 1)
+	go g.readPackets()
+	err = g.write([]byte{GVRET_START_BINARY, GVRET_START_BINARY})
+	if err != nil {
+		logger.Log("GVRET: " + err.Error())
+		return false
+	}
+	for i := range g.BusSpeeds {
+		if g.BusSpeeds[i] == 0 {
+			g.BusSpeeds[i] = GVRET_BITRATE
+		}
+	}
+	err = g.SetupBuses()
+	if err != nil {
+		logger.Log("GVRET: " + err.Error())
+		return false
+	}
+	g.write([]byte{GVRET_CMD, GVRET_GET_NUM_BUSES})
+	g.write([]byte{GVRET_CMD, GVRET_GET_DEV_INFO})
+	select {
+	case <-g.gotInfo:
+		g.Desc = fmt.Sprintf("GVRET build %d on %s", g.Build, g.SerialPort)
+	case <-time.After(GVRET_INFO_WAIT):
+		logger.Log("GVRET did not answer device info request")
+		g.Desc = "GVRET on " + g.SerialPort
+	}
+	return true
+}
+
+// SetupBuses sends the configured bus speeds.  A speed of -1 disables the bus
+func (g *GVRET) SetupBuses() error {
+	cmd := []byte{GVRET_CMD, GVRET_SETUP_CANBUS}
+	for i := range g.BusSpeeds {
+		val := uint32(0x80000000) // Apply enable bit
+		if g.BusSpeeds[i] > 0 {
+			val |= 0x40000000 | uint32(g.BusSpeeds[i])
+		}
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, val)
+		cmd = append(cmd, b...)
+	}
+	return g.write(cmd)
+}
+
+func (g *GVRET) write(data []byte) error {
+	g.writeLock.Lock()
+	defer g.writeLock.Unlock()
+	_, err := g.Serial.Write(data)
+	if err != nil {
+		return logger.Err("Could not write to GVRET")
+	}
+	return nil
+}
+
+// readPackets runs for the life of the device handling every reply
+func (g *GVRET) readPackets() {
+	buf := make([]byte, 256)
+	var msg []byte
+	for {
+		n, err := g.Serial.Read(buf)
+		if err != nil {
+			logger.Log("GVRET read error: " + err.Error())
+			return
+		}
+		for i := 0; i < n; i++ {
+			if len(msg) == 0 && buf[i] != GVRET_CMD {
+				continue
+			}
+			msg = append(msg, buf[i])
+			need := gvretMsgLen(msg)
+			if need < 0 {
+				msg = nil
+			} else if need > 0 && len(msg) >= need {
+				g.handleMsg(msg)
+				msg = nil
+			}
+		}
+	}
+}
+
+// gvretMsgLen returns the full length of a message given its first bytes,
+// 0 if more bytes are needed to tell, or -1 for unknown commands
+func gvretMsgLen(msg []byte) int {
+	if len(msg) < 2 {
+		return 0
+	}
+	switch msg[1] {
+	case GVRET_CAN_FRAME:
+		// cmd, ts(4), id(4), bus/len, data, checksum
+		if len(msg) < 11 {
+			return 0
+		}
+		return 11 + int(msg[10]&0x0F) + 1
+	case GVRET_TIME_SYNC:
+		return 6
+	case GVRET_GET_CANBUS:
+		return 12
+	case GVRET_GET_DEV_INFO:
+		return 8
+	case GVRET_KEEPALIVE:
+		return 4
+	case GVRET_GET_NUM_BUSES:
+		return 3
+	}
+	return -1
+}
+
+func (g *GVRET) handleMsg(msg []byte) {
+	switch msg[1] {
+	case GVRET_CAN_FRAME:
+		pkt, ts := DecodeGVRETFrame(msg)
+		if g.sniffEnabled {
+			pkt.Src = "GVRET"
+			pkt.RelTime = g.relTime(ts)
+			g.addPacket(pkt)
+		}
+	case GVRET_GET_DEV_INFO:
+		g.Build = int(binary.LittleEndian.Uint16(msg[2:4]))
+		select {
+		case g.gotInfo <- true:
+		default:
+		}
+	case GVRET_GET_NUM_BUSES:
+		g.NumBuses = int(msg[2])
+	case GVRET_GET_CANBUS:
+		g.BusSpeeds[0] = int(binary.LittleEndian.Uint32(msg[3:7]))
+		g.BusSpeeds[1] = int(binary.LittleEndian.Uint32(msg[8:12]))
+	}
+}
+
+// DecodeGVRETFrame decodes a received frame message and returns its
+// microsecond timestamp
+func DecodeGVRETFrame(msg []byte) (api.CanData, uint32) {
+	pkt := api.CanData{}
+	ts := binary.LittleEndian.Uint32(msg[2:6])
+	arbId := binary.LittleEndian.Uint32(msg[6:10])
+	if arbId&0x80000000 != 0 {
+		pkt.Extended = true
+		pkt.ArbID = api.FormatArbId(arbId&CAN_EFF_MASK, true)
+	} else {
+		pkt.ArbID = api.FormatArbId(arbId&CAN_SFF_MASK, false)
+	}
+	bus := int(msg[10] >> 4)
+	dlc := int(msg[10] & 0x0F)
+	if dlc > 8 {
+		dlc = 8
+	}
+	pkt.Network = fmt.Sprintf("CAN%d", bus)
+	pkt.SetData(msg[11 : 11+dlc])
+	return pkt, ts
+}
+
+// EncodeGVRETFrame builds the command to send a frame on a bus
+func EncodeGVRETFrame(pkt api.CanData, bus int) ([]byte, error) {
+	arbId, err := api.Hextoui32(pkt.ArbID)
+	if err != nil {
+		return nil, logger.Err("Invalid ArbID: " + pkt.ArbID)
+	}
+	if pkt.Extended || arbId > CAN_SFF_MASK {
+		arbId = (arbId & CAN_EFF_MASK) | 0x80000000
+	}
+	data := pkt.Data()
+	cmd := []byte{GVRET_CMD, GVRET_CAN_FRAME, 0, 0, 0, 0, uint8(bus), uint8(len(data))}
+	binary.LittleEndian.PutUint32(cmd[2:6], arbId)
+	cmd = append(cmd, data...)
+	cmd = append(cmd, 0)
+	return cmd, nil
+}
+
+// busFromNetwork maps a Network name such as "CAN1" back to a bus number
+func busFromNetwork(network string) int {
+	n := strings.TrimPrefix(strings.ToUpper(network), "CAN")
+	for bus := 0; bus < GVRET_MAX_BUS; bus++ {
+		if n == fmt.Sprintf("%d", bus) {
+			return bus
+		}
+	}
+	return 0
+}
+
+// relTime turns the device's microsecond clock into seconds since the previous frame
+func (g *GVRET) relTime(ts uint32) string {
+	delta := uint32(0)
+	if g.haveTimestamp {
+		delta = ts - g.lastTimestamp
+	}
+	g.lastTimestamp = ts
+	g.haveTimestamp = true
+	return fmt.Sprintf("%.5f", float64(delta)/1000000.0)
+}
+
+func (g *GVRET) DeviceType() string {
+	return "GVRET"
+}
+
+func (g *GVRET) DeviceDesc() string {
+	return g.Desc
+}
+
+func (g *GVRET) GetId() int {
+	return g.id
+}
+
+func (g *GVRET) SetId(id int) {
+	g.id = id
+}
+
+func (g *GVRET) GetHackSession() api.HackSession {
+	return g.HackSession
+}
+
+func (g *GVRET) SetHackSession(hax api.HackSession) {
+	g.HackSession = hax
+}
+
+func (g *GVRET) GetYear() string {
+	return ""
+}
+
+func (g *GVRET) GetMake() string {
+	return ""
+}
+
+func (g *GVRET) GetModel() string {
+	return ""
+}
+
+func (g *GVRET) StartSniffing() {
+	g.packetIdx = 0
+	g.seqNo = 0
+	g.haveTimestamp = false
+	g.sniffEnabled = true
+}
+
+func (g *GVRET) StopSniffing() {
+	g.sniffEnabled = false
+}
+
+func (g *GVRET) addPacket(canpkt api.CanData) {
+	pkt := canpkt
+	pkt.SeqNo = g.seqNo
+	g.seqNo += 1
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
+	g.Packets[g.packetIdx] = pkt
+	g.packetIdx += 1
+	if g.packetIdx >= MAX_BUFFER {
+		g.packetIdx = 0
+	}
+}
+
+func (g *GVRET) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	var pkts []api.CanData
+	done := false
+	appends := 0
+	for done != true {
+		if idx >= MAX_BUFFER || idx < 0 {
+			idx = 0
+		}
+		if idx == g.packetIdx {
+			return pkts, g.packetIdx
+		}
+		pkts = append(pkts, g.Packets[idx])
+		idx += 1
+		appends += 1
+		if appends > MAX_APPENDS {
+			done = true
+		}
+	}
+	return pkts, g.packetIdx
+}
+
+func (g *GVRET) GetPacketIdx() int {
+	return g.packetIdx
+}
+
+// InjectPacket sends on the bus named by pkt.Network, CAN0 by default
+func (g *GVRET) InjectPacket(pkt api.CanData) error {
+	if g.Serial == nil {
+		return logger.Err("GVRET not initialized")
+	}
+	bus := busFromNetwork(pkt.Network)
+	cmd, err := EncodeGVRETFrame(pkt, bus)
+	if err != nil {
+		return err
+	}
+	err = g.write(cmd)
+	if err != nil {
+		return err
+	}
+	pkt.Network = fmt.Sprintf("CAN%d", bus)
+	g.addPacket(pkt)
+	return nil
+}
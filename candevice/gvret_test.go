@@ -0,0 +1,70 @@
+package candevice
+
+import (
+	"testing"
+)
+
+func TestGVRETFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		want string
+		ts   uint32
+		net  string
+	}{
+		{"standard", []byte{GVRET_CMD, GVRET_CAN_FRAME, 0x78, 0x56, 0x34, 0x12, 0xE8, 0x07, 0, 0, 0x03, 0x02, 0x7E, 0x00, 0},
+			"7E8 ext=false rtr=false [02 7E 00]", 0x12345678, "CAN0"},
+		{"extended on CAN1", []byte{GVRET_CMD, GVRET_CAN_FRAME, 1, 0, 0, 0, 0x10, 0xF1, 0xDA, 0x98, 0x12, 0xAA, 0xBB, 0},
+			"18DAF110 ext=true rtr=false [AA BB]", 1, "CAN1"},
+		{"empty", []byte{GVRET_CMD, GVRET_CAN_FRAME, 0, 0, 0, 0, 0x23, 0x01, 0, 0, 0x00, 0},
+			"123 ext=false rtr=false []", 0, "CAN0"},
+	}
+	for _, tt := range tests {
+		if n := gvretMsgLen(tt.msg); n != len(tt.msg) {
+			t.Errorf("%s: message length %d, want %d", tt.name, n, len(tt.msg))
+		}
+		pkt, ts := DecodeGVRETFrame(tt.msg)
+		if describe(pkt) != tt.want || ts != tt.ts || pkt.Network != tt.net {
+			t.Errorf("%s: got %s ts %d on %s, want %s ts %d on %s", tt.name, describe(pkt), ts, pkt.Network, tt.want, tt.ts, tt.net)
+		}
+	}
+}
+
+func TestGVRETMsgLen(t *testing.T) {
+	tests := []struct {
+		msg  []byte
+		want int
+	}{
+		{[]byte{GVRET_CMD}, 0},
+		{[]byte{GVRET_CMD, GVRET_CAN_FRAME, 0, 0, 0, 0}, 0},
+		{[]byte{GVRET_CMD, GVRET_TIME_SYNC}, 6},
+		{[]byte{GVRET_CMD, GVRET_GET_DEV_INFO}, 8},
+		{[]byte{GVRET_CMD, GVRET_KEEPALIVE}, 4},
+		{[]byte{GVRET_CMD, 0x42}, -1},
+	}
+	for _, tt := range tests {
+		if n := gvretMsgLen(tt.msg); n != tt.want {
+			t.Errorf("% X: got %d, want %d", tt.msg, n, tt.want)
+		}
+	}
+}
+
+func TestEncodeGVRETFrame(t *testing.T) {
+	tests := []struct {
+		pkt  string
+		bus  int
+		want []byte
+	}{
+		{"7E0", 0, []byte{GVRET_CMD, GVRET_CAN_FRAME, 0xE0, 0x07, 0, 0, 0, 2, 0x3E, 0x00, 0}},
+		{"18DB33F1", 1, []byte{GVRET_CMD, GVRET_CAN_FRAME, 0xF1, 0x33, 0xDB, 0x98, 1, 2, 0x3E, 0x00, 0}},
+	}
+	for _, tt := range tests {
+		cmd, err := EncodeGVRETFrame(packet(tt.pkt, len(tt.pkt) > 3, false, []byte{0x3E, 0x00}), tt.bus)
+		if err != nil || string(cmd) != string(tt.want) {
+			t.Errorf("%s: got % X err %v, want % X", tt.pkt, cmd, err, tt.want)
+		}
+	}
+	if bus := busFromNetwork("can1"); bus != 1 {
+		t.Errorf("can1 is bus %d", bus)
+	}
+}
@@ -0,0 +1,122 @@
+package candevice
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/isotp"
+	"github.com/ghetzel/canibus/logger"
+	"github.com/ghetzel/canibus/obd"
+)
+
+const (
+	OBD_FUNCTIONAL_ID = "7DF"                  // Broadcast request ID
+	OBD_RESPONSE_WAIT = 500 * time.Millisecond // Time ECUs get to start answering
+	OBD_MULTI_WAIT    = 2 * time.Second        // Time allowed for a multi-frame answer
+	OBD_SETTLE        = 100 * time.Millisecond // Quiet time after every ECU has answered
+	OBD_POLL          = 10 * time.Millisecond
+)
+
+// OBDRequestDevice is implemented by adapters such as the ELM327 that do
+// their own OBD framing
+type OBDRequestDevice interface {
+	OBDRequest(req []byte) ([]obd.Response, error)
+}
+
+// OBDRequester returns a Requester for a device.  Raw CAN devices must be
+// sniffing so the answers show up in their packet buffer
+func OBDRequester(dev api.CanDevice) obd.Requester {
+	if o, ok := dev.(OBDRequestDevice); ok {
+		return o.OBDRequest
+	}
+	return func(req []byte) ([]obd.Response, error) {
+		return rawOBDRequest(dev, req)
+	}
+}
+
+// rawOBDRequest broadcasts a request on 7DF and reassembles the ISO-TP
+// answers from 7E8-7EF, sending flow control for multi-frame answers
+func rawOBDRequest(dev api.CanDevice, req []byte) ([]obd.Response, error) {
+	if len(req) > 7 {
+		return nil, logger.Err("OBD request too long for a single frame")
+	}
+	frames, err := isotp.Segment(req, 0x00)
+	if err != nil {
+		return nil, err
+	}
+	idx := dev.GetPacketIdx()
+	pkt := api.CanData{ArbID: OBD_FUNCTIONAL_ID, Src: "OBD"}
+	pkt.SetData(frames[0])
+	err = dev.InjectPacket(pkt)
+	if err != nil {
+		return nil, err
+	}
+	var order []string
+	answers := map[string]*isotp.Reassembler{}
+	deadline := time.Now().Add(OBD_RESPONSE_WAIT)
+	lastFrame := time.Now()
+	for time.Now().Before(deadline) {
+		var pkts []api.CanData
+		pkts, idx = dev.GetPacketsFrom(idx)
+		for i := range pkts {
+			if !obd.IsResponseId(pkts[i].ArbID) {
+				continue
+			}
+			lastFrame = time.Now()
+			ecu := pkts[i].ArbID
+			ans, ok := answers[ecu]
+			if !ok {
+				ans = &isotp.Reassembler{}
+				answers[ecu] = ans
+				order = append(order, ecu)
+			}
+			if ans.Done() {
+				continue
+			}
+			_, needFC, err := ans.Add(pkts[i].Data())
+			if err != nil {
+				logger.Log(ecu + ": " + err.Error())
+			}
+			if needFC {
+				deadline = time.Now().Add(OBD_MULTI_WAIT)
+				sendFlowControl(dev, ecu)
+			}
+		}
+		if len(order) > 0 && allAnswered(answers) && time.Since(lastFrame) > OBD_SETTLE {
+			break
+		}
+		time.Sleep(OBD_POLL)
+	}
+	var resps []obd.Response
+	for i := range order {
+		if answers[order[i]].Done() {
+			resps = append(resps, obd.Response{ECU: order[i], Data: answers[order[i]].Data})
+		}
+	}
+	if len(resps) == 0 {
+		return nil, logger.Err("No response from any ECU")
+	}
+	return resps, nil
+}
+
+func allAnswered(answers map[string]*isotp.Reassembler) bool {
+	for _, ans := range answers {
+		if !ans.Done() {
+			return false
+		}
+	}
+	return true
+}
+
+// sendFlowControl tells an ECU to send the rest of its answer with no
+// block limit or delay.  ECUs listen 8 below the ID they answer on
+func sendFlowControl(dev api.CanDevice, ecu string) {
+	id, _ := api.Hextoui32(ecu)
+	fc := api.CanData{ArbID: fmt.Sprintf("%03X", id-8), Src: "OBD"}
+	fc.SetData(isotp.FlowControlFrame(isotp.FC_CONTINUE, 0, 0, 0x00))
+	err := dev.InjectPacket(fc)
+	if err != nil {
+		logger.Log("Could not send flow control: " + err.Error())
+	}
+}
@@ -0,0 +1,76 @@
+package candevice
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty returns the master side of a raw pseudo-terminal and the name of
+// the slave for a driver to open as its serial port
+func openPty(t *testing.T) (*os.File, string) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("No pseudo-terminals: " + err.Error())
+	}
+	var n uint32
+	var unlock int32
+	if ioctl(m.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)) != nil || ioctl(m.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)) != nil {
+		m.Close()
+		t.Skip("Could not set up a pseudo-terminal")
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	// Raw, so CRs reach the driver as sent and nothing is echoed back
+	var tio syscall.Termios
+	if err := ioctl(slave.Fd(), syscall.TCGETS, unsafe.Pointer(&tio)); err != nil {
+		t.Fatal(err)
+	}
+	tio.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	tio.Oflag &^= syscall.OPOST
+	tio.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	tio.Cflag = tio.Cflag&^(syscall.CSIZE|syscall.PARENB) | syscall.CS8
+	if err := ioctl(slave.Fd(), syscall.TCSETS, unsafe.Pointer(&tio)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		slave.Close()
+		m.Close()
+	})
+	return m, name
+}
+
+// fakeAdapter plays an ASCII adapter on the master side of a pty.  Every
+// CR terminated command is passed to answer and then sent on commands
+func fakeAdapter(m *os.File, answer func(cmd string) string) chan string {
+	commands := make(chan string, 100)
+	go func() {
+		r := bufio.NewReader(m)
+		for {
+			line, err := r.ReadString('\r')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimSuffix(line, "\r")
+			m.Write([]byte(answer(cmd)))
+			commands <- cmd
+		}
+	}()
+	return commands
+}
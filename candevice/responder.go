@@ -0,0 +1,261 @@
+package candevice
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/isotp"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	RESPONDER_FC_WAIT   = 1 * time.Second // How long to wait for a flow control frame
+	RESPONDER_PAD_BYTE  = 0x00
+	RESPONDER_SRC       = "Responder"
+	RESPONDER_ANY_ARBID = "*"
+)
+
+// ResponderRule answers a request frame.  Data and Mask are hex byte
+// strings such as "02 09 02", a frame matches when every masked byte of
+// Data equals the same byte of the frame.  Mask defaults to FF for each
+// Data byte.  Frames are sent as-is, IsoTP is sent as one ISO-TP message
+// split into single, first and consecutive frames as needed
+type ResponderRule struct {
+	Name    string
+	ArbID   string // Request ID, "*" matches any
+	Data    string
+	Mask    string
+	ReplyID string
+	Frames  []string
+	IsoTP   string
+	FlowID  string // ID flow control frames arrive on, empty is the tester answered
+	Delay   int    // Milliseconds before replying
+	data    []byte
+	mask    []byte
+	frames  [][]byte
+	isotp   []byte
+}
+
+// Responder is a rule engine that fakes ECUs answering injected frames
+type Responder struct {
+	Rules       []ResponderRule
+	send        func(api.CanData)
+	flowControl chan api.CanData
+}
+
+// LoadResponder reads a JSON array of ResponderRules
+func LoadResponder(file string, send func(api.CanData)) (*Responder, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, logger.Err("Could not open responder file " + file)
+	}
+	r := &Responder{send: send, flowControl: make(chan api.CanData, 1)}
+	err = json.Unmarshal(buf, &r.Rules)
+	if err != nil {
+		return nil, logger.Err("Problem with json unmarshal responder rules: " + err.Error())
+	}
+	for i := range r.Rules {
+		err = r.Rules[i].compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func parseHexBytes(s string) ([]byte, error) {
+	s = strings.Replace(strings.Replace(s, " ", "", -1), "0x", "", -1)
+	return hex.DecodeString(s)
+}
+
+func (rule *ResponderRule) compile() error {
+	var err error
+	if rule.ArbID == "" {
+		rule.ArbID = RESPONDER_ANY_ARBID
+	}
+	if rule.ArbID != RESPONDER_ANY_ARBID {
+		if _, err = api.Hextoui32(rule.ArbID); err != nil {
+			return logger.Err("Responder rule " + rule.Name + ": bad ArbID " + rule.ArbID)
+		}
+	}
+	if _, err = api.Hextoui32(rule.ReplyID); err != nil {
+		return logger.Err("Responder rule " + rule.Name + ": bad ReplyID " + rule.ReplyID)
+	}
+	rule.data, err = parseHexBytes(rule.Data)
+	if err != nil || len(rule.data) > 8 {
+		return logger.Err("Responder rule " + rule.Name + ": bad Data " + rule.Data)
+	}
+	if rule.Mask == "" {
+		rule.mask = make([]byte, len(rule.data))
+		for i := range rule.mask {
+			rule.mask[i] = 0xFF
+		}
+	} else {
+		rule.mask, err = parseHexBytes(rule.Mask)
+		if err != nil || len(rule.mask) != len(rule.data) {
+			return logger.Err("Responder rule " + rule.Name + ": Mask must be the same length as Data")
+		}
+	}
+	rule.frames = nil
+	for i := range rule.Frames {
+		frame, err := parseHexBytes(rule.Frames[i])
+		if err != nil || len(frame) > 8 {
+			return logger.Err("Responder rule " + rule.Name + ": bad frame " + rule.Frames[i])
+		}
+		rule.frames = append(rule.frames, frame)
+	}
+	rule.isotp, err = parseHexBytes(rule.IsoTP)
+	if err != nil || len(rule.isotp) > isotp.MAX_LEN {
+		return logger.Err("Responder rule " + rule.Name + ": bad IsoTP payload")
+	}
+	return nil
+}
+
+// Matches reports whether a frame triggers the rule
+func (rule *ResponderRule) Matches(pkt api.CanData) bool {
+	if rule.ArbID != RESPONDER_ANY_ARBID && !sameArbId(rule.ArbID, pkt.ArbID) {
+		return false
+	}
+	data := pkt.Data()
+	if len(data) < len(rule.data) {
+		return false
+	}
+	for i := range rule.data {
+		if data[i]&rule.mask[i] != rule.data[i]&rule.mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameArbId(a string, b string) bool {
+	x, xerr := api.Hextoui32(a)
+	y, yerr := api.Hextoui32(b)
+	return xerr == nil && yerr == nil && x == y
+}
+
+// HandleFrame checks a frame against every rule and starts any replies.
+// Flow control frames are passed to a multi-frame reply waiting for them
+func (r *Responder) HandleFrame(pkt api.CanData) {
+	data := pkt.Data()
+	if len(data) > 0 && isotp.FrameType(data) == isotp.FLOW_CONTROL {
+		select {
+		case r.flowControl <- pkt:
+		default:
+		}
+	}
+	for i := range r.Rules {
+		if r.Rules[i].Matches(pkt) {
+			go r.reply(&r.Rules[i], pkt.ArbID)
+		}
+	}
+}
+
+func (r *Responder) reply(rule *ResponderRule, tester string) {
+	if rule.Delay > 0 {
+		time.Sleep(time.Duration(rule.Delay) * time.Millisecond)
+	}
+	for i := range rule.frames {
+		r.sendFrame(rule, rule.frames[i])
+	}
+	if len(rule.isotp) > 0 {
+		err := r.sendIsoTP(rule, tester)
+		if err != nil {
+			logger.Log("Responder rule " + rule.Name + ": " + err.Error())
+		}
+	}
+}
+
+func (r *Responder) sendFrame(rule *ResponderRule, data []byte) {
+	pkt := api.CanData{Src: RESPONDER_SRC, Desc: rule.Name}
+	arbId, _ := api.Hextoui32(rule.ReplyID)
+	pkt.Extended = len(strings.TrimPrefix(rule.ReplyID, "0x")) > 3 || arbId > CAN_SFF_MASK
+	pkt.ArbID = api.FormatArbId(arbId, pkt.Extended)
+	pkt.SetData(data)
+	r.send(pkt)
+}
+
+// sendIsoTP sends the rule's payload as a single frame, or as a first frame
+// followed by consecutive frames paced by the tester's flow control
+func (r *Responder) sendIsoTP(rule *ResponderRule, tester string) error {
+	frames, err := isotp.Segment(rule.isotp, RESPONDER_PAD_BYTE)
+	if err != nil {
+		return err
+	}
+	// Drop any stale flow control before starting
+	select {
+	case <-r.flowControl:
+	default:
+	}
+	r.sendFrame(rule, frames[0])
+	frames = frames[1:]
+	waits := 0
+	for len(frames) > 0 {
+		fc, err := r.waitFlowControl(rule, tester)
+		if err != nil {
+			return err
+		}
+		fcData := fc.Data()
+		switch fcData[0] & 0x0F {
+		case isotp.FC_WAIT:
+			waits += 1
+			if waits > isotp.MAX_WAIT_FRAMES {
+				return logger.Err("Too many flow control waits")
+			}
+			continue
+		case isotp.FC_OVERFLOW:
+			return logger.Err("Tester aborted transfer")
+		case isotp.FC_CONTINUE:
+		default:
+			return logger.Err(fmt.Sprintf("Bad flow control status %X", fcData[0]&0x0F))
+		}
+		blockSize := 0
+		stMin := time.Duration(0)
+		if len(fcData) > 1 {
+			blockSize = int(fcData[1])
+		}
+		if len(fcData) > 2 {
+			stMin = isotp.SeparationTime(fcData[2])
+		}
+		for sent := 0; len(frames) > 0 && (blockSize == 0 || sent < blockSize); sent++ {
+			r.sendFrame(rule, frames[0])
+			frames = frames[1:]
+			if stMin > 0 && len(frames) > 0 {
+				time.Sleep(stMin)
+			}
+		}
+	}
+	return nil
+}
+
+// fromTester reports whether a flow control frame comes from the tester a
+// rule answered.  A functional request is followed up on the physical ID
+// paired with ReplyID
+func (rule *ResponderRule) fromTester(fcId string, tester string) bool {
+	if rule.FlowID != "" {
+		return sameArbId(rule.FlowID, fcId)
+	}
+	if isotp.Functional(tester) {
+		return !isotp.Functional(fcId) && isotp.Pairs(fcId, rule.ReplyID)
+	}
+	return sameArbId(tester, fcId)
+}
+
+func (r *Responder) waitFlowControl(rule *ResponderRule, tester string) (api.CanData, error) {
+	timeout := time.After(RESPONDER_FC_WAIT)
+	for {
+		select {
+		case fc := <-r.flowControl:
+			if rule.fromTester(fc.ArbID, tester) {
+				return fc, nil
+			}
+		case <-timeout:
+			return api.CanData{}, logger.Err("Timed out waiting for flow control")
+		}
+	}
+}
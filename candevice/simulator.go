@@ -1,13 +1,14 @@
 package candevice
 
 import (
-	"encoding/json"
 	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ghetzel/canibus/api"
 	"github.com/ghetzel/canibus/logger"
-	//	"strconv"
-	"time"
 )
 
 const (
@@ -15,48 +16,128 @@ const (
 	MAX_APPENDS = 1000  // Max packets returned at one time
 )
 
+const (
+	SIM_DEFAULT_DELAY = 100 * time.Millisecond // Used when a capture has no timing
+	SIM_MAX_SLEEP     = 100 * time.Millisecond // Keeps pause/seek/stop responsive
+	SIM_LOOP_YIELD    = 1 * time.Millisecond   // Pause per loop at full speed
+)
+
+// SimulatorStatus reports where a replay is
+type SimulatorStatus struct {
+	Position  int
+	Total     int
+	Speed     float64
+	Paused    bool
+	StopAtEnd bool
+	Running   bool
+}
+
 type Simulator struct {
-	PacketFile   string
-	SimPackets   []api.CanData
-	Packets      [MAX_BUFFER]api.CanData
-	HackSession  api.HackSession
-	id           int
-	sniffEnabled bool
-	packetIdx    int
-	seqNo        int
+	PacketFile    string
+	SimPackets    []api.CanData
+	Packets       [MAX_BUFFER]api.CanData
+	HackSession   api.HackSession
+	Bus           string  // Optional virtual bus to replay onto
+	Speed         float64 // Replay speed multiplier, -1 is as fast as possible
+	StopAtEnd     bool    // Stop instead of looping at the end of the capture
+	ResponderFile string  // Optional JSON rules answering injected frames
+	responder     *Responder
+	segment       *virtualBusSegment
+	simOffsets    []time.Duration // Time of each SimPacket from the start of the capture
+	simIdx        int
+	paused        bool
+	seekTo        int
+	replayLock    sync.Mutex
+	id            int
+	sniffEnabled  bool
+	packetIdx     int
+	seqNo         int
+	packetLock    sync.Mutex // Replay, injects and other bus nodes all add packets
 }
 
 func (sim *Simulator) SetPacketFile(packets string) {
 	sim.PacketFile = packets
 }
 
+func (sim *Simulator) SetBus(bus string) {
+	sim.Bus = bus
+}
+
+func (sim *Simulator) SetResponderFile(file string) {
+	sim.ResponderFile = file
+}
+
 func (sim *Simulator) Init() bool {
-	logger.Log("Loading packets from " + sim.PacketFile)
-	err := sim.LoadCanDataFromFile(sim.PacketFile)
-	if err != nil {
-		return false
+	if sim.Speed == 0 {
+		sim.Speed = 1.0
+	}
+	if sim.PacketFile != "" || sim.ResponderFile == "" {
+		logger.Log("Loading packets from " + sim.PacketFile)
+		err := sim.LoadCanDataFromFile(sim.PacketFile)
+		if err != nil {
+			return false
+		}
+	}
+	if sim.ResponderFile != "" {
+		logger.Log("Loading responder rules from " + sim.ResponderFile)
+		responder, err := LoadResponder(sim.ResponderFile, sim.sendReply)
+		if err != nil {
+			logger.Log(err.Error())
+			return false
+		}
+		sim.responder = responder
+	}
+	if sim.Bus != "" {
+		logger.Log("Attaching simulator to virtual bus " + sim.Bus)
+		if sim.segment != nil {
+			sim.segment.detach(sim) // Initialised again
+		}
+		sim.segment = attachVirtualNode(sim.Bus, 0, sim)
 	}
 	return true
 }
 
+// LoadCanDataFromFile loads a capture in any format ParseCaptureFile knows
 func (sim *Simulator) LoadCanDataFromFile(file string) error {
-	packets, err := ioutil.ReadFile(sim.PacketFile)
+	packets, err := ioutil.ReadFile(file)
 	if err != nil {
 		logger.Log("Could not open Simulator data file")
 		return err
 	}
-	var canPacket []api.CanData
-	err = json.Unmarshal(packets, &canPacket)
+	canPacket, err := ParseCaptureFile(file, packets)
 	if err != nil {
-		logger.Log("Problem with json unmarshal sim data")
+		logger.Log("Problem loading sim data: " + err.Error())
 		return err
-	} else {
-		sim.SimPackets = canPacket
 	}
+	sim.SimPackets = canPacket
+	sim.simOffsets = replayOffsets(canPacket)
 	return nil
 }
 
+// replayOffsets works out when each packet was seen relative to the first
+// one.  AbsTime is used when it is a number of seconds, otherwise RelTime
+// is taken as the time since the previous packet
+func replayOffsets(pkts []api.CanData) []time.Duration {
+	offsets := make([]time.Duration, len(pkts))
+	for i := 1; i < len(pkts); i++ {
+		delta := SIM_DEFAULT_DELAY
+		prevAbs, perr := strconv.ParseFloat(strings.TrimSpace(pkts[i-1].AbsTime), 64)
+		abs, aerr := strconv.ParseFloat(strings.TrimSpace(pkts[i].AbsTime), 64)
+		rel, rerr := strconv.ParseFloat(strings.TrimSpace(pkts[i].RelTime), 64)
+		if perr == nil && aerr == nil && abs >= prevAbs {
+			delta = time.Duration((abs - prevAbs) * float64(time.Second))
+		} else if rerr == nil && rel >= 0 {
+			delta = time.Duration(rel * float64(time.Second))
+		}
+		offsets[i] = offsets[i-1] + delta
+	}
+	return offsets
+}
+
 func (sim *Simulator) DeviceDesc() string {
+	if sim.PacketFile == "" {
+		return sim.ResponderFile
+	}
 	return sim.PacketFile
 }
 
@@ -94,8 +175,15 @@ func (sim *Simulator) GetModel() string {
 
 func (sim *Simulator) StartSniffing() {
 	sim.sniffEnabled = true
+	sim.packetLock.Lock()
 	sim.packetIdx = 0
 	sim.seqNo = 0
+	sim.packetLock.Unlock()
+	sim.replayLock.Lock()
+	sim.simIdx = 0
+	sim.seekTo = -1
+	sim.paused = false
+	sim.replayLock.Unlock()
 	go sim.processPackets()
 }
 
@@ -103,12 +191,70 @@ func (sim *Simulator) StopSniffing() {
 	sim.sniffEnabled = false
 }
 
+// SetSpeed sets the replay speed multiplier, -1 replays as fast as possible
+func (sim *Simulator) SetSpeed(speed float64) {
+	sim.replayLock.Lock()
+	defer sim.replayLock.Unlock()
+	if speed == 0 {
+		speed = 1.0
+	}
+	sim.Speed = speed
+	sim.seekTo = sim.simIdx // Restart the clock from here at the new speed
+}
+
+func (sim *Simulator) SetStopAtEnd(stop bool) {
+	sim.StopAtEnd = stop
+}
+
+func (sim *Simulator) Pause() {
+	sim.replayLock.Lock()
+	sim.paused = true
+	sim.replayLock.Unlock()
+}
+
+func (sim *Simulator) Resume() {
+	sim.replayLock.Lock()
+	defer sim.replayLock.Unlock()
+	if sim.paused {
+		sim.paused = false
+		sim.seekTo = sim.simIdx
+	}
+}
+
+// Seek moves the replay to a packet in the capture
+func (sim *Simulator) Seek(idx int) error {
+	if idx < 0 || idx >= len(sim.SimPackets) {
+		return logger.Err("Seek position out of range")
+	}
+	sim.replayLock.Lock()
+	sim.seekTo = idx
+	sim.replayLock.Unlock()
+	return nil
+}
+
+func (sim *Simulator) GetStatus() SimulatorStatus {
+	sim.replayLock.Lock()
+	defer sim.replayLock.Unlock()
+	return SimulatorStatus{
+		Position:  sim.simIdx,
+		Total:     len(sim.SimPackets),
+		Speed:     sim.Speed,
+		Paused:    sim.paused,
+		StopAtEnd: sim.StopAtEnd,
+		Running:   sim.sniffEnabled,
+	}
+}
+
 func (sim *Simulator) addPacket(simPkt api.CanData) {
+	sim.packetLock.Lock()
+	defer sim.packetLock.Unlock()
 	pkt := api.CanData{}
 	pkt.SeqNo = sim.seqNo
 	sim.seqNo += 1
 	pkt.Src = simPkt.Src
-	pkt.AbsTime = time.Now().Format("10:00:00pm (EST)")
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
 	pkt.RelTime = simPkt.RelTime
 	pkt.Status = simPkt.Status
 	pkt.Error = simPkt.Error
@@ -127,6 +273,8 @@ func (sim *Simulator) addPacket(simPkt api.CanData) {
 	pkt.B6 = simPkt.B6
 	pkt.B7 = simPkt.B7
 	pkt.B8 = simPkt.B8
+	pkt.DLC = simPkt.DLC
+	pkt.HasDLC = simPkt.HasDLC
 	pkt.Value = simPkt.Value
 	pkt.Trigger = simPkt.Trigger
 	pkt.Signals = simPkt.Signals
@@ -137,35 +285,81 @@ func (sim *Simulator) addPacket(simPkt api.CanData) {
 	}
 }
 
+// processPackets replays SimPackets keeping their recorded spacing scaled by Speed
 func (sim *Simulator) processPackets() {
 	total := len(sim.SimPackets)
-	simIdx := 0
-	//startedAt := time.Now()
-	// ported from old canibusd
-	//relDiff := float64(startedAt.Second() + (startedAt.Nanosecond() / 1000000000.0))
+	if total == 0 {
+		logger.Log("Simulator has no packets to replay")
+		return
+	}
+	// Gap used when looping back to the start
+	loopGap := SIM_DEFAULT_DELAY
+	if total > 1 {
+		loopGap = sim.simOffsets[total-1] / time.Duration(total-1)
+	}
+	startedAt := time.Now()
 	for sim.sniffEnabled == true {
-		if simIdx >= total || simIdx < 0 {
-			simIdx = 0
+		sim.replayLock.Lock()
+		if sim.seekTo >= 0 {
+			sim.simIdx = sim.seekTo
+			sim.seekTo = -1
+			startedAt = time.Now().Add(-sim.scaled(sim.simOffsets[sim.simIdx]))
 		}
-		/*
-			pktRelTime, cerr := strconv.ParseFloat(sim.SimPackets[simIdx].RelTime, 32)
-			if cerr == nil {
-				if sim.SimPackets[simIdx].SeqNo != 0 && relDiff > pktRelTime {
-					relDiff -= pktRelTime
-					sim.addPacket(sim.SimPackets[simIdx])
-					simIdx += 1
-				}
+		if sim.paused {
+			sim.replayLock.Unlock()
+			time.Sleep(SIM_MAX_SLEEP)
+			continue
+		}
+		simIdx := sim.simIdx
+		due := startedAt.Add(sim.scaled(sim.simOffsets[simIdx]))
+		sim.replayLock.Unlock()
+		wait := due.Sub(time.Now())
+		if wait > 0 {
+			if wait > SIM_MAX_SLEEP {
+				wait = SIM_MAX_SLEEP
 			}
-		*/
-		// FIXME Just temp code to test interface
+			time.Sleep(wait)
+			continue
+		}
 		sim.SimPackets[simIdx].Src = "Sim"
 		sim.addPacket(sim.SimPackets[simIdx])
-		simIdx += 1
-		time.Sleep(100 * time.Millisecond)
+		if sim.segment != nil {
+			sim.segment.transmit(sim, sim.SimPackets[simIdx])
+		}
+		yield := false
+		sim.replayLock.Lock()
+		if sim.seekTo < 0 {
+			sim.simIdx = simIdx + 1
+			if sim.simIdx >= total {
+				sim.simIdx = 0
+				if sim.StopAtEnd {
+					sim.sniffEnabled = false
+				} else {
+					startedAt = time.Now().Add(sim.scaled(loopGap))
+					yield = sim.Speed <= 0
+				}
+			}
+		}
+		sim.replayLock.Unlock()
+		// As fast as possible still gives the rest of the program a turn
+		// every time the capture loops
+		if yield {
+			time.Sleep(SIM_LOOP_YIELD)
+		}
+	}
+}
+
+// scaled converts a capture offset into wall clock time at the current speed
+func (sim *Simulator) scaled(d time.Duration) time.Duration {
+	if sim.Speed <= 0 {
+		return 0
 	}
+	return time.Duration(float64(d) / sim.Speed)
 }
 
 func (sim *Simulator) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	sim.packetLock.Lock()
+	defer sim.packetLock.Unlock()
 	var pkts []api.CanData
 	var done bool
 	done = false
@@ -189,10 +383,36 @@ func (sim *Simulator) GetPacketsFrom(idx int) ([]api.CanData, int) {
 }
 
 func (sim *Simulator) GetPacketIdx() int {
+	sim.packetLock.Lock()
+	defer sim.packetLock.Unlock()
 	return sim.packetIdx
 }
 
 func (sim *Simulator) InjectPacket(pkt api.CanData) error {
 	sim.addPacket(pkt)
+	if sim.segment != nil {
+		sim.segment.transmit(sim, pkt)
+	}
+	if sim.responder != nil {
+		sim.responder.HandleFrame(pkt)
+	}
 	return nil
 }
+
+// sendReply puts a responder frame in the buffer and on the virtual bus
+func (sim *Simulator) sendReply(pkt api.CanData) {
+	sim.addPacket(pkt)
+	if sim.segment != nil {
+		sim.segment.transmit(sim, pkt)
+	}
+}
+
+// receiveFrame records frames sent by other nodes on the virtual bus
+func (sim *Simulator) receiveFrame(pkt api.CanData) {
+	if sim.sniffEnabled {
+		sim.addPacket(pkt)
+	}
+	if sim.responder != nil {
+		sim.responder.HandleFrame(pkt)
+	}
+}
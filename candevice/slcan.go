@@ -0,0 +1,332 @@
+package candevice
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+	"github.com/ghetzel/canibus/serialbuffer"
+)
+
+const (
+	SLCAN_DEFAULT_BAUD    = 115200
+	SLCAN_DEFAULT_BITRATE = 500000
+)
+
+// LAWICEL Sn bitrate codes
+var SlcanBitrates = map[int]string{
+	10000:   "S0",
+	20000:   "S1",
+	50000:   "S2",
+	100000:  "S3",
+	125000:  "S4",
+	250000:  "S5",
+	500000:  "S6",
+	800000:  "S7",
+	1000000: "S8",
+}
+
+// SLCAN speaks the LAWICEL ASCII protocol used by CANtact, CANable and USBtin
+type SLCAN struct {
+	Serial        serialbuffer.SerialBuffer
+	Bitrate       int
+	Version       string
+	Desc          string
+	HackSession   api.HackSession
+	Packets       [MAX_BUFFER]api.CanData
+	id            int
+	sniffEnabled  bool
+	packetIdx     int
+	seqNo         int
+	lastTimestamp int
+}
+
+func (s *SLCAN) SetSerial(port string) {
+	s.Serial.SetSerial(port)
+}
+
+func (s *SLCAN) SetBitrate(bitrate int) {
+	s.Bitrate = bitrate
+}
+
+func (s *SLCAN) Init() bool {
+	logger.Log("Initializing SLCAN on " + s.Serial.SerialPort)
+	s.Desc = "Not connected"
+	if s.Serial.GetBaud() == 0 {
+		s.Serial.SetBaud(SLCAN_DEFAULT_BAUD)
+	}
+	if s.Bitrate == 0 {
+		s.Bitrate = SLCAN_DEFAULT_BITRATE
+	}
+	speed, ok := SlcanBitrates[s.Bitrate]
+	if !ok {
+		logger.Log(fmt.Sprintf("Unsupported SLCAN bitrate: %d", s.Bitrate))
+		return false
+	}
+	ok = s.Serial.Init()
+	if !ok {
+		logger.Log("Could not open SLCAN device")
+		return false
+	}
+	// Close first in case the channel was left open, timestamps
+	// can only be changed while the channel is closed
+	s.sendCmd("C")
+	s.sendCmd(speed)
+	s.sendCmd("Z1")
+	s.Version = s.GetVersion()
+	err := s.sendCmd("O")
+	if err != nil {
+		logger.Log("Could not open SLCAN channel")
+		return false
+	}
+	s.Desc = fmt.Sprintf("%s @ %dkbps", s.Serial.SerialPort, s.Bitrate/1000)
+	if s.Version != "" {
+		s.Desc += " (" + s.Version + ")"
+	}
+	return true
+}
+
+// sendCmd writes a command and gives the adapter a moment to answer.  The
+// CR/BELL answers carry no data so they are left for the sniffer to skip
+func (s *SLCAN) sendCmd(cmd string) error {
+	err := s.Serial.Writeln(cmd)
+	if err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+// GetVersion asks the adapter for its hardware/software version
+func (s *SLCAN) GetVersion() string {
+	s.sendCmd("V")
+	resp, gotLine := s.Serial.ReadLn()
+	resp = strings.TrimRight(resp, "\x00")
+	if gotLine && len(resp) > 1 && resp[0] == 'V' {
+		return resp
+	}
+	return ""
+}
+
+func (s *SLCAN) DeviceType() string {
+	return "SLCAN"
+}
+
+func (s *SLCAN) DeviceDesc() string {
+	return s.Desc
+}
+
+func (s *SLCAN) GetId() int {
+	return s.id
+}
+
+func (s *SLCAN) SetId(id int) {
+	s.id = id
+}
+
+func (s *SLCAN) GetHackSession() api.HackSession {
+	return s.HackSession
+}
+
+func (s *SLCAN) SetHackSession(hax api.HackSession) {
+	s.HackSession = hax
+}
+
+func (s *SLCAN) GetYear() string {
+	return ""
+}
+
+func (s *SLCAN) GetMake() string {
+	return ""
+}
+
+func (s *SLCAN) GetModel() string {
+	return ""
+}
+
+func (s *SLCAN) StartSniffing() {
+	s.sniffEnabled = true
+	s.packetIdx = 0
+	s.seqNo = 0
+	s.lastTimestamp = -1
+	go s.processPackets()
+}
+
+func (s *SLCAN) StopSniffing() {
+	s.sniffEnabled = false
+}
+
+func (s *SLCAN) processPackets() {
+	for s.sniffEnabled == true {
+		resp, gotLine := s.Serial.ReadLn()
+		if !gotLine {
+			continue
+		}
+		resp = strings.TrimRight(resp, "\x00")
+		// BELL is sent without a CR so it shows up in front of the next line
+		for len(resp) > 0 && resp[0] == 7 {
+			logger.Log("SLCAN adapter reported an error")
+			resp = resp[1:]
+		}
+		if len(resp) == 0 {
+			continue
+		}
+		switch resp[0] {
+		case 't', 'T', 'r', 'R':
+			pkt, ts, err := ParseSlcanFrame(resp)
+			if err != nil {
+				logger.Log("SLCAN: " + err.Error())
+				continue
+			}
+			pkt.Src = "SLCAN"
+			pkt.RelTime = s.relTime(ts)
+			s.addPacket(pkt)
+		}
+		// z and Z are transmit acks
+	}
+}
+
+// relTime converts the adapter's millisecond timestamp, which wraps every
+// minute, into seconds since the previous frame
+func (s *SLCAN) relTime(ts int) string {
+	if ts < 0 {
+		return ""
+	}
+	delta := 0
+	if s.lastTimestamp >= 0 {
+		delta = (ts - s.lastTimestamp + 60000) % 60000
+	}
+	s.lastTimestamp = ts
+	return fmt.Sprintf("%.5f", float64(delta)/1000.0)
+}
+
+// ParseSlcanFrame decodes a t, T, r or R line.  The timestamp is -1 if the
+// adapter did not send one
+func ParseSlcanFrame(line string) (api.CanData, int, error) {
+	pkt := api.CanData{}
+	ts := -1
+	if len(line) == 0 {
+		return pkt, ts, logger.Err("Empty SLCAN frame")
+	}
+	idLen := 3
+	if line[0] == 'T' || line[0] == 'R' {
+		idLen = 8
+		pkt.Extended = true
+	}
+	pkt.Remote = line[0] == 'r' || line[0] == 'R'
+	if len(line) < 1+idLen+1 {
+		return pkt, ts, logger.Err("Short SLCAN frame: " + line)
+	}
+	arbId, err := api.Hextoui32(line[1 : 1+idLen])
+	if err != nil {
+		return pkt, ts, logger.Err("Bad SLCAN ArbID: " + line)
+	}
+	pkt.ArbID = api.FormatArbId(arbId, pkt.Extended)
+	dlc := int(line[1+idLen] - '0')
+	if dlc < 0 || dlc > 8 {
+		return pkt, ts, logger.Err("Bad SLCAN DLC: " + line)
+	}
+	rest := line[2+idLen:]
+	if pkt.Remote {
+		pkt.SetDLC(dlc)
+	} else {
+		if len(rest) < dlc*2 {
+			return pkt, ts, logger.Err("Short SLCAN frame: " + line)
+		}
+		data, err := hex.DecodeString(rest[:dlc*2])
+		if err != nil {
+			return pkt, ts, logger.Err("Bad SLCAN data: " + line)
+		}
+		pkt.SetData(data)
+		rest = rest[dlc*2:]
+	}
+	if len(rest) >= 4 {
+		t, err := strconv.ParseInt(rest[:4], 16, 32)
+		if err == nil {
+			ts = int(t)
+		}
+	}
+	return pkt, ts, nil
+}
+
+// FormatSlcanFrame encodes a packet as a LAWICEL transmit command
+func FormatSlcanFrame(pkt api.CanData) (string, error) {
+	arbId, err := api.Hextoui32(pkt.ArbID)
+	if err != nil {
+		return "", logger.Err("Invalid ArbID: " + pkt.ArbID)
+	}
+	data := pkt.Data()
+	cmd := "t"
+	if pkt.Remote {
+		cmd = "r"
+	}
+	if pkt.Extended || arbId > CAN_SFF_MASK {
+		cmd = strings.ToUpper(cmd) + fmt.Sprintf("%08X", arbId&CAN_EFF_MASK)
+	} else {
+		cmd += fmt.Sprintf("%03X", arbId)
+	}
+	cmd += strconv.Itoa(len(data))
+	if !pkt.Remote {
+		cmd += strings.ToUpper(hex.EncodeToString(data))
+	}
+	return cmd, nil
+}
+
+func (s *SLCAN) addPacket(canpkt api.CanData) {
+	pkt := canpkt
+	pkt.SeqNo = s.seqNo
+	s.seqNo += 1
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
+	s.Packets[s.packetIdx] = pkt
+	s.packetIdx += 1
+	if s.packetIdx >= MAX_BUFFER {
+		s.packetIdx = 0
+	}
+}
+
+func (s *SLCAN) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	var pkts []api.CanData
+	done := false
+	appends := 0
+	for done != true {
+		if idx >= MAX_BUFFER || idx < 0 {
+			idx = 0
+		}
+		if idx == s.packetIdx {
+			return pkts, s.packetIdx
+		}
+		pkts = append(pkts, s.Packets[idx])
+		idx += 1
+		appends += 1
+		if appends > MAX_APPENDS {
+			done = true
+		}
+	}
+	return pkts, s.packetIdx
+}
+
+func (s *SLCAN) GetPacketIdx() int {
+	return s.packetIdx
+}
+
+func (s *SLCAN) InjectPacket(pkt api.CanData) error {
+	if s.Serial.Serial == nil {
+		return logger.Err("SLCAN not initialized")
+	}
+	line, err := FormatSlcanFrame(pkt)
+	if err != nil {
+		return err
+	}
+	err = s.Serial.Writeln(line)
+	if err != nil {
+		return logger.Err("Could not write to SLCAN device")
+	}
+	s.addPacket(pkt)
+	return nil
+}
@@ -0,0 +1,64 @@
+package candevice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLCANAdapter(t *testing.T) {
+	m, name := openPty(t)
+	commands := fakeAdapter(m, func(cmd string) string {
+		if cmd == "V" {
+			return "V1013\r"
+		}
+		return "\r"
+	})
+	s := &SLCAN{}
+	s.SetSerial(name)
+	s.SetBitrate(250000)
+	if !s.Init() {
+		t.Fatal("Init failed")
+	}
+	for _, want := range []string{"C", "S5", "Z1", "V", "O"} {
+		if cmd := nextCommand(t, commands); cmd != want {
+			t.Fatalf("got command %q, want %q", cmd, want)
+		}
+	}
+	if s.Version != "V1013" {
+		t.Errorf("Version %q", s.Version)
+	}
+	s.StartSniffing()
+	defer s.StopSniffing()
+	m.Write([]byte("t7E8803410C1AF8000000EA60\rT18DAF11021122EA70\r\x07r1232\r"))
+	want := []string{
+		"7E8 ext=false rtr=false [03 41 0C 1A F8 00 00 00]",
+		"18DAF110 ext=true rtr=false [11 22]",
+		"123 ext=false rtr=true [00 00]",
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.GetPacketIdx() < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pkts, _ := s.GetPacketsFrom(0)
+	if len(pkts) != len(want) {
+		t.Fatalf("Sniffed %d packets, want %d", len(pkts), len(want))
+	}
+	for i := range pkts {
+		if describe(pkts[i]) != want[i] {
+			t.Errorf("got %s, want %s", describe(pkts[i]), want[i])
+		}
+	}
+	if pkts[1].RelTime != "0.01600" {
+		t.Errorf("RelTime %q, want 0.01600", pkts[1].RelTime)
+	}
+	err := s.InjectPacket(packet("7DF", false, false, []byte{0x02, 0x01, 0x0C}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := nextCommand(t, commands); cmd != "t7DF302010C" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if pkts, _ = s.GetPacketsFrom(len(want)); len(pkts) != 1 || pkts[0].ArbID != "7DF" {
+		t.Errorf("Injected packet not recorded: %v", pkts)
+	}
+}
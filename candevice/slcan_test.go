@@ -0,0 +1,67 @@
+package candevice
+
+import (
+	"testing"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+func TestParseSlcanFrame(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+		ts   int
+		err  bool
+	}{
+		{"t7E8803410C1AF8000000", "7E8 ext=false rtr=false [03 41 0C 1A F8 00 00 00]", -1, false},
+		{"t1232AABB1F40", "123 ext=false rtr=false [AA BB]", 0x1F40, false},
+		{"T18DAF1103010203", "18DAF110 ext=true rtr=false [01 02 03]", -1, false},
+		{"t1230", "123 ext=false rtr=false []", -1, false},
+		{"r1232", "123 ext=false rtr=true [00 00]", -1, false},
+		{"R18DAF1100", "18DAF110 ext=true rtr=true []", -1, false},
+		{"", "", -1, true},
+		{"t12", "", -1, true},
+		{"tXYZ0", "", -1, true},
+		{"t1239", "", -1, true},
+		{"t1233AABB", "", -1, true},
+		{"t1232AAZZ", "", -1, true},
+	}
+	for _, tt := range tests {
+		pkt, ts, err := ParseSlcanFrame(tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.line)
+			}
+			continue
+		}
+		if err != nil || describe(pkt) != tt.want || ts != tt.ts {
+			t.Errorf("%q: got %s ts %d err %v, want %s ts %d", tt.line, describe(pkt), ts, err, tt.want, tt.ts)
+		}
+	}
+}
+
+func TestFormatSlcanFrame(t *testing.T) {
+	tests := []struct {
+		pkt  string
+		want string
+	}{
+		{"7E0", "t7E0802010C0000000000"},
+		{"18DB33F1", "T18DB33F1802010C0000000000"},
+	}
+	for _, tt := range tests {
+		pkt := packet(tt.pkt, len(tt.pkt) > 3, false, []byte{0x02, 0x01, 0x0C, 0, 0, 0, 0, 0})
+		line, err := FormatSlcanFrame(pkt)
+		if err != nil || line != tt.want {
+			t.Errorf("%s: got %q err %v, want %q", tt.pkt, line, err, tt.want)
+		}
+		back, _, err := ParseSlcanFrame(line)
+		if err != nil || describe(back) != describe(pkt) {
+			t.Errorf("%s: parsed back as %s", tt.pkt, describe(back))
+		}
+	}
+	remote := api.CanData{ArbID: "123", Remote: true}
+	remote.SetDLC(4)
+	if line, _ := FormatSlcanFrame(remote); line != "r1234" {
+		t.Errorf("remote: got %q", line)
+	}
+}
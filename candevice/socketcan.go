@@ -0,0 +1,228 @@
+package candevice
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+// Linux struct can_frame layout and can_id flags
+const (
+	CAN_MTU      = 16
+	CAN_EFF_FLAG = 0x80000000 // Extended frame format
+	CAN_RTR_FLAG = 0x40000000 // Remote transmission request
+	CAN_ERR_FLAG = 0x20000000 // Error message frame
+	CAN_SFF_MASK = 0x000007FF
+	CAN_EFF_MASK = 0x1FFFFFFF
+)
+
+// SocketCAN talks to a Linux raw CAN socket such as can0 or vcan0
+type SocketCAN struct {
+	Interface    string
+	Desc         string
+	HackSession  api.HackSession
+	Packets      [MAX_BUFFER]api.CanData
+	sock         *os.File
+	id           int
+	sniffEnabled bool
+	packetIdx    int
+	seqNo        int
+}
+
+func (s *SocketCAN) SetInterface(iface string) {
+	s.Interface = iface
+}
+
+func (s *SocketCAN) Init() bool {
+	logger.Log("Initializing SocketCAN on " + s.Interface)
+	s.Desc = "Not connected"
+	sock, err := openCanSocket(s.Interface)
+	if err != nil {
+		logger.Log("Could not open SocketCAN device: " + err.Error())
+		return false
+	}
+	s.sock = sock
+	s.Desc = "Interface: " + s.Interface
+	return true
+}
+
+func (s *SocketCAN) DeviceType() string {
+	return "SocketCAN"
+}
+
+func (s *SocketCAN) DeviceDesc() string {
+	return s.Desc
+}
+
+func (s *SocketCAN) GetId() int {
+	return s.id
+}
+
+func (s *SocketCAN) SetId(id int) {
+	s.id = id
+}
+
+func (s *SocketCAN) GetHackSession() api.HackSession {
+	return s.HackSession
+}
+
+func (s *SocketCAN) SetHackSession(hax api.HackSession) {
+	s.HackSession = hax
+}
+
+func (s *SocketCAN) GetYear() string {
+	return ""
+}
+
+func (s *SocketCAN) GetMake() string {
+	return ""
+}
+
+func (s *SocketCAN) GetModel() string {
+	return ""
+}
+
+func (s *SocketCAN) StartSniffing() {
+	s.sniffEnabled = true
+	s.packetIdx = 0
+	s.seqNo = 0
+	go s.processPackets()
+}
+
+func (s *SocketCAN) StopSniffing() {
+	s.sniffEnabled = false
+}
+
+func (s *SocketCAN) processPackets() {
+	if s.sock == nil {
+		logger.Log("SocketCAN not initialized")
+		return
+	}
+	frame := make([]byte, CAN_MTU)
+	for s.sniffEnabled == true {
+		// Use a deadline so StopSniffing is noticed on a quiet bus
+		s.sock.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := s.sock.Read(frame)
+		if err != nil {
+			if os.IsTimeout(err) {
+				continue
+			}
+			logger.Log("SocketCAN read error: " + err.Error())
+			s.sniffEnabled = false
+			return
+		}
+		if n < CAN_MTU {
+			continue
+		}
+		pkt, ok := decodeCanFrame(frame)
+		if ok {
+			pkt.Src = "SocketCAN"
+			pkt.Network = s.Interface
+			s.addPacket(pkt)
+		}
+	}
+}
+
+// decodeCanFrame converts a struct can_frame into a packet.  Error frames are dropped
+func decodeCanFrame(frame []byte) (api.CanData, bool) {
+	pkt := api.CanData{}
+	canId := binary.NativeEndian.Uint32(frame[0:4])
+	if canId&CAN_ERR_FLAG != 0 {
+		return pkt, false
+	}
+	pkt.Extended = canId&CAN_EFF_FLAG != 0
+	pkt.Remote = canId&CAN_RTR_FLAG != 0
+	if pkt.Extended {
+		pkt.ArbID = api.FormatArbId(canId&CAN_EFF_MASK, true)
+	} else {
+		pkt.ArbID = api.FormatArbId(canId&CAN_SFF_MASK, false)
+	}
+	dlc := int(frame[4])
+	if dlc > 8 {
+		dlc = 8
+	}
+	pkt.SetData(frame[8 : 8+dlc])
+	return pkt, true
+}
+
+// encodeCanFrame converts a packet into a struct can_frame
+func encodeCanFrame(pkt api.CanData) ([]byte, error) {
+	canId, err := api.Hextoui32(pkt.ArbID)
+	if err != nil {
+		return nil, logger.Err("Invalid ArbID: " + pkt.ArbID)
+	}
+	if pkt.Extended || canId > CAN_SFF_MASK {
+		canId = (canId & CAN_EFF_MASK) | CAN_EFF_FLAG
+	}
+	if pkt.Remote {
+		canId |= CAN_RTR_FLAG
+	}
+	data := pkt.Data()
+	frame := make([]byte, CAN_MTU)
+	binary.NativeEndian.PutUint32(frame[0:4], canId)
+	frame[4] = uint8(len(data))
+	copy(frame[8:], data)
+	return frame, nil
+}
+
+func (s *SocketCAN) addPacket(canpkt api.CanData) {
+	pkt := canpkt
+	pkt.SeqNo = s.seqNo
+	s.seqNo += 1
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
+	s.Packets[s.packetIdx] = pkt
+	s.packetIdx += 1
+	if s.packetIdx >= MAX_BUFFER {
+		s.packetIdx = 0
+	}
+}
+
+func (s *SocketCAN) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	var pkts []api.CanData
+	done := false
+	appends := 0
+	for done != true {
+		if idx >= MAX_BUFFER || idx < 0 {
+			idx = 0
+		}
+		if idx == s.packetIdx {
+			return pkts, s.packetIdx
+		}
+		pkts = append(pkts, s.Packets[idx])
+		idx += 1
+		appends += 1
+		if appends > MAX_APPENDS {
+			done = true
+		}
+	}
+	return pkts, s.packetIdx
+}
+
+func (s *SocketCAN) GetPacketIdx() int {
+	return s.packetIdx
+}
+
+func (s *SocketCAN) InjectPacket(pkt api.CanData) error {
+	if s.sock == nil {
+		return logger.Err("SocketCAN not initialized")
+	}
+	frame, err := encodeCanFrame(pkt)
+	if err != nil {
+		return err
+	}
+	_, err = s.sock.Write(frame)
+	if err != nil {
+		return logger.Err("Could not write to SocketCAN: " + err.Error())
+	}
+	// The kernel does not loop our own frames back so record it here
+	if pkt.Network == "" {
+		pkt.Network = s.Interface
+	}
+	s.addPacket(pkt)
+	return nil
+}
@@ -0,0 +1,45 @@
+package candevice
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+const CAN_RAW = 1
+
+// struct sockaddr_can from linux/can.h
+type sockaddrCan struct {
+	Family  uint16
+	_       [2]byte
+	Ifindex int32
+	Addr    [16]byte
+}
+
+// openCanSocket opens a raw CAN socket bound to iface
+func openCanSocket(iface string) (*os.File, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_CAN, syscall.SOCK_RAW, CAN_RAW)
+	if err != nil {
+		return nil, err
+	}
+	addr := sockaddrCan{Family: syscall.AF_CAN, Ifindex: int32(ifi.Index)}
+	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, logger.Err("Could not bind to " + iface + ": " + errno.Error())
+	}
+	// Non-blocking lets the runtime poller handle read deadlines
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "can:"+iface), nil
+}
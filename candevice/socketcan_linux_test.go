@@ -0,0 +1,49 @@
+package candevice
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSocketCANVcan sends between two sockets on vcan0, set up with
+//
+//	modprobe vcan
+//	ip link add dev vcan0 type vcan
+//	ip link set up vcan0
+func TestSocketCANVcan(t *testing.T) {
+	if _, err := net.InterfaceByName("vcan0"); err != nil {
+		t.Skip("vcan0 not present")
+	}
+	tx := &SocketCAN{Interface: "vcan0"}
+	rx := &SocketCAN{Interface: "vcan0"}
+	if !tx.Init() || !rx.Init() {
+		t.Fatal("Could not open vcan0")
+	}
+	rx.StartSniffing()
+	defer rx.StopSniffing()
+	sent := []string{}
+	for _, pkt := range []string{"7DF", "18DB33F1"} {
+		p := packet(pkt, len(pkt) > 3, false, []byte{0x02, 0x01, 0x00})
+		if err := tx.InjectPacket(p); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, describe(p))
+	}
+	if _, idx := tx.GetPacketsFrom(0); idx != 2 {
+		t.Errorf("Sender recorded %d packets, want 2", idx)
+	}
+	deadline := time.Now().Add(time.Second)
+	for rx.GetPacketIdx() < len(sent) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pkts, _ := rx.GetPacketsFrom(0)
+	if len(pkts) != len(sent) {
+		t.Fatalf("Received %d packets, want %d", len(pkts), len(sent))
+	}
+	for i := range pkts {
+		if describe(pkts[i]) != sent[i] || pkts[i].Network != "vcan0" || pkts[i].RxTime == 0 {
+			t.Errorf("got %s on %s, want %s", describe(pkts[i]), pkts[i].Network, sent[i])
+		}
+	}
+}
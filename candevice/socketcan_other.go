@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package candevice
+
+import (
+	"os"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+func openCanSocket(iface string) (*os.File, error) {
+	return nil, logger.Err("SocketCAN is only supported on Linux")
+}
@@ -0,0 +1,78 @@
+package candevice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+// describe prints the parts of a packet the codecs carry
+func describe(pkt api.CanData) string {
+	return fmt.Sprintf("%s ext=%v rtr=%v [% X]", pkt.ArbID, pkt.Extended, pkt.Remote, pkt.Data())
+}
+
+func packet(arbId string, extended bool, remote bool, data []byte) api.CanData {
+	pkt := api.CanData{ArbID: arbId, Extended: extended, Remote: remote}
+	pkt.SetData(data)
+	return pkt
+}
+
+// nextCommand waits for the driver to send a command to a fake adapter
+func nextCommand(t *testing.T, commands chan string) string {
+	select {
+	case cmd := <-commands:
+		return cmd
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a command")
+	}
+	return ""
+}
+
+func TestCanFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  api.CanData
+	}{
+		{"standard", packet("7E8", false, false, []byte{0x03, 0x41, 0x0C, 0x1A, 0xF8})},
+		{"extended", packet("18DAF110", true, false, []byte{1, 2, 3, 4, 5, 6, 7, 8})},
+		{"empty", packet("123", false, false, []byte{})},
+		{"remote", packet("456", false, true, []byte{0, 0})},
+	}
+	for _, tt := range tests {
+		frame, err := encodeCanFrame(tt.pkt)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(frame) != CAN_MTU || int(frame[4]) != len(tt.pkt.Data()) {
+			t.Errorf("%s: bad frame % X", tt.name, frame)
+		}
+		pkt, ok := decodeCanFrame(frame)
+		if !ok || describe(pkt) != describe(tt.pkt) {
+			t.Errorf("%s: got %s, want %s", tt.name, describe(pkt), describe(tt.pkt))
+		}
+	}
+}
+
+func TestCanFrameFlags(t *testing.T) {
+	frame, _ := encodeCanFrame(packet("100", true, true, nil))
+	if canId := binary.NativeEndian.Uint32(frame[0:4]); canId != 0x100|CAN_EFF_FLAG|CAN_RTR_FLAG {
+		t.Errorf("can_id %08X", canId)
+	}
+	errFrame := make([]byte, CAN_MTU)
+	binary.NativeEndian.PutUint32(errFrame[0:4], CAN_ERR_FLAG|0x001)
+	if _, ok := decodeCanFrame(errFrame); ok {
+		t.Error("Error frame was not dropped")
+	}
+	long := make([]byte, CAN_MTU)
+	long[4] = 15
+	if pkt, ok := decodeCanFrame(long); !ok || len(pkt.Data()) != 8 {
+		t.Errorf("DLC 15: got %s", describe(pkt))
+	}
+	if _, err := encodeCanFrame(packet("XYZ", false, false, nil)); err == nil {
+		t.Error("Bad ArbID encoded")
+	}
+}
@@ -0,0 +1,308 @@
+package candevice
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	SOCKETCAND_PORT         = 29536
+	SOCKETCAND_DIAL_TIMEOUT = 5 * time.Second
+)
+
+// Socketcand connects to a remote bus exported by a socketcand daemon
+type Socketcand struct {
+	Host          string
+	Port          int
+	Interface     string
+	Desc          string
+	HackSession   api.HackSession
+	Packets       [MAX_BUFFER]api.CanData
+	conn          net.Conn
+	reader        *bufio.Reader
+	id            int
+	sniffEnabled  bool
+	packetIdx     int
+	seqNo         int
+	lastTimestamp float64
+	writeLock     sync.Mutex
+}
+
+func (s *Socketcand) SetHost(host string) {
+	s.Host = host
+}
+
+func (s *Socketcand) SetPort(port int) {
+	s.Port = port
+}
+
+func (s *Socketcand) SetInterface(iface string) {
+	s.Interface = iface
+}
+
+func (s *Socketcand) Init() bool {
+	if s.Port == 0 {
+		s.Port = SOCKETCAND_PORT
+	}
+	if s.Interface == "" {
+		s.Interface = "can0"
+	}
+	remote := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	logger.Log("Connecting to socketcand on " + remote)
+	s.Desc = "Not connected"
+	conn, err := net.DialTimeout("tcp", remote, SOCKETCAND_DIAL_TIMEOUT)
+	if err != nil {
+		logger.Log("Could not connect to socketcand: " + err.Error())
+		return false
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	err = s.handshake()
+	if err != nil {
+		logger.Log("socketcand: " + err.Error())
+		conn.Close()
+		return false
+	}
+	s.Desc = s.Interface + " on " + remote
+	go s.readPackets()
+	return true
+}
+
+// handshake opens the remote bus and switches to raw mode
+func (s *Socketcand) handshake() error {
+	s.conn.SetReadDeadline(time.Now().Add(SOCKETCAND_DIAL_TIMEOUT))
+	defer s.conn.SetReadDeadline(time.Time{})
+	msg, err := ReadSocketcandMsg(s.reader)
+	if err != nil {
+		return err
+	}
+	if msg != "hi" {
+		return logger.Err("Unexpected greeting: " + msg)
+	}
+	cmds := []string{"open " + s.Interface, "rawmode"}
+	for i := range cmds {
+		err = s.send(cmds[i])
+		if err != nil {
+			return err
+		}
+		msg, err = ReadSocketcandMsg(s.reader)
+		if err != nil {
+			return err
+		}
+		if msg != "ok" {
+			return logger.Err(cmds[i] + " failed: " + msg)
+		}
+	}
+	return nil
+}
+
+func (s *Socketcand) send(msg string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err := s.conn.Write([]byte("< " + msg + " >"))
+	return err
+}
+
+// ReadSocketcandMsg returns the text between the next < and >
+func ReadSocketcandMsg(r *bufio.Reader) (string, error) {
+	_, err := r.ReadString('<')
+	if err != nil {
+		return "", err
+	}
+	msg, err := r.ReadString('>')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(msg, ">")), nil
+}
+
+func (s *Socketcand) readPackets() {
+	for {
+		msg, err := ReadSocketcandMsg(s.reader)
+		if err != nil {
+			logger.Log("socketcand connection lost: " + err.Error())
+			s.Desc = "Disconnected from " + s.Host
+			return
+		}
+		fields := strings.Fields(msg)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "frame":
+			pkt, ts, err := ParseSocketcandFrame(fields)
+			if err != nil {
+				logger.Log("socketcand: " + err.Error())
+				continue
+			}
+			if s.sniffEnabled {
+				pkt.Src = "socketcand"
+				pkt.Network = s.Interface
+				pkt.RelTime = s.relTime(ts)
+				s.addPacket(pkt)
+			}
+		case "error":
+			logger.Log("socketcand error: " + msg)
+		}
+	}
+}
+
+// ParseSocketcandFrame decodes the fields of "frame <id> <sec.usec> <data>".
+// Data may be sent as one hex string or as separate bytes
+func ParseSocketcandFrame(fields []string) (api.CanData, float64, error) {
+	pkt := api.CanData{}
+	if len(fields) < 3 {
+		return pkt, 0, logger.Err("Short frame: " + strings.Join(fields, " "))
+	}
+	arbId, err := api.Hextoui32(fields[1])
+	if err != nil {
+		return pkt, 0, logger.Err("Bad ArbID: " + fields[1])
+	}
+	pkt.Extended = len(fields[1]) > 3
+	pkt.ArbID = api.FormatArbId(arbId, pkt.Extended)
+	ts, _ := strconv.ParseFloat(fields[2], 64)
+	data, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil || len(data) > 8 {
+		return pkt, 0, logger.Err("Bad frame data: " + strings.Join(fields, " "))
+	}
+	pkt.SetData(data)
+	return pkt, ts, nil
+}
+
+// FormatSocketcandSend builds the "send <id> <dlc> <bytes>" command for a packet
+func FormatSocketcandSend(pkt api.CanData) (string, error) {
+	arbId, err := api.Hextoui32(pkt.ArbID)
+	if err != nil {
+		return "", logger.Err("Invalid ArbID: " + pkt.ArbID)
+	}
+	data := pkt.Data()
+	cmd := "send " + api.FormatArbId(arbId, pkt.Extended || arbId > CAN_SFF_MASK)
+	cmd += " " + strconv.Itoa(len(data))
+	for i := range data {
+		cmd += fmt.Sprintf(" %02X", data[i])
+	}
+	return cmd, nil
+}
+
+func (s *Socketcand) relTime(ts float64) string {
+	delta := 0.0
+	if s.lastTimestamp > 0 {
+		delta = ts - s.lastTimestamp
+	}
+	s.lastTimestamp = ts
+	return fmt.Sprintf("%.5f", delta)
+}
+
+func (s *Socketcand) DeviceType() string {
+	return "socketcand"
+}
+
+func (s *Socketcand) DeviceDesc() string {
+	return s.Desc
+}
+
+func (s *Socketcand) GetId() int {
+	return s.id
+}
+
+func (s *Socketcand) SetId(id int) {
+	s.id = id
+}
+
+func (s *Socketcand) GetHackSession() api.HackSession {
+	return s.HackSession
+}
+
+func (s *Socketcand) SetHackSession(hax api.HackSession) {
+	s.HackSession = hax
+}
+
+func (s *Socketcand) GetYear() string {
+	return ""
+}
+
+func (s *Socketcand) GetMake() string {
+	return ""
+}
+
+func (s *Socketcand) GetModel() string {
+	return ""
+}
+
+func (s *Socketcand) StartSniffing() {
+	s.packetIdx = 0
+	s.seqNo = 0
+	s.lastTimestamp = 0
+	s.sniffEnabled = true
+}
+
+func (s *Socketcand) StopSniffing() {
+	s.sniffEnabled = false
+}
+
+func (s *Socketcand) addPacket(canpkt api.CanData) {
+	pkt := canpkt
+	pkt.SeqNo = s.seqNo
+	s.seqNo += 1
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
+	s.Packets[s.packetIdx] = pkt
+	s.packetIdx += 1
+	if s.packetIdx >= MAX_BUFFER {
+		s.packetIdx = 0
+	}
+}
+
+func (s *Socketcand) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	var pkts []api.CanData
+	done := false
+	appends := 0
+	for done != true {
+		if idx >= MAX_BUFFER || idx < 0 {
+			idx = 0
+		}
+		if idx == s.packetIdx {
+			return pkts, s.packetIdx
+		}
+		pkts = append(pkts, s.Packets[idx])
+		idx += 1
+		appends += 1
+		if appends > MAX_APPENDS {
+			done = true
+		}
+	}
+	return pkts, s.packetIdx
+}
+
+func (s *Socketcand) GetPacketIdx() int {
+	return s.packetIdx
+}
+
+func (s *Socketcand) InjectPacket(pkt api.CanData) error {
+	if s.conn == nil {
+		return logger.Err("socketcand not connected")
+	}
+	cmd, err := FormatSocketcandSend(pkt)
+	if err != nil {
+		return err
+	}
+	err = s.send(cmd)
+	if err != nil {
+		return logger.Err("Could not send to socketcand: " + err.Error())
+	}
+	if pkt.Network == "" {
+		pkt.Network = s.Interface
+	}
+	s.addPacket(pkt)
+	return nil
+}
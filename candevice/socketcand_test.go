@@ -0,0 +1,94 @@
+package candevice
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeSocketcand listens on a loopback port for one client, says hi,
+// acknowledges open and rawmode and passes every command on
+func fakeSocketcand(t *testing.T) (int, chan net.Conn, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 1)
+	commands := make(chan string, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("< hi >"))
+		accepted <- conn
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := ReadSocketcandMsg(r)
+			if err != nil {
+				return
+			}
+			if msg == "open vcan0" || msg == "rawmode" {
+				conn.Write([]byte("< ok >"))
+			}
+			commands <- msg
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, accepted, commands
+}
+
+func TestSocketcandServer(t *testing.T) {
+	port, accepted, commands := fakeSocketcand(t)
+	s := &Socketcand{}
+	s.SetHost("127.0.0.1")
+	s.SetPort(port)
+	s.SetInterface("vcan0")
+	if !s.Init() {
+		t.Fatal("Init failed")
+	}
+	for _, want := range []string{"open vcan0", "rawmode"} {
+		if cmd := nextCommand(t, commands); cmd != want {
+			t.Fatalf("got command %q, want %q", cmd, want)
+		}
+	}
+	conn := <-accepted
+	defer conn.Close()
+	s.StartSniffing()
+	defer s.StopSniffing()
+	conn.Write([]byte("< frame 7E8 1.000100 03410C1A >< frame 18DAF110 1.250100 02 10 03 >"))
+	want := []string{
+		"7E8 ext=false rtr=false [03 41 0C 1A]",
+		"18DAF110 ext=true rtr=false [02 10 03]",
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.GetPacketIdx() < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pkts, _ := s.GetPacketsFrom(0)
+	if len(pkts) != len(want) {
+		t.Fatalf("Sniffed %d packets, want %d", len(pkts), len(want))
+	}
+	for i := range pkts {
+		if describe(pkts[i]) != want[i] {
+			t.Errorf("got %s, want %s", describe(pkts[i]), want[i])
+		}
+		if pkts[i].Network != "vcan0" {
+			t.Errorf("Network %q", pkts[i].Network)
+		}
+	}
+	if pkts[1].RelTime != "0.25000" {
+		t.Errorf("RelTime %q, want 0.25000", pkts[1].RelTime)
+	}
+	err := s.InjectPacket(packet("7DF", false, false, []byte{0x02, 0x01, 0x0C}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := nextCommand(t, commands); cmd != "send 7DF 3 02 01 0C" {
+		t.Errorf("Sent %q", cmd)
+	}
+	if pkts, _ = s.GetPacketsFrom(len(want)); len(pkts) != 1 || pkts[0].ArbID != "7DF" {
+		t.Errorf("Injected packet not recorded: %v", pkts)
+	}
+}
@@ -0,0 +1,249 @@
+package candevice
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+// virtualNode is anything that can be attached to a virtual bus
+type virtualNode interface {
+	receiveFrame(api.CanData)
+}
+
+// virtualBusSegment is one named in-process bus shared by its nodes
+type virtualBusSegment struct {
+	Name      string
+	Bitrate   int // 0 delivers frames immediately
+	nodes     []virtualNode
+	busyUntil time.Time
+	lock      sync.Mutex
+}
+
+var virtualBuses = map[string]*virtualBusSegment{}
+var virtualBusesLock sync.Mutex
+
+// attachVirtualNode adds a node to the named bus, creating the bus if needed
+func attachVirtualNode(name string, bitrate int, node virtualNode) *virtualBusSegment {
+	virtualBusesLock.Lock()
+	defer virtualBusesLock.Unlock()
+	bus, ok := virtualBuses[name]
+	if !ok {
+		bus = &virtualBusSegment{Name: name}
+		virtualBuses[name] = bus
+	}
+	bus.lock.Lock()
+	if bitrate > 0 {
+		bus.Bitrate = bitrate
+	}
+	bus.nodes = append(bus.nodes, node)
+	bus.lock.Unlock()
+	return bus
+}
+
+// detach removes a node, so a device initialised again is not on the bus twice
+func (b *virtualBusSegment) detach(node virtualNode) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var nodes []virtualNode
+	for i := range b.nodes {
+		if b.nodes[i] != node {
+			nodes = append(nodes, b.nodes[i])
+		}
+	}
+	b.nodes = nodes
+}
+
+// transmit delivers a frame to every node except the sender.  When the bus
+// has a bitrate the sender waits for the bus to go idle and for its frame to
+// go out, so frames sent at the same time queue up like a busy bus
+func (b *virtualBusSegment) transmit(from virtualNode, pkt api.CanData) {
+	b.lock.Lock()
+	if b.Bitrate > 0 {
+		start := time.Now()
+		if b.busyUntil.After(start) {
+			start = b.busyUntil
+		}
+		b.busyUntil = start.Add(FrameDuration(pkt, b.Bitrate))
+		wait := b.busyUntil.Sub(time.Now())
+		b.lock.Unlock()
+		time.Sleep(wait)
+		b.lock.Lock()
+	}
+	nodes := make([]virtualNode, len(b.nodes))
+	copy(nodes, b.nodes)
+	b.lock.Unlock()
+	for i := range nodes {
+		if nodes[i] != from {
+			nodes[i].receiveFrame(pkt)
+		}
+	}
+}
+
+// FrameDuration is how long a frame occupies the bus, ignoring stuff bits
+func FrameDuration(pkt api.CanData, bitrate int) time.Duration {
+	bits := 47
+	if pkt.Extended {
+		bits = 67
+	}
+	if !pkt.Remote {
+		bits += 8 * len(pkt.Data())
+	}
+	return time.Duration(bits) * time.Second / time.Duration(bitrate)
+}
+
+// VirtualBus is a software node on a named in-process bus.  Frames it
+// injects are seen by every other node attached to the same bus
+type VirtualBus struct {
+	Bus          string
+	Bitrate      int
+	HackSession  api.HackSession
+	Packets      [MAX_BUFFER]api.CanData
+	segment      *virtualBusSegment
+	id           int
+	sniffEnabled bool
+	packetIdx    int
+	seqNo        int
+	lock         sync.Mutex
+}
+
+func (v *VirtualBus) SetBus(bus string) {
+	v.Bus = bus
+}
+
+func (v *VirtualBus) SetBitrate(bitrate int) {
+	v.Bitrate = bitrate
+}
+
+func (v *VirtualBus) Init() bool {
+	if v.Bus == "" {
+		v.Bus = "vbus0"
+	}
+	logger.Log("Attaching to virtual bus " + v.Bus)
+	if v.segment != nil {
+		v.segment.detach(v) // Initialised again, possibly onto another bus
+	}
+	v.segment = attachVirtualNode(v.Bus, v.Bitrate, v)
+	return true
+}
+
+func (v *VirtualBus) DeviceType() string {
+	return "VirtualBus"
+}
+
+func (v *VirtualBus) DeviceDesc() string {
+	if v.segment != nil && v.segment.Bitrate > 0 {
+		return fmt.Sprintf("Bus: %s @ %dkbps", v.Bus, v.segment.Bitrate/1000)
+	}
+	return "Bus: " + v.Bus
+}
+
+func (v *VirtualBus) GetId() int {
+	return v.id
+}
+
+func (v *VirtualBus) SetId(id int) {
+	v.id = id
+}
+
+func (v *VirtualBus) GetHackSession() api.HackSession {
+	return v.HackSession
+}
+
+func (v *VirtualBus) SetHackSession(hax api.HackSession) {
+	v.HackSession = hax
+}
+
+func (v *VirtualBus) GetYear() string {
+	return ""
+}
+
+func (v *VirtualBus) GetMake() string {
+	return ""
+}
+
+func (v *VirtualBus) GetModel() string {
+	return ""
+}
+
+func (v *VirtualBus) StartSniffing() {
+	v.lock.Lock()
+	v.packetIdx = 0
+	v.seqNo = 0
+	v.sniffEnabled = true
+	v.lock.Unlock()
+}
+
+func (v *VirtualBus) StopSniffing() {
+	v.sniffEnabled = false
+}
+
+func (v *VirtualBus) receiveFrame(pkt api.CanData) {
+	if v.sniffEnabled {
+		v.addPacket(pkt)
+	}
+}
+
+func (v *VirtualBus) addPacket(canpkt api.CanData) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	pkt := canpkt
+	pkt.SeqNo = v.seqNo
+	v.seqNo += 1
+	now := time.Now()
+	pkt.AbsTime = now.Format("10:00:00pm (EST)")
+	pkt.RxTime = now.UnixNano()
+	if pkt.Network == "" {
+		pkt.Network = v.Bus
+	}
+	v.Packets[v.packetIdx] = pkt
+	v.packetIdx += 1
+	if v.packetIdx >= MAX_BUFFER {
+		v.packetIdx = 0
+	}
+}
+
+func (v *VirtualBus) GetPacketsFrom(idx int) ([]api.CanData, int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	var pkts []api.CanData
+	done := false
+	appends := 0
+	for done != true {
+		if idx >= MAX_BUFFER || idx < 0 {
+			idx = 0
+		}
+		if idx == v.packetIdx {
+			return pkts, v.packetIdx
+		}
+		pkts = append(pkts, v.Packets[idx])
+		idx += 1
+		appends += 1
+		if appends > MAX_APPENDS {
+			done = true
+		}
+	}
+	return pkts, v.packetIdx
+}
+
+func (v *VirtualBus) GetPacketIdx() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.packetIdx
+}
+
+func (v *VirtualBus) InjectPacket(pkt api.CanData) error {
+	if v.segment == nil {
+		return logger.Err("VirtualBus not attached")
+	}
+	_, err := api.Hextoui32(pkt.ArbID)
+	if err != nil {
+		return logger.Err("Invalid ArbID: " + pkt.ArbID)
+	}
+	v.segment.transmit(v, pkt)
+	v.addPacket(pkt)
+	return nil
+}
@@ -0,0 +1,105 @@
+package candevice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+// virtualNodeOn initialises a sniffing node on bus
+func virtualNodeOn(t *testing.T, bus string, bitrate int) *VirtualBus {
+	v := &VirtualBus{}
+	v.SetBus(bus)
+	v.SetBitrate(bitrate)
+	if !v.Init() {
+		t.Fatal("Init failed")
+	}
+	v.StartSniffing()
+	return v
+}
+
+func TestVirtualBus(t *testing.T) {
+	a := virtualNodeOn(t, "vbus-test-a", 0)
+	b := virtualNodeOn(t, "vbus-test-a", 0)
+	c := virtualNodeOn(t, "vbus-test-a", 0)
+	other := virtualNodeOn(t, "vbus-test-b", 0)
+	// Initialising again must not attach b twice
+	b.Init()
+	fromA := packet("7DF", false, false, []byte{0x02, 0x01, 0x0C})
+	fromC := packet("18DAF110", true, false, []byte{0x02, 0x10, 0x03})
+	if err := a.InjectPacket(fromA); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.InjectPacket(fromC); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		node *VirtualBus
+		want []string
+	}{
+		{"a", a, []string{describe(fromA), describe(fromC)}},
+		{"b", b, []string{describe(fromA), describe(fromC)}},
+		{"c", c, []string{describe(fromA), describe(fromC)}},
+		{"other bus", other, nil},
+	}
+	for _, tt := range tests {
+		pkts, _ := tt.node.GetPacketsFrom(0)
+		if len(pkts) != len(tt.want) {
+			t.Errorf("%s: got %d packets, want %d", tt.name, len(pkts), len(tt.want))
+			continue
+		}
+		for i := range pkts {
+			if describe(pkts[i]) != tt.want[i] || pkts[i].SeqNo != i || pkts[i].Network != "vbus-test-a" {
+				t.Errorf("%s: got %s seq %d on %q, want %s", tt.name, describe(pkts[i]), pkts[i].SeqNo, pkts[i].Network, tt.want[i])
+			}
+		}
+	}
+	if err := a.InjectPacket(packet("XYZ", false, false, nil)); err == nil {
+		t.Error("Invalid ArbID accepted")
+	}
+}
+
+func TestFrameDuration(t *testing.T) {
+	remote := packet("123", false, true, nil)
+	remote.SetDLC(8)
+	tests := []struct {
+		name    string
+		pkt     api.CanData
+		bitrate int
+		want    time.Duration
+	}{
+		{"empty", packet("123", false, false, nil), 500000, 94 * time.Microsecond},
+		{"full", packet("123", false, false, make([]byte, 8)), 500000, 222 * time.Microsecond},
+		{"extended full", packet("18DAF110", true, false, make([]byte, 8)), 500000, 262 * time.Microsecond},
+		{"remote", remote, 500000, 94 * time.Microsecond},
+		{"full at 125k", packet("123", false, false, make([]byte, 8)), 125000, 888 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		if got := FrameDuration(tt.pkt, tt.bitrate); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVirtualBusBitrate(t *testing.T) {
+	a := virtualNodeOn(t, "vbus-test-bitrate", 125000)
+	b := virtualNodeOn(t, "vbus-test-bitrate", 0)
+	if desc := b.DeviceDesc(); desc != "Bus: vbus-test-bitrate @ 125kbps" {
+		t.Errorf("DeviceDesc %q", desc)
+	}
+	pkt := packet("7E8", false, false, make([]byte, 8))
+	frames := 20
+	start := time.Now()
+	for i := 0; i < frames; i++ {
+		a.InjectPacket(pkt)
+	}
+	elapsed := time.Since(start)
+	if want := time.Duration(frames) * FrameDuration(pkt, 125000); elapsed < want {
+		t.Errorf("%d frames took %v, want at least %v", frames, elapsed, want)
+	}
+	if idx := b.GetPacketIdx(); idx != frames {
+		t.Errorf("Received %d frames, want %d", idx, frames)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ghetzel/canibus/analysis"
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/candevice"
+)
+
+func loadCapture(file string) ([]api.CanData, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return candevice.ParseCaptureFile(file, data)
+}
+
+// diffCommand runs "canibusd diff [-min score] [-top n] a b" and prints
+// what tells capture a apart from capture b
+func diffCommand(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	min := flags.Float64("min", analysis.DIFF_MIN_SCORE, "lowest score to report")
+	top := flags.Int("top", 20, "most bytes and bits to list, 0 for all")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: canibusd diff [-min score] [-top n] capture-a capture-b")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	fileA, fileB := flags.Arg(0), flags.Arg(1)
+	a, err := loadCapture(fileA)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, fileA+": "+err.Error())
+		return 1
+	}
+	b, err := loadCapture(fileB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, fileB+": "+err.Error())
+		return 1
+	}
+	report := analysis.Diff(a, b, *min)
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, only := range []struct {
+		file string
+		ids  []analysis.IdCount
+	}{{fileA, report.OnlyA}, {fileB, report.OnlyB}} {
+		for _, id := range only.ids {
+			fmt.Fprintf(out, "Only in %s:\t%s\t%d frames\n", only.file, id.ArbID, id.Count)
+		}
+	}
+	bytes, bits := report.Bytes, report.Bits
+	if *top > 0 && len(bytes) > *top {
+		bytes = bytes[:*top]
+	}
+	if *top > 0 && len(bits) > *top {
+		bits = bits[:*top]
+	}
+	fmt.Fprintf(out, "\nArbID\tByte\tScore\t%s\t%s\n", fileA, fileB)
+	for _, d := range bytes {
+		fmt.Fprintf(out, "%s\t%d\t%.2f\t%s %3.0f%% (%d values)\t%s %3.0f%% (%d values)\n", d.ArbID, d.Byte, d.Score,
+			d.ValueA, d.ShareA*100, d.DistinctA, d.ValueB, d.ShareB*100, d.DistinctB)
+	}
+	fmt.Fprintf(out, "\nArbID\tBit\tScore\t%s\t%s\n", fileA, fileB)
+	for _, d := range bits {
+		fmt.Fprintf(out, "%s\t%d.%d\t%.2f\t%3.0f%% set\t%3.0f%% set\n", d.ArbID, d.Bit/8, d.Bit%8, d.Score, d.SetA*100, d.SetB*100)
+	}
+	out.Flush()
+	return 0
+}
@@ -14,8 +14,10 @@ const (
 	DEFAULT_IP          = "0.0.0.0"
 	DEFAULT_PORT        = "1234"
 	DEFAULT_WEBPORT     = "2515"
+	DEFAULT_SOCKETCAND  = "29536"
 	DEFAULT_WWW_ROOT    = "www"
 	DEFAULT_CONFIG_FILE = "config.json"
+	DEFAULT_VEHICLE_DIR = "vehicles"
 )
 
 var ServerConfig server.Config
@@ -23,8 +25,10 @@ var ServerConfig server.Config
 var bindIP = flag.String("ip", DEFAULT_IP, "IP to bind to")
 var tcpPort = flag.String("port", DEFAULT_PORT, "TCP port")
 var wwwPort = flag.String("www", DEFAULT_WEBPORT, "port for web server")
+var socketcandPort = flag.String("socketcand", DEFAULT_SOCKETCAND, "port for socketcand server, empty to disable")
 var wwwRoot = flag.String("root", DEFAULT_WWW_ROOT, "file path for web server")
 var configFile = flag.String("config", DEFAULT_CONFIG_FILE, "Settings config file")
+var vehicleDir = flag.String("vehicles", DEFAULT_VEHICLE_DIR, "directory for per vehicle signal databases")
 
 func launchTCPServer() {
 	err := server.StartListener(*bindIP, *tcpPort)
@@ -34,6 +38,14 @@ func launchTCPServer() {
 	}
 }
 
+func launchSocketcandServer() {
+	err := server.StartSocketcandListener(*bindIP, *socketcandPort)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+}
+
 func launchSPAWebServer() {
 	err := webserver.StartSPAWebListener(*wwwRoot, *bindIP, *wwwPort)
 	if err != nil {
@@ -54,9 +66,16 @@ func launchWebServer() {
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "diff" {
+		os.Exit(diffCommand(flag.Args()[1:]))
+	}
 	core.SetConfig(&ServerConfig)
+	core.SetVehicleDir(*vehicleDir)
 	core.LoadConfig(*configFile)
 	server.InitDrivers()
 	go launchTCPServer()
+	if *socketcandPort != "" {
+		go launchSocketcandServer()
+	}
 	launchSPAWebServer()
 }
@@ -2,13 +2,19 @@
 package core
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/dbc"
 	"github.com/ghetzel/canibus/logger"
 )
 
 type CoreData struct {
-	CConfig api.Configer
-	Users   []api.User
+	CConfig    api.Configer
+	Users      []api.User
+	SignalDBs  map[int]*dbc.Database // Per device ID
+	VehicleDir string                // Where signal databases are kept per VIN
 }
 
 var CData CoreData
@@ -58,3 +64,35 @@ func GetUserByName(userName string) (api.User, error) {
 func AddUser(user api.User) {
 	CData.Users = append(CData.Users, user)
 }
+
+// SetSignalDB attaches a signal database to a device
+func SetSignalDB(devId int, db *dbc.Database) {
+	if CData.SignalDBs == nil {
+		CData.SignalDBs = map[int]*dbc.Database{}
+	}
+	CData.SignalDBs[devId] = db
+}
+
+// GetSignalDB returns the signal database attached to a device, or nil
+func GetSignalDB(devId int) *dbc.Database {
+	return CData.SignalDBs[devId]
+}
+
+// SetVehicleDir sets where signal databases built in hack sessions are kept
+func SetVehicleDir(dir string) {
+	CData.VehicleDir = dir
+}
+
+// VehicleDBFile returns the DBC file kept for a VIN, creating the vehicle
+// directory if needed
+func VehicleDBFile(vin string) (string, error) {
+	dir := CData.VehicleDir
+	if dir == "" {
+		dir = "."
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", logger.Err("Could not create vehicle directory " + dir)
+	}
+	return filepath.Join(dir, vin+".dbc"), nil
+}
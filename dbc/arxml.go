@@ -0,0 +1,243 @@
+package dbc
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+// arNode is any ARXML element, the schema is too large to map into structs
+type arNode struct {
+	XMLName xml.Name
+	Text    string   `xml:",chardata"`
+	Nodes   []arNode `xml:",any"`
+}
+
+// child returns the first direct child named tag, or an empty node
+func (n *arNode) child(tag string) *arNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == tag {
+			return &n.Nodes[i]
+		}
+	}
+	return &arNode{}
+}
+
+// find returns the first descendant named tag, depth first
+func (n *arNode) find(tag string) *arNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == tag {
+			return &n.Nodes[i]
+		}
+		if found := n.Nodes[i].find(tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// findAll returns every descendant named tag
+func (n *arNode) findAll(tag string, found []*arNode) []*arNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == tag {
+			found = append(found, &n.Nodes[i])
+		}
+		found = n.Nodes[i].findAll(tag, found)
+	}
+	return found
+}
+
+// text returns the trimmed text of the first descendant named tag
+func (n *arNode) text(tag string) string {
+	if found := n.find(tag); found != nil {
+		return strings.TrimSpace(found.Text)
+	}
+	return ""
+}
+
+// number reads the first descendant named tag, 0x prefixes are allowed
+func (n *arNode) number(tag string) (int64, bool) {
+	text := n.text(tag)
+	value, err := strconv.ParseInt(text, 0, 64)
+	if err != nil {
+		f, ferr := strconv.ParseFloat(text, 64)
+		return int64(f), ferr == nil
+	}
+	return value, true
+}
+
+// arxml indexes every element that has a SHORT-NAME by its reference path
+type arxml struct {
+	paths map[string]*arNode
+	names map[string]*arNode // Last path component, for sloppy references
+}
+
+func (a *arxml) index(n *arNode, path string) {
+	if name := shortName(n); name != "" {
+		path = path + "/" + name
+		a.paths[path] = n
+		a.names[name] = n
+	}
+	for i := range n.Nodes {
+		a.index(&n.Nodes[i], path)
+	}
+}
+
+// ref resolves the first descendant reference named tag
+func (a *arxml) ref(n *arNode, tag string) *arNode {
+	path := n.text(tag)
+	if path == "" {
+		return nil
+	}
+	if found, ok := a.paths[path]; ok {
+		return found
+	}
+	return a.names[path[strings.LastIndex(path, "/")+1:]]
+}
+
+func shortName(n *arNode) string {
+	return strings.TrimSpace(n.child("SHORT-NAME").Text)
+}
+
+// comment returns the description of an element
+func comment(n *arNode) string {
+	return n.child("DESC").text("L-2")
+}
+
+// compuMethod applies a COMPU-METHOD's scaling and text table to a signal
+func (a *arxml) compuMethod(sig *Signal, compu *arNode) {
+	for _, scale := range compu.findAll("COMPU-SCALE", nil) {
+		if coeffs := scale.find("COMPU-RATIONAL-COEFFS"); coeffs != nil {
+			var num []float64
+			for _, v := range coeffs.child("COMPU-NUMERATOR").findAll("V", nil) {
+				f, _ := strconv.ParseFloat(strings.TrimSpace(v.Text), 64)
+				num = append(num, f)
+			}
+			den := 1.0
+			if f, err := strconv.ParseFloat(coeffs.child("COMPU-DENOMINATOR").text("V"), 64); err == nil && f != 0 {
+				den = f
+			}
+			if len(num) >= 2 {
+				sig.Offset = num[0] / den
+				sig.Factor = num[1] / den
+			}
+			continue
+		}
+		text := scale.text("VT")
+		lower, lok := scale.number("LOWER-LIMIT")
+		upper, uok := scale.number("UPPER-LIMIT")
+		if text == "" || !lok {
+			continue
+		}
+		if !uok {
+			upper = lower
+		}
+		sig.setValueRange(lower, upper, text)
+	}
+	if unit := a.ref(compu, "UNIT-REF"); unit != nil && sig.Unit == "" {
+		sig.Unit = unit.text("DISPLAY-NAME")
+		if sig.Unit == "" {
+			sig.Unit = shortName(unit)
+		}
+	}
+}
+
+// signal builds a signal from an I-SIGNAL-TO-I-PDU-MAPPING placed at bit
+// offset pduStart of the frame
+func (a *arxml) signal(mapping *arNode, pduStart int) *Signal {
+	isignal := a.ref(mapping, "I-SIGNAL-REF")
+	if isignal == nil {
+		isignal = a.ref(mapping, "SIGNAL-REF") // AUTOSAR 3
+	}
+	if isignal == nil {
+		return nil // Signal groups carry no bits of their own
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(isignal.child("LENGTH").Text))
+	start, ok := mapping.number("START-POSITION")
+	if err != nil || !ok || length < 1 || length > 64 {
+		return nil
+	}
+	sig := &Signal{Name: shortName(isignal), Length: int(length), Factor: 1, Comment: comment(isignal)}
+	sig.LittleEndian = mapping.text("PACKING-BYTE-ORDER") != "MOST-SIGNIFICANT-BYTE-FIRST"
+	sig.StartBit = int(start) + pduStart
+	if !sig.LittleEndian {
+		sig.StartBit = lsbToMsb(sig.StartBit, sig.Length)
+	}
+	system := a.ref(isignal, "SYSTEM-SIGNAL-REF")
+	if sig.Comment == "" && system != nil {
+		sig.Comment = comment(system)
+	}
+	if base := a.ref(isignal, "BASE-TYPE-REF"); base != nil {
+		switch base.text("BASE-TYPE-ENCODING") {
+		case "2C", "1C", "SM":
+			sig.Signed = true
+		case "IEEE754":
+			sig.Type = SIGNAL_FLOAT
+			if sig.Length == 64 {
+				sig.Type = SIGNAL_DOUBLE
+			}
+		}
+	}
+	compu := a.ref(isignal, "COMPU-METHOD-REF")
+	if compu == nil && system != nil {
+		compu = a.ref(system, "COMPU-METHOD-REF")
+	}
+	if compu != nil {
+		a.compuMethod(sig, compu)
+	}
+	if sig.Unit == "" {
+		if unit := a.ref(isignal, "UNIT-REF"); unit != nil {
+			sig.Unit = unit.text("DISPLAY-NAME")
+		}
+	}
+	return sig
+}
+
+// ParseARXML reads the CAN frames of an AUTOSAR system description.  Frames
+// are found through their CAN-FRAME-TRIGGERING, signals through the
+// I-SIGNAL-I-PDUs mapped into them.  Multiplexed and container PDUs are not
+// supported
+func ParseARXML(data []byte) (*Database, error) {
+	var root arNode
+	err := xml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, logger.Err("Could not parse ARXML: " + err.Error())
+	}
+	a := &arxml{paths: map[string]*arNode{}, names: map[string]*arNode{}}
+	a.index(&root, "")
+	db := NewDatabase()
+	for _, ecu := range root.findAll("ECU-INSTANCE", nil) {
+		db.Nodes = append(db.Nodes, shortName(ecu))
+	}
+	for _, trigger := range root.findAll("CAN-FRAME-TRIGGERING", nil) {
+		id, ok := trigger.number("IDENTIFIER")
+		frame := a.ref(trigger, "FRAME-REF")
+		if !ok || frame == nil {
+			continue
+		}
+		extended := trigger.text("CAN-ADDRESSING-MODE") == "EXTENDED" || id > 0x7FF
+		msg := &Message{ID: uint32(id), Extended: extended, Name: shortName(frame), Comment: comment(frame)}
+		if dlc, ok := frame.number("FRAME-LENGTH"); ok {
+			msg.DLC = int(dlc)
+		}
+		for _, pduMapping := range frame.findAll("PDU-TO-FRAME-MAPPING", nil) {
+			pdu := a.ref(pduMapping, "PDU-REF")
+			if pdu == nil {
+				continue
+			}
+			pduStart, _ := pduMapping.number("START-POSITION")
+			for _, mapping := range pdu.findAll("I-SIGNAL-TO-I-PDU-MAPPING", nil) {
+				if sig := a.signal(mapping, int(pduStart)); sig != nil {
+					msg.Signals = append(msg.Signals, sig)
+				}
+			}
+		}
+		db.Messages[Key(msg.ID, msg.Extended)] = msg
+	}
+	if len(db.Messages) == 0 {
+		return nil, logger.Err("No CAN frames found in ARXML")
+	}
+	return db, nil
+}
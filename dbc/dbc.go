@@ -0,0 +1,424 @@
+// Package dbc holds a CAN signal database, loaded from Vector DBC, Kayak KCD
+// or AUTOSAR ARXML files, and decodes packets with it
+package dbc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	DBC_EXTENDED_FLAG = 0x80000000 // Set on extended IDs in DBC files
+	DBC_INDEPENDENT   = 0xC0000000 // VECTOR__INDEPENDENT_SIG_MSG pseudo message
+	SIGNAL_INTEGER    = 0
+	SIGNAL_FLOAT      = 1
+	SIGNAL_DOUBLE     = 2
+	MAX_VALUE_RANGE   = 0xFF // Widest range of raw values given one description
+)
+
+// Signal is a value packed into some bits of a message
+type Signal struct {
+	Name         string
+	StartBit     int // LSB for little endian, MSB for big endian signals
+	Length       int
+	LittleEndian bool // Intel byte order, big endian is Motorola
+	Signed       bool
+	Type         int // SIGNAL_INTEGER, SIGNAL_FLOAT or SIGNAL_DOUBLE
+	Factor       float64
+	Offset       float64
+	Min          float64
+	Max          float64
+	Unit         string
+	Receivers    []string
+	Multiplexor  bool // Selects which multiplexed signals are present
+	Multiplexed  bool // Only present when the multiplexor equals MuxValue
+	MuxValue     int
+	Values       map[int64]string
+	Comment      string
+}
+
+// Message is a frame layout
+type Message struct {
+	ID          uint32
+	Extended    bool
+	Name        string
+	DLC         int
+	Transmitter string
+	Signals     []*Signal
+	Comment     string
+}
+
+// Database is a set of message layouts
+type Database struct {
+	Version     string
+	Comment     string
+	Nodes       []string
+	Messages    map[uint32]*Message // Keyed by ID, DBC_EXTENDED_FLAG set for extended
+	ValueTables map[string]map[int64]string
+}
+
+var (
+	boRegexp = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:\s*(\d+)\s+(\S+)`)
+	sgRegexp = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+M?)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(\s*([^,]+?)\s*,\s*([^)]+?)\s*\)\s*\[\s*([^|]*?)\s*\|\s*([^\]]*?)\s*\]\s*"((?:[^"\\]|\\.)*)"\s*(.*)$`)
+)
+
+// statementKeywords start statements that run until a semicolon and may
+// span lines
+var statementKeywords = []string{"CM_", "VAL_", "VAL_TABLE_", "SIG_VALTYPE_", "BA_", "BA_DEF_", "BA_DEF_DEF_",
+	"BA_DEF_REL_", "BA_REL_", "BA_DEF_DEF_REL_", "BO_TX_BU_", "SIG_GROUP_", "EV_", "ENVVAR_DATA_", "SGTYPE_", "SIG_TYPE_REF_"}
+
+// NewDatabase returns an empty database
+func NewDatabase() *Database {
+	return &Database{Messages: map[uint32]*Message{}, ValueTables: map[string]map[int64]string{}}
+}
+
+// Key returns the Messages key of an ID
+func Key(id uint32, extended bool) uint32 {
+	if extended {
+		return id | DBC_EXTENDED_FLAG
+	}
+	return id
+}
+
+// LoadFile reads a DBC, KCD or ARXML file
+func LoadFile(file string) (*Database, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, logger.Err("Could not open signal database " + file)
+	}
+	return Load(buf)
+}
+
+// Load parses a signal database in any supported format.  XML is told apart
+// by its root element, anything else is taken to be a DBC
+func Load(data []byte) (*Database, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return Parse(data)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "NetworkDefinition":
+				return ParseKCD(data)
+			case "AUTOSAR":
+				return ParseARXML(data)
+			}
+			return nil, logger.Err("Unknown signal database format " + t.Name.Local)
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return Parse(data)
+			}
+		}
+	}
+}
+
+// tokenize splits a statement into words, numbers, punctuation and quoted
+// strings.  Quoted strings keep their quotes so they can be told apart
+func tokenize(stmt string) []string {
+	var tokens []string
+	for i := 0; i < len(stmt); {
+		c := stmt[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(stmt) && stmt[j] != '"' {
+				if stmt[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(stmt) {
+				j = len(stmt) - 1
+			}
+			tokens = append(tokens, stmt[i:j+1])
+			i = j + 1
+		case strings.IndexByte(":;,|@()[]", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(stmt) && strings.IndexByte(" \t\r\n\":;,|@()[]", stmt[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, stmt[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func unquote(token string) string {
+	if len(token) >= 2 && token[0] == '"' {
+		token = token[1 : len(token)-1]
+	}
+	return strings.Replace(token, `\"`, `"`, -1)
+}
+
+// statementDone reports whether a statement has its closing semicolon
+// outside of any quoted string
+func statementDone(stmt string) bool {
+	quoted := false
+	for i := 0; i < len(stmt); i++ {
+		switch stmt[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func keyword(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(fields[0], ":")
+}
+
+// Parse reads the contents of a DBC file
+func Parse(data []byte) (*Database, error) {
+	db := NewDatabase()
+	var msg *Message
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	for n := 0; n < len(lines); n++ {
+		line := strings.TrimSpace(lines[n])
+		kw := keyword(line)
+		if kw == "NS_" {
+			// The new symbols list is indented keyword names, skip it
+			for n+1 < len(lines) && (strings.TrimSpace(lines[n+1]) == "" || lines[n+1][0] == ' ' || lines[n+1][0] == '\t') {
+				n++
+			}
+			continue
+		}
+		for _, k := range statementKeywords {
+			if kw == k {
+				start := n + 1
+				for !statementDone(line) && n+1 < len(lines) {
+					n++
+					line += "\n" + lines[n]
+				}
+				err := db.parseStatement(kw, line)
+				if err != nil {
+					return nil, logger.Err(fmt.Sprintf("DBC line %d: %s", start, err.Error()))
+				}
+				kw = "_"
+				break
+			}
+		}
+		if kw != "SG_" && kw != "" {
+			msg = nil
+		}
+		switch kw {
+		case "VERSION":
+			db.Version = unquote(strings.TrimSpace(strings.TrimPrefix(line, "VERSION")))
+		case "BU_":
+			db.Nodes = strings.Fields(strings.TrimPrefix(strings.TrimPrefix(line, "BU_"), ":"))
+		case "BO_":
+			m := boRegexp.FindStringSubmatch(line)
+			if m == nil {
+				return nil, logger.Err(fmt.Sprintf("DBC line %d: bad message", n+1))
+			}
+			id, _ := strconv.ParseUint(m[1], 10, 32)
+			if uint32(id) == DBC_INDEPENDENT {
+				continue
+			}
+			dlc, _ := strconv.Atoi(m[3])
+			msg = &Message{ID: uint32(id) &^ DBC_EXTENDED_FLAG, Extended: uint32(id)&DBC_EXTENDED_FLAG != 0,
+				Name: m[2], DLC: dlc, Transmitter: m[4]}
+			db.Messages[uint32(id)] = msg
+		case "SG_":
+			if msg == nil {
+				continue
+			}
+			sig, err := parseSignal(line)
+			if err != nil {
+				return nil, logger.Err(fmt.Sprintf("DBC line %d: %s", n+1, err.Error()))
+			}
+			msg.Signals = append(msg.Signals, sig)
+		}
+	}
+	return db, nil
+}
+
+func parseSignal(line string) (*Signal, error) {
+	m := sgRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return nil, logger.Err("bad signal")
+	}
+	sig := &Signal{Name: m[1], LittleEndian: m[5] == "1", Signed: m[6] == "-", Unit: unquote(`"` + m[11] + `"`)}
+	sig.StartBit, _ = strconv.Atoi(m[3])
+	sig.Length, _ = strconv.Atoi(m[4])
+	if sig.Length < 1 || sig.Length > 64 {
+		return nil, logger.Err("bad signal length for " + sig.Name)
+	}
+	var err error
+	for i, f := range []*float64{&sig.Factor, &sig.Offset, &sig.Min, &sig.Max} {
+		*f, err = strconv.ParseFloat(m[7+i], 64)
+		if err != nil {
+			return nil, logger.Err("bad number in signal " + sig.Name)
+		}
+	}
+	mux := m[2]
+	if strings.HasSuffix(mux, "M") {
+		sig.Multiplexor = true
+		mux = strings.TrimSuffix(mux, "M")
+	}
+	if strings.HasPrefix(mux, "m") {
+		sig.Multiplexed = true
+		sig.MuxValue, _ = strconv.Atoi(mux[1:])
+	}
+	for _, r := range strings.FieldsFunc(m[12], func(c rune) bool { return c == ',' || c == ' ' || c == '\t' }) {
+		sig.Receivers = append(sig.Receivers, r)
+	}
+	return sig, nil
+}
+
+// parseValues reads "n "desc" n "desc" ..." pairs
+func parseValues(tokens []string) (map[int64]string, error) {
+	values := map[int64]string{}
+	for i := 0; i+1 < len(tokens); i += 2 {
+		if tokens[i] == ";" {
+			break
+		}
+		n, err := strconv.ParseInt(tokens[i], 10, 64)
+		if err != nil {
+			f, ferr := strconv.ParseFloat(tokens[i], 64)
+			if ferr != nil {
+				return nil, logger.Err("bad value " + tokens[i])
+			}
+			n = int64(f)
+		}
+		values[n] = unquote(tokens[i+1])
+	}
+	return values, nil
+}
+
+func (db *Database) signal(id string, name string) *Signal {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil
+	}
+	msg, ok := db.Messages[uint32(n)]
+	if !ok {
+		return nil
+	}
+	return msg.Signal(name)
+}
+
+func (db *Database) parseStatement(kw string, stmt string) error {
+	tokens := tokenize(stmt)
+	switch kw {
+	case "CM_":
+		if len(tokens) >= 2 && strings.HasPrefix(tokens[1], `"`) {
+			db.Comment = unquote(tokens[1])
+		} else if len(tokens) >= 4 && tokens[1] == "BO_" {
+			n, _ := strconv.ParseUint(tokens[2], 10, 32)
+			if msg, ok := db.Messages[uint32(n)]; ok {
+				msg.Comment = unquote(tokens[3])
+			}
+		} else if len(tokens) >= 5 && tokens[1] == "SG_" {
+			if sig := db.signal(tokens[2], tokens[3]); sig != nil {
+				sig.Comment = unquote(tokens[4])
+			}
+		}
+	case "VAL_TABLE_":
+		if len(tokens) < 2 {
+			return logger.Err("bad value table")
+		}
+		values, err := parseValues(tokens[2:])
+		if err != nil {
+			return err
+		}
+		db.ValueTables[tokens[1]] = values
+	case "VAL_":
+		if len(tokens) < 3 {
+			return logger.Err("bad value description")
+		}
+		if _, err := strconv.ParseUint(tokens[1], 10, 32); err != nil {
+			return nil // Environment variable
+		}
+		values, err := parseValues(tokens[3:])
+		if err != nil {
+			return err
+		}
+		if sig := db.signal(tokens[1], tokens[2]); sig != nil {
+			sig.Values = values
+		}
+	case "SIG_VALTYPE_":
+		// SIG_VALTYPE_ id name : type ;
+		if len(tokens) >= 5 {
+			if sig := db.signal(tokens[1], tokens[2]); sig != nil {
+				sig.Type, _ = strconv.Atoi(tokens[4])
+			}
+		}
+	}
+	return nil
+}
+
+// setValueRange describes every raw value from lower to upper with text.
+// Only small ranges are worth expanding, wider ones are skipped
+func (s *Signal) setValueRange(lower int64, upper int64, text string) {
+	if upper < lower || upper-lower > MAX_VALUE_RANGE {
+		return
+	}
+	if s.Values == nil {
+		s.Values = map[int64]string{}
+	}
+	for i := int64(0); i <= upper-lower; i++ {
+		s.Values[lower+i] = text
+	}
+}
+
+// Signal returns the signal with a name
+func (m *Message) Signal(name string) *Signal {
+	for i := range m.Signals {
+		if m.Signals[i].Name == name {
+			return m.Signals[i]
+		}
+	}
+	return nil
+}
+
+// Lookup returns the layout for an ArbID as found in CanData
+func (db *Database) Lookup(arbId string, extended bool) *Message {
+	id, err := api.Hextoui32(arbId)
+	if err != nil {
+		return nil
+	}
+	extended = extended || id > 0x7FF
+	if msg, ok := db.Messages[Key(id, extended)]; ok {
+		return msg
+	}
+	return db.Messages[Key(id, !extended)]
+}
+
+// SortedMessages returns the messages ordered by ID
+func (db *Database) SortedMessages() []*Message {
+	var msgs []*Message
+	for _, msg := range db.Messages {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return Key(msgs[i].ID, msgs[i].Extended) < Key(msgs[j].ID, msgs[j].Extended) })
+	return msgs
+}
@@ -0,0 +1,217 @@
+package dbc
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+const fixture = `VERSION "1.0"
+
+
+NS_ :
+	NS_DESC_
+	CM_
+	VAL_
+	VAL_TABLE_
+	SIG_VALTYPE_
+
+BS_:
+
+BU_: ECM TCM
+
+VAL_TABLE_ Gears 0 "P" 1 "R" 2 "N" 3 "D" ;
+
+BO_ 256 Engine: 8 ECM
+ SG_ RPM : 7|16@0+ (0.25,0) [0|16383.75] "rpm" TCM
+ SG_ Coolant : 16|8@1- (1,0) [-128|127] "degC" TCM
+ SG_ Torque : 31|12@0- (0.5,0) [-1024|1023.5] "Nm" TCM,ECM
+ SG_ Gear : 40|4@1+ (1,0) [0|3] "" TCM
+
+BO_ 512 Fuel: 4 ECM
+ SG_ Level : 0|32@1- (1,0) [0|100] "%" Vector__XXX
+
+BO_ 2564485392 Diag: 8 TCM
+ SG_ Mode M : 0|8@1+ (1,0) [0|255] "" ECM
+ SG_ Speed m1 : 8|8@1+ (1,0) [0|255] "km/h" ECM
+ SG_ Volts m2 : 8|16@1+ (0.001,0) [0|65.535] "V" ECM
+
+BO_ 3221225472 VECTOR__INDEPENDENT_SIG_MSG: 0 Vector__XXX
+ SG_ Orphan : 0|8@1+ (1,0) [0|0] "" Vector__XXX
+
+CM_ "Test database";
+CM_ BO_ 256 "Engine status";
+CM_ SG_ 256 RPM "Crank speed;
+filtered";
+VAL_ 256 Gear 0 "P" 1 "R" 2 "N" 3 "D" ;
+SIG_VALTYPE_ 512 Level : 1;
+`
+
+func loadFixture(t *testing.T) *Database {
+	db, err := Parse([]byte(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func packet(arbId string, extended bool, data []byte) api.CanData {
+	pkt := api.CanData{ArbID: arbId, Extended: extended}
+	pkt.SetData(data)
+	return pkt
+}
+
+func TestParse(t *testing.T) {
+	db := loadFixture(t)
+	if db.Version != "1.0" || db.Comment != "Test database" || !reflect.DeepEqual(db.Nodes, []string{"ECM", "TCM"}) {
+		t.Errorf("header: version %q comment %q nodes %v", db.Version, db.Comment, db.Nodes)
+	}
+	if len(db.Messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(db.Messages))
+	}
+	if !reflect.DeepEqual(db.ValueTables["Gears"], map[int64]string{0: "P", 1: "R", 2: "N", 3: "D"}) {
+		t.Errorf("value table %v", db.ValueTables["Gears"])
+	}
+	engine := db.Lookup("100", false)
+	if engine == nil || engine.Name != "Engine" || engine.DLC != 8 || engine.Transmitter != "ECM" || engine.Comment != "Engine status" {
+		t.Fatalf("Engine: %+v", engine)
+	}
+	rpm := engine.Signal("RPM")
+	want := &Signal{Name: "RPM", StartBit: 7, Length: 16, Factor: 0.25, Max: 16383.75, Unit: "rpm",
+		Receivers: []string{"TCM"}, Comment: "Crank speed;\nfiltered"}
+	if !reflect.DeepEqual(rpm, want) {
+		t.Errorf("RPM: got %+v, want %+v", rpm, want)
+	}
+	if torque := engine.Signal("Torque"); !torque.Signed || torque.LittleEndian || !reflect.DeepEqual(torque.Receivers, []string{"TCM", "ECM"}) {
+		t.Errorf("Torque: %+v", torque)
+	}
+	if gear := engine.Signal("Gear"); gear.Values[3] != "D" {
+		t.Errorf("Gear values %v", gear.Values)
+	}
+	if level := db.Lookup("200", false).Signal("Level"); level.Type != SIGNAL_FLOAT {
+		t.Errorf("Level type %d", level.Type)
+	}
+	diag := db.Lookup("18DAF110", true)
+	if diag == nil || diag.ID != 0x18DAF110 || !diag.Extended {
+		t.Fatalf("Diag: %+v", diag)
+	}
+	if mode, volts := diag.Signal("Mode"), diag.Signal("Volts"); !mode.Multiplexor || !volts.Multiplexed || volts.MuxValue != 2 {
+		t.Errorf("mux: %+v %+v", mode, volts)
+	}
+	if db.Lookup("18DAF110", false) != diag {
+		t.Error("Extended ID not found without the extended flag")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"BO_ x Engine: 8 ECM\n",
+		"BO_ 256 Engine: 8 ECM\n SG_ RPM : 7|16@0+ (0.25,0) \"rpm\" TCM\n",
+		"BO_ 256 Engine: 8 ECM\n SG_ RPM : 0|0@1+ (1,0) [0|0] \"\" TCM\n",
+		"BO_ 256 Engine: 8 ECM\n SG_ RPM : 0|8@1+ (x,0) [0|0] \"\" TCM\n",
+		"VAL_TABLE_ Gears x \"P\" ;\n",
+		"VAL_ 256 Gear zero \"P\" ;\n",
+	}
+	for _, dbc := range tests {
+		if _, err := Parse([]byte(dbc)); err == nil {
+			t.Errorf("%q: no error", dbc)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	db := loadFixture(t)
+	level := make([]byte, 4)
+	binary.LittleEndian.PutUint32(level, math.Float32bits(42.5))
+	tests := []struct {
+		id       string
+		extended bool
+		data     []byte
+		want     string
+	}{
+		{"100", false, []byte{0x1F, 0x40, 0xF6, 0xFF, 0x0F, 0x03, 0, 0}, "RPM=2000 rpm, Coolant=-10 degC, Torque=-8 Nm, Gear=D"},
+		{"100", false, []byte{0x00, 0x64, 0x7F, 0x07, 0xF0, 0x01, 0, 0}, "RPM=25 rpm, Coolant=127 degC, Torque=63.5 Nm, Gear=R"},
+		{"100", false, []byte{0x1F, 0x40, 0xF6}, "RPM=2000 rpm, Coolant=-10 degC"},
+		{"200", false, level, "Level=42.5 %"},
+		{"18DAF110", true, []byte{0x01, 0x32, 0x0A, 0x00}, "Mode=1, Speed=50 km/h"},
+		{"18DAF110", true, []byte{0x02, 0xE8, 0x30, 0x00}, "Mode=2, Volts=12.52 V"},
+		{"18DAF110", true, []byte{0x03, 0xE8, 0x30}, "Mode=3"},
+	}
+	for _, tt := range tests {
+		pkt := packet(tt.id, tt.extended, tt.data)
+		if !db.DescribePacket(&pkt) || pkt.Signals != tt.want {
+			t.Errorf("%s % X: got %q, want %q", tt.id, tt.data, pkt.Signals, tt.want)
+		}
+	}
+	unknown := packet("7E8", false, []byte{1})
+	if db.DescribePacket(&unknown) {
+		t.Error("Unknown ArbID described")
+	}
+}
+
+func TestRawValue(t *testing.T) {
+	tests := []struct {
+		sig  Signal
+		data []byte
+		want uint64
+		fits int
+	}{
+		{Signal{StartBit: 0, Length: 8, LittleEndian: true}, []byte{0xAB}, 0xAB, 1},
+		{Signal{StartBit: 4, Length: 8, LittleEndian: true}, []byte{0xAB, 0xCD}, 0xDA, 2},
+		{Signal{StartBit: 7, Length: 16}, []byte{0x12, 0x34}, 0x1234, 2},
+		{Signal{StartBit: 3, Length: 8}, []byte{0x0A, 0xB0}, 0xAB, 2},
+		{Signal{StartBit: 7, Length: 64}, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0x0102030405060708, 8},
+		{Signal{StartBit: 0, Length: 64, LittleEndian: true}, []byte{8, 7, 6, 5, 4, 3, 2, 1}, 0x0102030405060708, 8},
+	}
+	for _, tt := range tests {
+		if got := tt.sig.RawValue(tt.data); got != tt.want {
+			t.Errorf("%d|%d@%v: got %X, want %X", tt.sig.StartBit, tt.sig.Length, tt.sig.LittleEndian, got, tt.want)
+		}
+		if !tt.sig.Fits(tt.fits) || tt.sig.Fits(tt.fits-1) {
+			t.Errorf("%d|%d@%v: should need %d bytes", tt.sig.StartBit, tt.sig.Length, tt.sig.LittleEndian, tt.fits)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	db := loadFixture(t)
+	again, err := Parse(db.DBC())
+	if err != nil {
+		t.Fatalf("%v\n%s", err, db.DBC())
+	}
+	if !reflect.DeepEqual(again, db) {
+		t.Errorf("got %+v, want %+v\n%s", again, db, db.DBC())
+	}
+	for key, msg := range db.Messages {
+		for i, sig := range msg.Signals {
+			if !reflect.DeepEqual(again.Messages[key].Signals[i], sig) {
+				t.Errorf("%s.%s: got %+v, want %+v", msg.Name, sig.Name, again.Messages[key].Signals[i], sig)
+			}
+		}
+	}
+}
+
+func TestSetValueRange(t *testing.T) {
+	tests := []struct {
+		lower int64
+		upper int64
+		want  int
+	}{
+		{3, 3, 1},
+		{0, MAX_VALUE_RANGE, MAX_VALUE_RANGE + 1},
+		{-1, MAX_VALUE_RANGE, 0},
+		{5, 4, 0},
+		{math.MaxInt64 - 1, math.MaxInt64, 2},
+		{math.MinInt64, math.MaxInt64, 0},
+	}
+	for _, tt := range tests {
+		sig := Signal{}
+		sig.setValueRange(tt.lower, tt.upper, "x")
+		if len(sig.Values) != tt.want {
+			t.Errorf("%d-%d: got %d values, want %d", tt.lower, tt.upper, len(sig.Values), tt.want)
+		}
+	}
+}
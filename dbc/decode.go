@@ -0,0 +1,148 @@
+package dbc
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+// SignalValue is a decoded signal
+type SignalValue struct {
+	Name  string
+	Raw   int64
+	Value float64
+	Units string
+	Text  string // Value table description of Raw
+}
+
+func (v SignalValue) String() string {
+	if v.Text != "" {
+		return v.Name + "=" + v.Text
+	}
+	value := strconv.FormatFloat(v.Value, 'f', -1, 64)
+	if v.Units == "" {
+		return v.Name + "=" + value
+	}
+	return v.Name + "=" + value + " " + v.Units
+}
+
+// bit returns bit n of data counting from the LSB of the first byte
+func bit(data []byte, n int) uint64 {
+	if n < 0 || n/8 >= len(data) {
+		return 0
+	}
+	return uint64(data[n/8]>>(uint(n)%8)) & 1
+}
+
+// Fits reports whether every bit of the signal is inside length bytes
+func (s *Signal) Fits(length int) bool {
+	if s.LittleEndian {
+		return s.StartBit+s.Length <= length*8
+	}
+	pos := s.StartBit
+	for i := 1; i < s.Length; i++ {
+		if pos%8 == 0 {
+			pos += 15
+		} else {
+			pos -= 1
+		}
+	}
+	return pos/8 < length
+}
+
+// RawValue extracts the unscaled bits of the signal.  Big endian signals
+// start at their MSB and walk the DBC sawtooth bit numbering
+func (s *Signal) RawValue(data []byte) uint64 {
+	var raw uint64
+	if s.LittleEndian {
+		for i := 0; i < s.Length; i++ {
+			raw |= bit(data, s.StartBit+i) << uint(i)
+		}
+		return raw
+	}
+	pos := s.StartBit
+	for i := 0; i < s.Length; i++ {
+		raw = raw<<1 | bit(data, pos)
+		if pos%8 == 0 {
+			pos += 15
+		} else {
+			pos -= 1
+		}
+	}
+	return raw
+}
+
+// Decode scales the signal's bits into a physical value
+func (s *Signal) Decode(data []byte) SignalValue {
+	raw := s.RawValue(data)
+	v := SignalValue{Name: s.Name, Units: s.Unit}
+	switch {
+	case s.Type == SIGNAL_FLOAT && s.Length == 32:
+		v.Raw = int64(raw)
+		v.Value = float64(math.Float32frombits(uint32(raw)))*s.Factor + s.Offset
+		return v
+	case s.Type == SIGNAL_DOUBLE && s.Length == 64:
+		v.Raw = int64(raw)
+		v.Value = math.Float64frombits(raw)*s.Factor + s.Offset
+		return v
+	case s.Signed && s.Length < 64 && raw&(1<<uint(s.Length-1)) != 0:
+		v.Raw = int64(raw) - int64(1)<<uint(s.Length)
+		v.Value = float64(v.Raw)*s.Factor + s.Offset
+	case s.Signed:
+		v.Raw = int64(raw)
+		v.Value = float64(v.Raw)*s.Factor + s.Offset
+	default:
+		v.Raw = int64(raw)
+		v.Value = float64(raw)*s.Factor + s.Offset
+	}
+	if text, ok := s.Values[v.Raw]; ok {
+		v.Text = text
+	}
+	return v
+}
+
+// Decode returns every signal present in a payload.  Multiplexed signals
+// are only decoded when the multiplexor selects them
+func (m *Message) Decode(data []byte) []SignalValue {
+	var values []SignalValue
+	mux := int64(-1)
+	for _, sig := range m.Signals {
+		if sig.Multiplexor && sig.Fits(len(data)) {
+			mux = sig.Decode(data).Raw
+		}
+	}
+	for _, sig := range m.Signals {
+		if !sig.Fits(len(data)) {
+			continue
+		}
+		if sig.Multiplexed && int64(sig.MuxValue) != mux {
+			continue
+		}
+		values = append(values, sig.Decode(data))
+	}
+	return values
+}
+
+// DescribePacket fills in Desc with the message name and Signals with the
+// decoded values.  Returns false when the database has no layout for it
+func (db *Database) DescribePacket(pkt *api.CanData) bool {
+	if db == nil {
+		return false
+	}
+	msg := db.Lookup(pkt.ArbID, pkt.Extended)
+	if msg == nil {
+		return false
+	}
+	values := msg.Decode(pkt.Data())
+	text := make([]string, len(values))
+	for i := range values {
+		text[i] = values[i].String()
+	}
+	if pkt.Desc == "" {
+		pkt.Desc = msg.Name
+	}
+	pkt.Signals = strings.Join(text, ", ")
+	return true
+}
@@ -0,0 +1,245 @@
+package dbc
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+// Kayak KCD network definition, only the parts a decoder needs
+type kcdNetwork struct {
+	Document kcdDocument `xml:"Document"`
+	Nodes    []kcdNode   `xml:"Node"`
+	Buses    []kcdBus    `xml:"Bus"`
+}
+
+type kcdDocument struct {
+	Name    string `xml:"name,attr"`
+	Version string `xml:"version,attr"`
+}
+
+type kcdNode struct {
+	ID   string `xml:"id,attr"`
+	Name string `xml:"name,attr"`
+}
+
+type kcdNodeRef struct {
+	ID string `xml:"id,attr"`
+}
+
+type kcdBus struct {
+	Name     string       `xml:"name,attr"`
+	Messages []kcdMessage `xml:"Message"`
+}
+
+type kcdMessage struct {
+	ID         string         `xml:"id,attr"`
+	Name       string         `xml:"name,attr"`
+	Length     string         `xml:"length,attr"`
+	Format     string         `xml:"format,attr"`
+	Notes      string         `xml:"Notes"`
+	Producers  []kcdNodeRef   `xml:"Producer>NodeRef"`
+	Multiplex  []kcdMultiplex `xml:"Multiplex"`
+	KcdSignals []kcdSignal    `xml:"Signal"`
+}
+
+type kcdSignal struct {
+	Name      string       `xml:"name,attr"`
+	Offset    int          `xml:"offset,attr"`
+	Length    string       `xml:"length,attr"`
+	Endianess string       `xml:"endianess,attr"`
+	Notes     string       `xml:"Notes"`
+	Consumers []kcdNodeRef `xml:"Consumer>NodeRef"`
+	Value     *kcdValue    `xml:"Value"`
+	Labels    []kcdLabel   `xml:"LabelSet>Label"`
+	Groups    []kcdLabel   `xml:"LabelSet>LabelGroup"`
+}
+
+type kcdMultiplex struct {
+	kcdSignal
+	MuxGroups []kcdMuxGroup `xml:"MuxGroup"`
+}
+
+type kcdMuxGroup struct {
+	Count      int         `xml:"count,attr"`
+	KcdSignals []kcdSignal `xml:"Signal"`
+}
+
+type kcdValue struct {
+	Type      string `xml:"type,attr"`
+	Slope     string `xml:"slope,attr"`
+	Intercept string `xml:"intercept,attr"`
+	Unit      string `xml:"unit,attr"`
+	Min       string `xml:"min,attr"`
+	Max       string `xml:"max,attr"`
+}
+
+type kcdLabel struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+	From  string `xml:"from,attr"`
+	To    string `xml:"to,attr"`
+}
+
+// lsbToMsb converts the LSB position of a big endian signal, as KCD and
+// ARXML give it, to the MSB start bit used by DBC
+func lsbToMsb(lsb int, length int) int {
+	pos := lsb
+	for i := 1; i < length; i++ {
+		if pos%8 == 7 {
+			pos -= 15
+		} else {
+			pos += 1
+		}
+	}
+	return pos
+}
+
+// kcdFloat parses an optional number attribute
+func kcdFloat(value string, def float64) (float64, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func (k *kcdSignal) signal(nodes map[string]string) (*Signal, error) {
+	sig := &Signal{Name: k.Name, StartBit: k.Offset, Length: 1, LittleEndian: k.Endianess != "big", Factor: 1, Comment: strings.TrimSpace(k.Notes)}
+	if k.Length != "" {
+		n, err := strconv.Atoi(k.Length)
+		if err != nil {
+			return nil, logger.Err("bad signal length for " + k.Name)
+		}
+		sig.Length = n
+	}
+	if sig.Length < 1 || sig.Length > 64 || k.Offset < 0 {
+		return nil, logger.Err("bad signal length for " + k.Name)
+	}
+	if !sig.LittleEndian {
+		sig.StartBit = lsbToMsb(k.Offset, sig.Length)
+	}
+	if k.Value != nil {
+		switch k.Value.Type {
+		case "signed":
+			sig.Signed = true
+		case "single":
+			sig.Type = SIGNAL_FLOAT
+		case "double":
+			sig.Type = SIGNAL_DOUBLE
+		}
+		var err error
+		for _, f := range []struct {
+			value string
+			def   float64
+			dst   *float64
+		}{{k.Value.Slope, 1, &sig.Factor}, {k.Value.Intercept, 0, &sig.Offset}, {k.Value.Min, 0, &sig.Min}, {k.Value.Max, 0, &sig.Max}} {
+			*f.dst, err = kcdFloat(f.value, f.def)
+			if err != nil {
+				return nil, logger.Err("bad number in signal " + k.Name)
+			}
+		}
+		if k.Value.Unit != "1" {
+			sig.Unit = k.Value.Unit
+		}
+	}
+	for _, label := range k.Labels {
+		n, err := strconv.ParseInt(label.Value, 0, 64)
+		if err != nil {
+			return nil, logger.Err("bad label value in signal " + k.Name)
+		}
+		if sig.Values == nil {
+			sig.Values = map[int64]string{}
+		}
+		sig.Values[n] = label.Name
+	}
+	for _, group := range k.Groups {
+		from, ferr := strconv.ParseInt(group.From, 0, 64)
+		to, terr := strconv.ParseInt(group.To, 0, 64)
+		if ferr == nil && terr == nil {
+			sig.setValueRange(from, to, group.Name)
+		}
+	}
+	for _, ref := range k.Consumers {
+		sig.Receivers = append(sig.Receivers, nodes[ref.ID])
+	}
+	return sig, nil
+}
+
+// ParseKCD reads a Kayak KCD network definition
+func ParseKCD(data []byte) (*Database, error) {
+	var network kcdNetwork
+	err := xml.Unmarshal(data, &network)
+	if err != nil {
+		return nil, logger.Err("Could not parse KCD: " + err.Error())
+	}
+	db := NewDatabase()
+	db.Version = network.Document.Version
+	nodes := map[string]string{}
+	for _, node := range network.Nodes {
+		nodes[node.ID] = node.Name
+		db.Nodes = append(db.Nodes, node.Name)
+	}
+	for _, bus := range network.Buses {
+		for _, m := range bus.Messages {
+			id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(m.ID), "0x"), 16, 32)
+			if err != nil {
+				return nil, logger.Err("KCD message " + m.Name + " has a bad id " + m.ID)
+			}
+			msg := &Message{ID: uint32(id), Extended: m.Format == "extended" || id > 0x7FF, Name: m.Name, Comment: strings.TrimSpace(m.Notes)}
+			if len(m.Producers) > 0 {
+				msg.Transmitter = nodes[m.Producers[0].ID]
+			}
+			for i := range m.Multiplex {
+				mux, err := m.Multiplex[i].signal(nodes)
+				if err != nil {
+					return nil, err
+				}
+				mux.Multiplexor = true
+				msg.Signals = append(msg.Signals, mux)
+				for _, group := range m.Multiplex[i].MuxGroups {
+					for j := range group.KcdSignals {
+						sig, err := group.KcdSignals[j].signal(nodes)
+						if err != nil {
+							return nil, err
+						}
+						sig.Multiplexed = true
+						sig.MuxValue = group.Count
+						msg.Signals = append(msg.Signals, sig)
+					}
+				}
+			}
+			for i := range m.KcdSignals {
+				sig, err := m.KcdSignals[i].signal(nodes)
+				if err != nil {
+					return nil, err
+				}
+				msg.Signals = append(msg.Signals, sig)
+			}
+			msg.DLC, err = strconv.Atoi(m.Length)
+			if err != nil {
+				msg.DLC = autoLength(msg.Signals) // "auto" or unset
+			}
+			db.Messages[Key(msg.ID, msg.Extended)] = msg
+		}
+	}
+	return db, nil
+}
+
+// autoLength is the fewest bytes holding every signal
+func autoLength(signals []*Signal) int {
+	for length := 0; length < 8; length++ {
+		fits := true
+		for _, sig := range signals {
+			if !sig.Fits(length) {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return length
+		}
+	}
+	return 8
+}
@@ -0,0 +1,303 @@
+package dbc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+const DBC_NO_NODE = "Vector__XXX" // Sender or receiver placeholder
+
+var nameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidName reports whether a name can be used as a DBC identifier
+func ValidName(name string) bool {
+	return nameRegexp.MatchString(name)
+}
+
+// Validate checks a signal can be written to a DBC and fits in dlc bytes
+func (s *Signal) Validate(dlc int) error {
+	if !ValidName(s.Name) {
+		return logger.Err("Invalid signal name " + s.Name)
+	}
+	if s.Length < 1 || s.Length > 64 || s.StartBit < 0 {
+		return logger.Err("Invalid bit range for signal " + s.Name)
+	}
+	if s.Type == SIGNAL_FLOAT && s.Length != 32 || s.Type == SIGNAL_DOUBLE && s.Length != 64 {
+		return logger.Err("Floating point signal " + s.Name + " has the wrong length")
+	}
+	if !s.Fits(dlc) {
+		return logger.Err(fmt.Sprintf("Signal %s does not fit in %d bytes", s.Name, dlc))
+	}
+	for _, node := range s.Receivers {
+		if !ValidName(node) {
+			return logger.Err("Invalid receiver " + node)
+		}
+	}
+	return nil
+}
+
+// Validate checks a message and its signals can be written to a DBC
+func (m *Message) Validate() error {
+	if !ValidName(m.Name) {
+		return logger.Err("Invalid message name " + m.Name)
+	}
+	if m.DLC < 0 || m.DLC > 64 {
+		return logger.Err(fmt.Sprintf("Invalid DLC %d", m.DLC))
+	}
+	if m.Extended && m.ID > 0x1FFFFFFF || !m.Extended && m.ID > 0x7FF {
+		return logger.Err(fmt.Sprintf("Invalid ID %X", m.ID))
+	}
+	if m.Transmitter != "" && !ValidName(m.Transmitter) {
+		return logger.Err("Invalid transmitter " + m.Transmitter)
+	}
+	for _, sig := range m.Signals {
+		if err := sig.Validate(m.DLC); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy, so a database in use by the decoder can be
+// edited and swapped in
+func (db *Database) Clone() *Database {
+	clone := NewDatabase()
+	clone.Version = db.Version
+	clone.Comment = db.Comment
+	clone.Nodes = append([]string{}, db.Nodes...)
+	for name, table := range db.ValueTables {
+		clone.ValueTables[name] = copyValues(table)
+	}
+	for key, msg := range db.Messages {
+		m := *msg
+		m.Signals = nil
+		for _, sig := range msg.Signals {
+			s := *sig
+			s.Receivers = append([]string{}, sig.Receivers...)
+			s.Values = copyValues(sig.Values)
+			m.Signals = append(m.Signals, &s)
+		}
+		clone.Messages[key] = &m
+	}
+	return clone
+}
+
+func copyValues(values map[int64]string) map[int64]string {
+	if values == nil {
+		return nil
+	}
+	c := map[int64]string{}
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
+
+// SetMessage adds or replaces a message, keeping the signals of the one it
+// replaces when msg has none
+func (db *Database) SetMessage(msg *Message) error {
+	key := Key(msg.ID, msg.Extended)
+	if old, ok := db.Messages[key]; ok && len(msg.Signals) == 0 {
+		msg.Signals = old.Signals
+	}
+	err := msg.Validate()
+	if err != nil {
+		return err
+	}
+	db.Messages[key] = msg
+	return nil
+}
+
+// RemoveMessage deletes a message and its signals
+func (db *Database) RemoveMessage(id uint32, extended bool) error {
+	if _, ok := db.Messages[Key(id, extended)]; !ok {
+		return logger.Err(fmt.Sprintf("No message %X", id))
+	}
+	delete(db.Messages, Key(id, extended))
+	return nil
+}
+
+// SetSignal adds a signal or replaces the one with the same name
+func (m *Message) SetSignal(sig *Signal) error {
+	err := sig.Validate(m.DLC)
+	if err != nil {
+		return err
+	}
+	if sig.Multiplexed && m.multiplexor() == nil {
+		return logger.Err("Message " + m.Name + " has no multiplexor")
+	}
+	for i := range m.Signals {
+		if m.Signals[i].Name == sig.Name {
+			m.Signals[i] = sig
+			return nil
+		}
+	}
+	m.Signals = append(m.Signals, sig)
+	return nil
+}
+
+// RemoveSignal deletes a signal by name
+func (m *Message) RemoveSignal(name string) error {
+	for i := range m.Signals {
+		if m.Signals[i].Name == name {
+			m.Signals = append(m.Signals[:i], m.Signals[i+1:]...)
+			return nil
+		}
+	}
+	return logger.Err("No signal " + name + " in " + m.Name)
+}
+
+func (m *Message) multiplexor() *Signal {
+	for _, sig := range m.Signals {
+		if sig.Multiplexor {
+			return sig
+		}
+	}
+	return nil
+}
+
+func quote(text string) string {
+	return `"` + strings.Replace(text, `"`, `\"`, -1) + `"`
+}
+
+func number(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func node(name string) string {
+	if name == "" {
+		return DBC_NO_NODE
+	}
+	return name
+}
+
+// writeValues writes "n "desc" ..." pairs in value order
+func writeValues(buf *bytes.Buffer, values map[int64]string) {
+	var keys []int64
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		fmt.Fprintf(buf, " %d %s", k, quote(values[k]))
+	}
+	buf.WriteString(" ;\n")
+}
+
+// nodes lists every node named in the database, declared ones first
+func (db *Database) nodes() []string {
+	var nodes []string
+	seen := map[string]bool{DBC_NO_NODE: true, "": true}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			nodes = append(nodes, name)
+		}
+	}
+	for _, name := range db.Nodes {
+		add(name)
+	}
+	for _, msg := range db.SortedMessages() {
+		add(msg.Transmitter)
+		for _, sig := range msg.Signals {
+			for _, name := range sig.Receivers {
+				add(name)
+			}
+		}
+	}
+	return nodes
+}
+
+// DBC writes the database out as a Vector DBC file
+func (db *Database) DBC() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "VERSION %s\n\n\n", quote(db.Version))
+	buf.WriteString("NS_ :\n\tNS_DESC_\n\tCM_\n\tBA_DEF_\n\tBA_\n\tVAL_\n\tVAL_TABLE_\n\tSIG_VALTYPE_\n\n")
+	buf.WriteString("BS_:\n\n")
+	fmt.Fprintf(&buf, "BU_: %s\n\n", strings.Join(db.nodes(), " "))
+	var tables []string
+	for name := range db.ValueTables {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+	for _, name := range tables {
+		buf.WriteString("VAL_TABLE_ " + name)
+		writeValues(&buf, db.ValueTables[name])
+	}
+	msgs := db.SortedMessages()
+	for _, msg := range msgs {
+		fmt.Fprintf(&buf, "\nBO_ %d %s: %d %s\n", Key(msg.ID, msg.Extended), msg.Name, msg.DLC, node(msg.Transmitter))
+		for _, sig := range msg.Signals {
+			mux := ""
+			if sig.Multiplexed {
+				mux = fmt.Sprintf("m%d", sig.MuxValue)
+			}
+			if sig.Multiplexor {
+				mux += "M"
+			}
+			if mux != "" {
+				mux += " "
+			}
+			order, sign := 0, "+"
+			if sig.LittleEndian {
+				order = 1
+			}
+			if sig.Signed {
+				sign = "-"
+			}
+			receivers := DBC_NO_NODE
+			if len(sig.Receivers) > 0 {
+				receivers = strings.Join(sig.Receivers, ",")
+			}
+			fmt.Fprintf(&buf, " SG_ %s %s: %d|%d@%d%s (%s,%s) [%s|%s] %s %s\n", sig.Name, mux, sig.StartBit, sig.Length, order, sign,
+				number(sig.Factor), number(sig.Offset), number(sig.Min), number(sig.Max), quote(sig.Unit), receivers)
+		}
+	}
+	buf.WriteString("\n")
+	if db.Comment != "" {
+		fmt.Fprintf(&buf, "CM_ %s;\n", quote(db.Comment))
+	}
+	for _, msg := range msgs {
+		id := Key(msg.ID, msg.Extended)
+		if msg.Comment != "" {
+			fmt.Fprintf(&buf, "CM_ BO_ %d %s;\n", id, quote(msg.Comment))
+		}
+		for _, sig := range msg.Signals {
+			if sig.Comment != "" {
+				fmt.Fprintf(&buf, "CM_ SG_ %d %s %s;\n", id, sig.Name, quote(sig.Comment))
+			}
+		}
+	}
+	for _, msg := range msgs {
+		for _, sig := range msg.Signals {
+			if len(sig.Values) > 0 {
+				fmt.Fprintf(&buf, "VAL_ %d %s", Key(msg.ID, msg.Extended), sig.Name)
+				writeValues(&buf, sig.Values)
+			}
+		}
+	}
+	for _, msg := range msgs {
+		for _, sig := range msg.Signals {
+			if sig.Type != SIGNAL_INTEGER {
+				fmt.Fprintf(&buf, "SIG_VALTYPE_ %d %s : %d;\n", Key(msg.ID, msg.Extended), sig.Name, sig.Type)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// SaveFile writes the database to a DBC file
+func (db *Database) SaveFile(file string) error {
+	err := ioutil.WriteFile(file, db.DBC(), 0644)
+	if err != nil {
+		return logger.Err("Could not write DBC file " + file)
+	}
+	return nil
+}
@@ -2,9 +2,16 @@ package hacksession
 
 import (
 	"fmt"
+	"os"
 
+	"github.com/ghetzel/canibus/analysis"
 	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/core"
+	"github.com/ghetzel/canibus/dbc"
+	"github.com/ghetzel/canibus/isotp"
 	"github.com/ghetzel/canibus/logger"
+	"github.com/ghetzel/canibus/obd"
+	"github.com/ghetzel/canibus/uds"
 )
 
 const (
@@ -14,10 +21,18 @@ const (
 )
 
 type HackSession struct {
-	Users    []api.User
-	State    int
-	DeviceId int
-	Device   api.CanDevice
+	Users        []api.User
+	State        int
+	DeviceId     int
+	Device       api.CanDevice
+	Transactions isotp.Monitor
+	UDS          *uds.Client
+	Scanner      *uds.Scanner
+	Enumerator   *uds.Enumerator
+	SignalDB     *dbc.Database
+	VIN          string // Vehicle SignalDB is being built for
+	Stats        analysis.Stats
+	AutoFill     bool // Set counters and checksums in injected packets
 }
 
 func (s *HackSession) GetState() string {
@@ -88,10 +103,136 @@ func (s *HackSession) GetPackets(user api.User) []api.CanData {
 	}
 	pkts, idx = s.Device.GetPacketsFrom(user.LastIdx())
 	// TODO: Apply filters
+	db := s.GetSignalDB()
+	for i := range pkts {
+		db.DescribePacket(&pkts[i])
+		obd.DescribePacket(&pkts[i])
+	}
 	user.SetLastIdx(idx)
 	return pkts
 }
 
+// Close stops everything following the device in the background.  Call it
+// when the last user leaves and the session is dropped
+func (s *HackSession) Close() {
+	s.Transactions.Stop()
+	s.Stats.Stop()
+}
+
+// GetSignalDB returns the signal database attached to the session, or
+// else the one configured for the device
+func (s *HackSession) GetSignalDB() *dbc.Database {
+	if s.SignalDB != nil {
+		return s.SignalDB
+	}
+	return core.GetSignalDB(s.DeviceId)
+}
+
+// VehicleDB returns the signal database being built for a vehicle.  It is
+// loaded from the vehicle's file, or else started from the database in use
+func (s *HackSession) VehicleDB(vin string) (*dbc.Database, error) {
+	if s.VIN == vin && s.SignalDB != nil {
+		return s.SignalDB, nil
+	}
+	file, err := core.VehicleDBFile(vin)
+	if err != nil {
+		return nil, err
+	}
+	var db *dbc.Database
+	if _, err := os.Stat(file); err == nil {
+		db, err = dbc.LoadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	} else if current := s.GetSignalDB(); current != nil {
+		db = current.Clone()
+	} else {
+		db = dbc.NewDatabase()
+	}
+	if db.Comment == "" {
+		db.Comment = fmt.Sprintf("VIN %s, %s %s %s", vin, obd.GetYearFromVIN(vin), obd.GetMakeFromVIN(vin), obd.GetModelFromVIN(vin).Model)
+	}
+	s.VIN = vin
+	s.SignalDB = db
+	return db, nil
+}
+
+// SaveVehicleDB writes a vehicle's database to its file and decodes with it
+// from then on.  Edits are made to a Clone and saved here, so the sniff view
+// never sees a half made change
+func (s *HackSession) SaveVehicleDB(db *dbc.Database) error {
+	if s.VIN == "" {
+		return logger.Err("No vehicle selected")
+	}
+	file, err := core.VehicleDBFile(s.VIN)
+	if err != nil {
+		return err
+	}
+	err = db.SaveFile(file)
+	if err != nil {
+		return err
+	}
+	s.SignalDB = db
+	return nil
+}
+
+// GetTransactionsFrom returns the ISO-TP requests and responses seen since
+// idx and the index to ask for next time.  The device is followed in the
+// background from the first call on
+func (s *HackSession) GetTransactionsFrom(idx int) ([]isotp.Transaction, int) {
+	if s.Device != nil {
+		s.Transactions.Start(s.Device)
+	}
+	return s.Transactions.GetTransactionsFrom(idx)
+}
+
+// GetStats returns the per ArbID statistics, following the device from the
+// first call on.  AutoFill needs them to find counters and checksums
+func (s *HackSession) GetStats() *analysis.Stats {
+	if s.Device != nil {
+		s.Stats.Start(s.Device)
+	}
+	return &s.Stats
+}
+
+// UDSClient returns the session's UDS client, opening a new one when the
+// request or response ID changes
+func (s *HackSession) UDSClient(txId string, rxId string) (*uds.Client, error) {
+	if s.Device == nil {
+		return nil, logger.Err("Device not set")
+	}
+	if s.UDS != nil && s.UDS.Conn.TxID == txId && s.UDS.Conn.RxID == rxId {
+		return s.UDS, nil
+	}
+	client, err := uds.NewClient(s.Device, txId, rxId)
+	if err != nil {
+		return nil, err
+	}
+	if s.UDS != nil {
+		s.UDS.StopKeepAlive()
+	}
+	s.UDS = client
+	return client, nil
+}
+
+// GetScanner returns the session's ECU scanner, which keeps the results of
+// the last scan
+func (s *HackSession) GetScanner() *uds.Scanner {
+	if s.Scanner == nil && s.Device != nil {
+		s.Scanner = uds.NewScanner(s.Device)
+	}
+	return s.Scanner
+}
+
+// GetEnumerator returns the session's UDS enumerator, which keeps the
+// reports of the last run
+func (s *HackSession) GetEnumerator() *uds.Enumerator {
+	if s.Enumerator == nil && s.Device != nil {
+		s.Enumerator = uds.NewEnumerator(s.Device)
+	}
+	return s.Enumerator
+}
+
 func (s *HackSession) InjectPacket(user api.User, TxPkt api.TransmitPacket) error {
 	if s.Device == nil {
 		return logger.Err("Device not set")
@@ -100,6 +241,7 @@ func (s *HackSession) InjectPacket(user api.User, TxPkt api.TransmitPacket) erro
 	pkt := api.CanData{}
 	pkt.Src = user.GetName()
 	pkt.ArbID = TxPkt.ArbId
+	pkt.Extended = TxPkt.Extended
 	pkt.Network = TxPkt.Network
 	pkt.B1, err = api.Atoui8(TxPkt.B1)
 	if err != nil {
@@ -133,6 +275,29 @@ func (s *HackSession) InjectPacket(user api.User, TxPkt api.TransmitPacket) erro
 	if err != nil {
 		return err
 	}
+	if TxPkt.DLC != "" {
+		dlc, err := api.Atoui8(TxPkt.DLC)
+		if err != nil || dlc > 8 {
+			return logger.Err("Invalid DLC: " + TxPkt.DLC)
+		}
+		pkt.SetDLC(int(dlc))
+	}
+	if s.AutoFill {
+		s.fill(&pkt)
+	}
 	err = s.Device.InjectPacket(pkt)
 	return err
 }
+
+// fill sets the counter and checksum sniffed on the packet's ArbID, so the
+// receiving ECU does not drop it
+func (s *HackSession) fill(pkt *api.CanData) {
+	id, err := api.Hextoui32(pkt.ArbID)
+	if err != nil {
+		return
+	}
+	data := pkt.Data()
+	if s.GetStats().Fill(api.FormatArbId(id, pkt.Extended || id > 0x7FF), data) {
+		pkt.SetData(data)
+	}
+}
@@ -0,0 +1,197 @@
+package isotp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	ISOTP_SRC     = "ISO-TP"
+	ISOTP_TIMEOUT = 1 * time.Second // Default N_Bs/N_Cr and response wait
+	ISOTP_POLL    = 5 * time.Millisecond
+)
+
+// Config holds the transport parameters of a Conn.  BlockSize and STmin
+// are what we ask the other side for in our flow control frames
+type Config struct {
+	BlockSize       uint8 // 0 means send everything without waiting
+	STmin           uint8
+	Padding         int           // Byte frames are padded to 8 bytes with, or NO_PADDING
+	Timeout         time.Duration // Wait for flow control or the next consecutive frame
+	ResponseTimeout time.Duration // Wait for the first frame of an answer
+}
+
+// DefaultConfig pads with 00 and asks for frames as fast as possible
+var DefaultConfig = Config{
+	Padding:         0x00,
+	Timeout:         ISOTP_TIMEOUT,
+	ResponseTimeout: ISOTP_TIMEOUT,
+}
+
+// Conn is a point to point ISO-TP link over any CanDevice.  Frames are
+// sent with InjectPacket and read back from the device's packet buffer,
+// so the device must be sniffing
+type Conn struct {
+	Device  api.CanDevice
+	TxID    string
+	RxID    string
+	Config  Config
+	txId    uint32
+	rxId    uint32
+	txExt   bool
+	idx     int
+	pending []api.CanData
+}
+
+// NewConn creates a link sending on txId and listening on rxId, for
+// example 7E0 and 7E8 for the engine ECU
+func NewConn(dev api.CanDevice, txId string, rxId string) (*Conn, error) {
+	var err error
+	c := &Conn{Device: dev, TxID: txId, RxID: rxId, Config: DefaultConfig}
+	c.txId, err = api.Hextoui32(txId)
+	if err != nil {
+		return nil, logger.Err("Bad ISO-TP transmit ID " + txId)
+	}
+	c.rxId, err = api.Hextoui32(rxId)
+	if err != nil {
+		return nil, logger.Err("Bad ISO-TP receive ID " + rxId)
+	}
+	c.txExt = len(strings.TrimPrefix(txId, "0x")) > 3 || c.txId > 0x7FF
+	c.idx = dev.GetPacketIdx()
+	return c, nil
+}
+
+func (c *Conn) sendFrame(frame []byte) error {
+	pkt := api.CanData{ArbID: api.FormatArbId(c.txId, c.txExt), Extended: c.txExt, Src: ISOTP_SRC}
+	pkt.SetData(frame)
+	return c.Device.InjectPacket(pkt)
+}
+
+// nextFrame waits for the next frame on RxID
+func (c *Conn) nextFrame(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for len(c.pending) > 0 {
+			pkt := c.pending[0]
+			c.pending = c.pending[1:]
+			id, err := api.Hextoui32(pkt.ArbID)
+			if err == nil && id == c.rxId {
+				return pkt.Data(), nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, logger.Err("Timed out waiting for ISO-TP frame from " + c.RxID)
+		}
+		c.pending, c.idx = c.Device.GetPacketsFrom(c.idx)
+		if len(c.pending) == 0 {
+			time.Sleep(ISOTP_POLL)
+		}
+	}
+}
+
+// Send transmits a message, waiting for flow control after a first frame
+func (c *Conn) Send(payload []byte) error {
+	frames, err := Segment(payload, c.Config.Padding)
+	if err != nil {
+		return err
+	}
+	c.idx = c.Device.GetPacketIdx()
+	c.pending = nil
+	err = c.sendFrame(frames[0])
+	if err != nil {
+		return err
+	}
+	frames = frames[1:]
+	waits := 0
+	for len(frames) > 0 {
+		fc, err := c.nextFrame(c.Config.Timeout)
+		if err != nil {
+			return err
+		}
+		if FrameType(fc) != FLOW_CONTROL {
+			continue
+		}
+		switch fc[0] & 0x0F {
+		case FC_WAIT:
+			waits += 1
+			if waits > MAX_WAIT_FRAMES {
+				return logger.Err("Too many ISO-TP flow control waits")
+			}
+			continue
+		case FC_OVERFLOW:
+			return logger.Err("ISO-TP receiver overflow")
+		case FC_CONTINUE:
+		default:
+			return logger.Err(fmt.Sprintf("Bad ISO-TP flow control status %X", fc[0]&0x0F))
+		}
+		blockSize := 0
+		stMin := time.Duration(0)
+		if len(fc) > 1 {
+			blockSize = int(fc[1])
+		}
+		if len(fc) > 2 {
+			stMin = SeparationTime(fc[2])
+		}
+		for sent := 0; len(frames) > 0 && (blockSize == 0 || sent < blockSize); sent++ {
+			if stMin > 0 {
+				time.Sleep(stMin)
+			}
+			err = c.sendFrame(frames[0])
+			if err != nil {
+				return err
+			}
+			frames = frames[1:]
+		}
+	}
+	return nil
+}
+
+// Recv waits for a message, sending flow control after the first frame
+// and after every BlockSize consecutive frames
+func (c *Conn) Recv() ([]byte, error) {
+	r := Reassembler{}
+	timeout := c.Config.ResponseTimeout
+	block := 0
+	for {
+		frame, err := c.nextFrame(timeout)
+		if err != nil {
+			return nil, err
+		}
+		done, needFC, err := r.Add(frame)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return r.Data, nil
+		}
+		if needFC {
+			timeout = c.Config.Timeout
+			block = 0
+		} else if FrameType(frame) == CONSECUTIVE_FRAME && c.Config.BlockSize > 0 {
+			block += 1
+			needFC = block == int(c.Config.BlockSize)
+			if needFC {
+				block = 0
+			}
+		}
+		if needFC {
+			err = c.sendFrame(FlowControlFrame(FC_CONTINUE, c.Config.BlockSize, c.Config.STmin, c.Config.Padding))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Request sends a message and waits for the answer
+func (c *Conn) Request(payload []byte) ([]byte, error) {
+	err := c.Send(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.Recv()
+}
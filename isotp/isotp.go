@@ -0,0 +1,148 @@
+// Package isotp implements the ISO 15765-2 transport used by OBD-II, UDS
+// and KWP2000 on CAN to carry messages longer than one frame
+package isotp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+// Frame types, the high nibble of the first byte
+const (
+	SINGLE_FRAME      = 0x0
+	FIRST_FRAME       = 0x1
+	CONSECUTIVE_FRAME = 0x2
+	FLOW_CONTROL      = 0x3
+)
+
+// Flow control status
+const (
+	FC_CONTINUE = 0x0
+	FC_WAIT     = 0x1
+	FC_OVERFLOW = 0x2
+)
+
+const (
+	MAX_LEN         = 4095
+	NO_PADDING      = -1
+	MAX_WAIT_FRAMES = 10 // Flow control WAITs accepted before giving up
+)
+
+// FrameType returns the type of a frame
+func FrameType(frame []byte) int {
+	if len(frame) == 0 {
+		return -1
+	}
+	return int(frame[0] >> 4)
+}
+
+// pad fills a frame up to 8 bytes unless padding is NO_PADDING
+func pad(frame []byte, padding int) []byte {
+	if padding == NO_PADDING {
+		return frame
+	}
+	for len(frame) < 8 {
+		frame = append(frame, uint8(padding))
+	}
+	return frame
+}
+
+// Segment splits a payload into a single frame, or a first frame followed by
+// consecutive frames.  The sender must wait for flow control after the first
+func Segment(payload []byte, padding int) ([][]byte, error) {
+	if len(payload) == 0 || len(payload) > MAX_LEN {
+		return nil, logger.Err(fmt.Sprintf("ISO-TP payload length %d out of range", len(payload)))
+	}
+	if len(payload) <= 7 {
+		frame := append([]byte{uint8(len(payload))}, payload...)
+		return [][]byte{pad(frame, padding)}, nil
+	}
+	frames := [][]byte{append([]byte{FIRST_FRAME<<4 | uint8(len(payload)>>8), uint8(len(payload))}, payload[:6]...)}
+	sn := uint8(1)
+	for pos := 6; pos < len(payload); pos += 7 {
+		end := pos + 7
+		if end > len(payload) {
+			end = len(payload)
+		}
+		frame := append([]byte{CONSECUTIVE_FRAME<<4 | sn}, payload[pos:end]...)
+		frames = append(frames, pad(frame, padding))
+		sn = (sn + 1) & 0x0F
+	}
+	return frames, nil
+}
+
+// FlowControlFrame builds a flow control frame
+func FlowControlFrame(status uint8, blockSize uint8, stMin uint8, padding int) []byte {
+	return pad([]byte{FLOW_CONTROL<<4 | status, blockSize, stMin}, padding)
+}
+
+// SeparationTime decodes an STmin byte.  Reserved values mean the maximum
+func SeparationTime(st uint8) time.Duration {
+	if st <= 0x7F {
+		return time.Duration(st) * time.Millisecond
+	}
+	if st >= 0xF1 && st <= 0xF9 {
+		return time.Duration(st-0xF0) * 100 * time.Microsecond
+	}
+	return 127 * time.Millisecond
+}
+
+// Reassembler rebuilds one message from the frames of a single sender
+type Reassembler struct {
+	Data     []byte
+	expected int
+	sn       uint8
+	done     bool
+}
+
+// Add feeds a frame in.  done is true once the message is complete,
+// needFlowControl is true after a first frame.  A new single or first frame
+// restarts the message, as the standard says a receiver must
+func (r *Reassembler) Add(frame []byte) (done bool, needFlowControl bool, err error) {
+	switch FrameType(frame) {
+	case SINGLE_FRAME:
+		length := int(frame[0] & 0x0F)
+		if length == 0 || length >= len(frame) {
+			return false, false, logger.Err("Bad ISO-TP single frame length")
+		}
+		r.Data = append([]byte{}, frame[1:1+length]...)
+		r.expected = length
+		r.done = true
+		return true, false, nil
+	case FIRST_FRAME:
+		if len(frame) < 8 {
+			return false, false, logger.Err("Short ISO-TP first frame")
+		}
+		r.expected = int(frame[0]&0x0F)<<8 | int(frame[1])
+		if r.expected < 8 {
+			return false, false, logger.Err("Bad ISO-TP first frame length")
+		}
+		r.Data = append([]byte{}, frame[2:]...)
+		r.sn = 1
+		r.done = false
+		return false, true, nil
+	case CONSECUTIVE_FRAME:
+		if r.expected == 0 || r.done {
+			return r.done, false, nil // Not ours or already finished
+		}
+		if frame[0]&0x0F != r.sn {
+			r.expected = 0
+			return false, false, logger.Err(fmt.Sprintf("ISO-TP sequence error, expected %d got %d", r.sn, frame[0]&0x0F))
+		}
+		r.sn = (r.sn + 1) & 0x0F
+		r.Data = append(r.Data, frame[1:]...)
+		if len(r.Data) >= r.expected {
+			r.Data = r.Data[:r.expected]
+			r.done = true
+		}
+		return r.done, false, nil
+	}
+	return r.done, false, nil
+}
+
+// Done reports whether a whole message has been received
+func (r *Reassembler) Done() bool {
+	return r.done
+}
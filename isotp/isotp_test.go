@@ -0,0 +1,254 @@
+package isotp_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/candevice"
+	"github.com/ghetzel/canibus/isotp"
+)
+
+func payload(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	return data
+}
+
+func TestSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		padding int
+		want    [][]byte
+	}{
+		{"single", []byte{0x3E, 0x00}, 0x00, [][]byte{{0x02, 0x3E, 0x00, 0, 0, 0, 0, 0}}},
+		{"single unpadded", []byte{0x3E, 0x00}, isotp.NO_PADDING, [][]byte{{0x02, 0x3E, 0x00}}},
+		{"single full", payload(7), 0xAA, [][]byte{{0x07, 0, 1, 2, 3, 4, 5, 6}}},
+		{"multi", payload(8), 0xAA, [][]byte{
+			{0x10, 0x08, 0, 1, 2, 3, 4, 5},
+			{0x21, 6, 7, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+		}},
+		{"multi unpadded", payload(14), isotp.NO_PADDING, [][]byte{
+			{0x10, 0x0E, 0, 1, 2, 3, 4, 5},
+			{0x21, 6, 7, 8, 9, 10, 11, 12},
+			{0x22, 13},
+		}},
+	}
+	for _, tt := range tests {
+		frames, err := isotp.Segment(tt.payload, tt.padding)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(frames) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got % X, want % X", tt.name, frames, tt.want)
+		}
+	}
+}
+
+func TestSegmentSequenceWraps(t *testing.T) {
+	frames, err := isotp.Segment(payload(6+7*17), isotp.NO_PADDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 18 {
+		t.Fatalf("got %d frames, want 18", len(frames))
+	}
+	for i, frame := range frames[1:] {
+		if want := uint8(0x20 | (i+1)&0x0F); frame[0] != want {
+			t.Errorf("frame %d: PCI %02X, want %02X", i+1, frame[0], want)
+		}
+	}
+}
+
+func TestSegmentLength(t *testing.T) {
+	for _, n := range []int{0, isotp.MAX_LEN + 1} {
+		if _, err := isotp.Segment(payload(n), 0); err == nil {
+			t.Errorf("length %d: no error", n)
+		}
+	}
+	frames, err := isotp.Segment(payload(isotp.MAX_LEN), 0)
+	if err != nil || frames[0][0] != 0x1F || frames[0][1] != 0xFF {
+		t.Errorf("length %d: % X, %v", isotp.MAX_LEN, frames[0], err)
+	}
+}
+
+func TestSeparationTime(t *testing.T) {
+	tests := []struct {
+		st   uint8
+		want time.Duration
+	}{
+		{0x00, 0},
+		{0x0A, 10 * time.Millisecond},
+		{0x7F, 127 * time.Millisecond},
+		{0x80, 127 * time.Millisecond},
+		{0xF0, 127 * time.Millisecond},
+		{0xF1, 100 * time.Microsecond},
+		{0xF9, 900 * time.Microsecond},
+		{0xFA, 127 * time.Millisecond},
+		{0xFF, 127 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := isotp.SeparationTime(tt.st); got != tt.want {
+			t.Errorf("STmin %02X: got %v, want %v", tt.st, got, tt.want)
+		}
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []byte
+		err    bool
+	}{
+		{"single", [][]byte{{0x02, 0x7E, 0x00, 0, 0, 0, 0, 0}}, []byte{0x7E, 0x00}, false},
+		{"single unpadded", [][]byte{{0x01, 0x7E}}, []byte{0x7E}, false},
+		{"single zero length", [][]byte{{0x00, 0, 0, 0, 0, 0, 0, 0}}, nil, true},
+		{"single too long", [][]byte{{0x05, 1, 2, 3}}, nil, true},
+		{"multi", [][]byte{
+			{0x10, 0x0A, 0, 1, 2, 3, 4, 5},
+			{0x21, 6, 7, 8, 9, 0xAA, 0xAA, 0xAA},
+		}, payload(10), false},
+		{"first frame short", [][]byte{{0x10, 0x0A, 0, 1, 2}}, nil, true},
+		{"first frame length under 8", [][]byte{{0x10, 0x07, 0, 1, 2, 3, 4, 5}}, nil, true},
+		{"sequence error", [][]byte{
+			{0x10, 0x10, 0, 1, 2, 3, 4, 5},
+			{0x22, 6, 7, 8, 9, 10, 11, 12},
+		}, nil, true},
+		{"restart on first frame", [][]byte{
+			{0x10, 0x14, 9, 9, 9, 9, 9, 9},
+			{0x10, 0x08, 0, 1, 2, 3, 4, 5},
+			{0x21, 6, 7, 0, 0, 0, 0, 0},
+		}, payload(8), false},
+	}
+	for _, tt := range tests {
+		r := isotp.Reassembler{}
+		var err error
+		for _, frame := range tt.frames {
+			_, _, err = r.Add(frame)
+			if err != nil {
+				break
+			}
+		}
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil || !r.Done() || !bytes.Equal(r.Data, tt.want) {
+			t.Errorf("%s: got % X done %v err %v, want % X", tt.name, r.Data, r.Done(), err, tt.want)
+		}
+	}
+}
+
+func TestReassemblerSequenceWraps(t *testing.T) {
+	want := payload(6 + 7*17)
+	frames, _ := isotp.Segment(want, 0)
+	r := isotp.Reassembler{}
+	for i, frame := range frames {
+		done, needFC, err := r.Add(frame)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if needFC != (i == 0) || done != (i == len(frames)-1) {
+			t.Fatalf("frame %d: done %v needFC %v", i, done, needFC)
+		}
+	}
+	if !bytes.Equal(r.Data, want) {
+		t.Errorf("got % X, want % X", r.Data, want)
+	}
+}
+
+// busNode joins a sniffing virtual bus node to bus
+func busNode(t *testing.T, bus string) *candevice.VirtualBus {
+	dev := &candevice.VirtualBus{}
+	dev.SetBus(bus)
+	if !dev.Init() {
+		t.Fatal("Could not start virtual bus node")
+	}
+	dev.StartSniffing()
+	return dev
+}
+
+func TestConn(t *testing.T) {
+	tests := []struct {
+		name      string
+		length    int
+		blockSize uint8
+		stMin     uint8
+	}{
+		{"single", 5, 0, 0},
+		{"multi", 20, 0, 0},
+		{"blocks", 60, 2, 0},
+		{"separation", 30, 0, 0xF1},
+	}
+	for _, tt := range tests {
+		bus := "isotp-test-" + tt.name
+		tester, err := isotp.NewConn(busNode(t, bus), "7E0", "7E8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ecu, err := isotp.NewConn(busNode(t, bus), "7E8", "7E0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ecu.Config.BlockSize = tt.blockSize
+		ecu.Config.STmin = tt.stMin
+		want := payload(tt.length)
+		got := make(chan []byte, 1)
+		go func() {
+			data, err := ecu.Recv()
+			if err != nil {
+				t.Errorf("%s: Recv: %v", tt.name, err)
+			}
+			got <- data
+		}()
+		if err := tester.Send(want); err != nil {
+			t.Errorf("%s: Send: %v", tt.name, err)
+		}
+		if data := <-got; !bytes.Equal(data, want) {
+			t.Errorf("%s: got % X, want % X", tt.name, data, want)
+		}
+	}
+}
+
+func TestConnFlowControlWait(t *testing.T) {
+	bus := "isotp-test-wait"
+	tester, err := isotp.NewConn(busNode(t, bus), "7E0", "7E8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecu := busNode(t, bus)
+	idx := ecu.GetPacketIdx()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- tester.Send(payload(20))
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		var pkts []api.CanData
+		pkts, idx = ecu.GetPacketsFrom(idx)
+		if len(pkts) > 0 && isotp.FrameType(pkts[0].Data()) == isotp.FIRST_FRAME {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No first frame sent")
+		}
+		time.Sleep(isotp.ISOTP_POLL)
+	}
+	for i := 0; i <= isotp.MAX_WAIT_FRAMES; i++ {
+		fc := api.CanData{ArbID: "7E8"}
+		fc.SetData(isotp.FlowControlFrame(isotp.FC_WAIT, 0, 0, 0))
+		ecu.InjectPacket(fc)
+	}
+	if err := <-sent; err == nil {
+		t.Error("Send kept waiting after too many flow control WAITs")
+	}
+}
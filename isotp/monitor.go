@@ -0,0 +1,311 @@
+package isotp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	MAX_TRANSACTIONS    = 1000
+	TRANSACTION_TIMEOUT = 2 * time.Second       // Unanswered requests are reported after this
+	MONITOR_POLL        = 10 * time.Millisecond // How often Start reads the packet buffer
+)
+
+// Message is one ISO-TP message rebuilt from sniffed frames
+type Message struct {
+	ArbID    string
+	Data     []byte
+	Hex      string
+	Frames   int
+	FirstSeq int // SeqNo of the first and last frame in the packet buffer
+	LastSeq  int
+	Time     string // AbsTime of the first frame
+}
+
+// Transaction is a request and the answer to it.  Response is nil when
+// nothing answered in time
+type Transaction struct {
+	Request  *Message
+	Response *Message
+}
+
+type pendingRequest struct {
+	msg      Message
+	answered bool
+	seen     time.Time
+}
+
+// Monitor passively reassembles the ISO-TP traffic on diagnostic IDs and
+// pairs requests with responses
+type Monitor struct {
+	Transactions [MAX_TRANSACTIONS]Transaction
+	txIdx        int
+	pktIdx       int
+	following    bool
+	streams      map[string]*Reassembler
+	messages     map[string]*Message
+	pending      []*pendingRequest
+	requestIds   map[string]bool
+	stop         chan bool
+	lock         sync.Mutex
+}
+
+// DiagnosticId reports whether an ID is one diagnostics normally use,
+// 700-7FF for standard IDs and 18DAxxxx/18DBxxxx for extended ones
+func DiagnosticId(arbId string) bool {
+	id, err := api.Hextoui32(arbId)
+	if err != nil {
+		return false
+	}
+	return (id >= 0x700 && id <= 0x7FF) || id&0xFFFF0000 == 0x18DA0000 || id&0xFFFF0000 == 0x18DB0000
+}
+
+// Functional reports whether an ID addresses every ECU at once
+func Functional(arbId string) bool {
+	id, err := api.Hextoui32(arbId)
+	if err != nil {
+		return false
+	}
+	return id == 0x7DF || id&0xFFFF0000 == 0x18DB0000
+}
+
+// Pairs reports whether resp is the ID an ECU answers a request on req
+// with.  Standard IDs answer 8 above the request, or anywhere in 7E8-7EF
+// for 7DF.  Extended IDs swap the target and source address bytes
+func Pairs(req string, resp string) bool {
+	r, err := api.Hextoui32(req)
+	if err != nil {
+		return false
+	}
+	a, err := api.Hextoui32(resp)
+	if err != nil {
+		return false
+	}
+	if r <= 0x7FF {
+		if r == 0x7DF {
+			return a >= 0x7E8 && a <= 0x7EF
+		}
+		return a == r+8
+	}
+	if a&0xFFFF0000 != 0x18DA0000 || (a>>8)&0xFF != r&0xFF {
+		return false
+	}
+	return r&0xFFFF0000 == 0x18DB0000 || (r&0xFFFF0000 == 0x18DA0000 && a&0xFF == (r>>8)&0xFF)
+}
+
+// ResponseId returns the ID a physically addressed ECU normally answers
+// requests on txId with, see Pairs
+func ResponseId(txId string) (string, error) {
+	id, err := api.Hextoui32(txId)
+	if err != nil {
+		return "", logger.Err("Bad request ID " + txId)
+	}
+	if id <= 0x7FF {
+		return api.FormatArbId(id+8, false), nil
+	}
+	if id&0xFFFF0000 != 0x18DA0000 {
+		return "", logger.Err("No usual response ID for " + txId)
+	}
+	return api.FormatArbId(0x18DA0000|(id&0xFF)<<8|(id>>8)&0xFF, true), nil
+}
+
+// responsePending is the UDS/KWP "request correctly received, response
+// pending" answer, the real response follows later
+func responsePending(data []byte) bool {
+	return len(data) >= 3 && data[0] == 0x7F && data[2] == 0x78
+}
+
+// Add feeds a sniffed frame in
+func (m *Monitor) Add(pkt api.CanData) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.add(pkt)
+}
+
+func (m *Monitor) add(pkt api.CanData) {
+	if !DiagnosticId(pkt.ArbID) {
+		return
+	}
+	if m.streams == nil {
+		m.streams = map[string]*Reassembler{}
+		m.messages = map[string]*Message{}
+	}
+	data := pkt.Data()
+	kind := FrameType(data)
+	if kind == SINGLE_FRAME || kind == FIRST_FRAME {
+		m.streams[pkt.ArbID] = &Reassembler{}
+		m.messages[pkt.ArbID] = &Message{ArbID: pkt.ArbID, FirstSeq: pkt.SeqNo, Time: pkt.AbsTime}
+	} else if kind != CONSECUTIVE_FRAME {
+		return
+	}
+	r, ok := m.streams[pkt.ArbID]
+	if !ok {
+		return // Joined in the middle of a transfer
+	}
+	msg := m.messages[pkt.ArbID]
+	done, _, err := r.Add(data)
+	if err != nil {
+		delete(m.streams, pkt.ArbID)
+		return
+	}
+	msg.Frames += 1
+	msg.LastSeq = pkt.SeqNo
+	if done {
+		delete(m.streams, pkt.ArbID)
+		msg.Data = r.Data
+		msg.Hex = fmt.Sprintf("% X", r.Data)
+		m.complete(*msg)
+	}
+}
+
+// responseId reports whether an ID answers requests, on 7E8-7EF or on the
+// response ID of a request seen before
+func (m *Monitor) responseId(arbId string) bool {
+	if Pairs("7DF", arbId) {
+		return true
+	}
+	for req := range m.requestIds {
+		if Pairs(req, arbId) {
+			return true
+		}
+	}
+	return false
+}
+
+// complete pairs a finished message with an outstanding request, or
+// records it as a new request.  Responses nothing is waiting for are dropped
+func (m *Monitor) complete(msg Message) {
+	now := time.Now()
+	m.expire(now)
+	for i, p := range m.pending {
+		if !Pairs(p.msg.ArbID, msg.ArbID) {
+			continue
+		}
+		req := p.msg
+		m.addTransaction(Transaction{Request: &req, Response: &msg})
+		p.answered = true
+		if !Functional(p.msg.ArbID) && !responsePending(msg.Data) {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+		}
+		return
+	}
+	if m.responseId(msg.ArbID) {
+		return
+	}
+	if m.requestIds == nil {
+		m.requestIds = map[string]bool{}
+	}
+	m.requestIds[msg.ArbID] = true
+	// Only one request per ID can be outstanding
+	for i, p := range m.pending {
+		if p.msg.ArbID == msg.ArbID {
+			m.flush(p)
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			break
+		}
+	}
+	m.pending = append(m.pending, &pendingRequest{msg: msg, seen: now})
+}
+
+// expire reports requests that went unanswered for too long
+func (m *Monitor) expire(now time.Time) {
+	var keep []*pendingRequest
+	for _, p := range m.pending {
+		if now.Sub(p.seen) > TRANSACTION_TIMEOUT {
+			m.flush(p)
+		} else {
+			keep = append(keep, p)
+		}
+	}
+	m.pending = keep
+}
+
+func (m *Monitor) flush(p *pendingRequest) {
+	if !p.answered {
+		req := p.msg
+		m.addTransaction(Transaction{Request: &req})
+	}
+}
+
+func (m *Monitor) addTransaction(t Transaction) {
+	m.Transactions[m.txIdx] = t
+	m.txIdx += 1
+	if m.txIdx >= MAX_TRANSACTIONS {
+		m.txIdx = 0
+	}
+}
+
+// Follow feeds in every frame the device recorded since the last call.
+// The first call only marks where to start
+func (m *Monitor) Follow(dev api.CanDevice) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.following {
+		m.pktIdx = dev.GetPacketIdx()
+		m.following = true
+		return
+	}
+	var pkts []api.CanData
+	pkts, m.pktIdx = dev.GetPacketsFrom(m.pktIdx)
+	for i := range pkts {
+		m.add(pkts[i])
+	}
+}
+
+// Start follows the device in the background until Stop, so requests are
+// timed when they are sent rather than when someone asks for transactions
+func (m *Monitor) Start(dev api.CanDevice) {
+	m.lock.Lock()
+	if m.stop != nil {
+		m.lock.Unlock()
+		return
+	}
+	stop := make(chan bool)
+	m.stop = stop
+	m.lock.Unlock()
+	m.Follow(dev) // Marks where to start before returning
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(MONITOR_POLL):
+			}
+			m.Follow(dev)
+		}
+	}()
+}
+
+// Stop ends background following
+func (m *Monitor) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+// GetTransactionsFrom returns the transactions completed since idx and the
+// index to ask for next time
+func (m *Monitor) GetTransactionsFrom(idx int) ([]Transaction, int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.expire(time.Now())
+	var txs []Transaction
+	for len(txs) < MAX_TRANSACTIONS {
+		if idx >= MAX_TRANSACTIONS || idx < 0 {
+			idx = 0
+		}
+		if idx == m.txIdx {
+			break
+		}
+		txs = append(txs, m.Transactions[idx])
+		idx += 1
+	}
+	return txs, idx
+}
@@ -0,0 +1,128 @@
+package obd
+
+import (
+	"fmt"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+// DTC related modes
+const (
+	MODE_STORED_DTCS    = 0x03
+	MODE_CLEAR_DTCS     = 0x04
+	MODE_PENDING_DTCS   = 0x07
+	MODE_PERMANENT_DTCS = 0x0A
+	NEGATIVE_RESPONSE   = 0x7F
+)
+
+var DTCModeNames = map[uint8]string{
+	MODE_STORED_DTCS:    "stored",
+	MODE_PENDING_DTCS:   "pending",
+	MODE_PERMANENT_DTCS: "permanent",
+}
+
+// Response is the reassembled reply of one ECU to an OBD request
+type Response struct {
+	ECU  string
+	Data []byte
+}
+
+// Requester sends an OBD request (mode and data, no ISO-TP framing) to all
+// ECUs and returns every response received
+type Requester func(req []byte) ([]Response, error)
+
+// DTC is a diagnostic trouble code reported by an ECU
+type DTC struct {
+	Code string
+	Desc string
+	ECU  string
+	Type string // stored, pending or permanent
+}
+
+// DecodeDTC turns the two raw bytes of a DTC into a code such as P0133
+func DecodeDTC(a uint8, b uint8) string {
+	system := []string{"P", "C", "B", "U"}[a>>6]
+	return fmt.Sprintf("%s%d%X%02X", system, (a>>4)&0x03, a&0x0F, b)
+}
+
+// DTCDescription looks a code up in the bundled table
+func DTCDescription(code string) string {
+	desc, ok := DTCDescriptions[code]
+	if !ok {
+		return "Unknown"
+	}
+	return desc
+}
+
+// DecodeDTCResponse decodes a Mode 03/07/0A response.  On CAN the byte
+// after the mode is the number of codes, padding (0000) is skipped
+func DecodeDTCResponse(data []byte) ([]string, error) {
+	var codes []string
+	if len(data) < 1 || data[0]&^MODE_RESPONSE != MODE_STORED_DTCS &&
+		data[0]&^MODE_RESPONSE != MODE_PENDING_DTCS && data[0]&^MODE_RESPONSE != MODE_PERMANENT_DTCS {
+		return nil, logger.Err("Not a DTC response")
+	}
+	pairs := data[1:]
+	if len(pairs)%2 == 1 && int(pairs[0])*2 <= len(pairs)-1 {
+		pairs = pairs[1 : 1+int(pairs[0])*2]
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == 0 && pairs[i+1] == 0 {
+			continue
+		}
+		codes = append(codes, DecodeDTC(pairs[i], pairs[i+1]))
+	}
+	return codes, nil
+}
+
+// ReadDTCs requests the stored, pending or permanent codes from every ECU
+func ReadDTCs(request Requester, mode uint8) ([]DTC, error) {
+	var dtcs []DTC
+	kind, ok := DTCModeNames[mode]
+	if !ok {
+		return nil, logger.Err(fmt.Sprintf("Mode %02X does not read DTCs", mode))
+	}
+	resps, err := request([]byte{mode})
+	if err != nil {
+		return nil, err
+	}
+	for i := range resps {
+		if len(resps[i].Data) == 0 || resps[i].Data[0] != mode+MODE_RESPONSE {
+			continue
+		}
+		codes, err := DecodeDTCResponse(resps[i].Data)
+		if err != nil {
+			continue
+		}
+		for j := range codes {
+			dtcs = append(dtcs, DTC{Code: codes[j], Desc: DTCDescription(codes[j]), ECU: resps[i].ECU, Type: kind})
+		}
+	}
+	return dtcs, nil
+}
+
+// ClearDTCs sends Mode 04, which also clears freeze frames and resets the
+// readiness monitors.  confirm must be true as a guard against accidents.
+// Returns the ECUs that acknowledged the clear
+func ClearDTCs(request Requester, confirm bool) ([]string, error) {
+	var ecus []string
+	if !confirm {
+		return nil, logger.Err("Clearing DTCs needs confirmation")
+	}
+	resps, err := request([]byte{MODE_CLEAR_DTCS})
+	if err != nil {
+		return nil, err
+	}
+	for i := range resps {
+		data := resps[i].Data
+		if len(data) > 0 && data[0] == MODE_CLEAR_DTCS+MODE_RESPONSE {
+			ecus = append(ecus, resps[i].ECU)
+		} else if len(data) > 2 && data[0] == NEGATIVE_RESPONSE {
+			logger.Log(fmt.Sprintf("%s refused to clear DTCs (NRC %02X)", resps[i].ECU, data[2]))
+		}
+	}
+	if len(ecus) == 0 {
+		return nil, logger.Err("No ECU acknowledged the clear request")
+	}
+	return ecus, nil
+}
@@ -0,0 +1,173 @@
+package obd
+
+// DTCDescriptions covers the common SAE J2012 generic codes.  Manufacturer
+// specific codes (P1xxx, B1xxx, ...) vary by make and are not included
+var DTCDescriptions = map[string]string{
+	"P0010": "Intake camshaft position actuator circuit (bank 1)",
+	"P0011": "Intake camshaft position timing over-advanced (bank 1)",
+	"P0012": "Intake camshaft position timing over-retarded (bank 1)",
+	"P0013": "Exhaust camshaft position actuator circuit (bank 1)",
+	"P0014": "Exhaust camshaft position timing over-advanced (bank 1)",
+	"P0016": "Crankshaft/camshaft position correlation (bank 1 sensor A)",
+	"P0017": "Crankshaft/camshaft position correlation (bank 1 sensor B)",
+	"P0020": "Intake camshaft position actuator circuit (bank 2)",
+	"P0021": "Intake camshaft position timing over-advanced (bank 2)",
+	"P0030": "HO2S heater control circuit (bank 1 sensor 1)",
+	"P0036": "HO2S heater control circuit (bank 1 sensor 2)",
+	"P0100": "Mass air flow circuit",
+	"P0101": "Mass air flow circuit range/performance",
+	"P0102": "Mass air flow circuit low",
+	"P0103": "Mass air flow circuit high",
+	"P0105": "Manifold absolute pressure/barometric pressure circuit",
+	"P0106": "Manifold absolute pressure/barometric pressure circuit range/performance",
+	"P0107": "Manifold absolute pressure/barometric pressure circuit low",
+	"P0108": "Manifold absolute pressure/barometric pressure circuit high",
+	"P0110": "Intake air temperature sensor circuit",
+	"P0112": "Intake air temperature sensor circuit low",
+	"P0113": "Intake air temperature sensor circuit high",
+	"P0115": "Engine coolant temperature circuit",
+	"P0116": "Engine coolant temperature circuit range/performance",
+	"P0117": "Engine coolant temperature circuit low",
+	"P0118": "Engine coolant temperature circuit high",
+	"P0120": "Throttle/pedal position sensor A circuit",
+	"P0121": "Throttle/pedal position sensor A circuit range/performance",
+	"P0122": "Throttle/pedal position sensor A circuit low",
+	"P0123": "Throttle/pedal position sensor A circuit high",
+	"P0125": "Insufficient coolant temperature for closed loop fuel control",
+	"P0128": "Coolant thermostat (coolant temperature below thermostat regulating temperature)",
+	"P0130": "O2 sensor circuit (bank 1 sensor 1)",
+	"P0131": "O2 sensor circuit low voltage (bank 1 sensor 1)",
+	"P0132": "O2 sensor circuit high voltage (bank 1 sensor 1)",
+	"P0133": "O2 sensor circuit slow response (bank 1 sensor 1)",
+	"P0134": "O2 sensor circuit no activity detected (bank 1 sensor 1)",
+	"P0135": "O2 sensor heater circuit (bank 1 sensor 1)",
+	"P0136": "O2 sensor circuit (bank 1 sensor 2)",
+	"P0137": "O2 sensor circuit low voltage (bank 1 sensor 2)",
+	"P0138": "O2 sensor circuit high voltage (bank 1 sensor 2)",
+	"P0139": "O2 sensor circuit slow response (bank 1 sensor 2)",
+	"P0140": "O2 sensor circuit no activity detected (bank 1 sensor 2)",
+	"P0141": "O2 sensor heater circuit (bank 1 sensor 2)",
+	"P0150": "O2 sensor circuit (bank 2 sensor 1)",
+	"P0151": "O2 sensor circuit low voltage (bank 2 sensor 1)",
+	"P0152": "O2 sensor circuit high voltage (bank 2 sensor 1)",
+	"P0153": "O2 sensor circuit slow response (bank 2 sensor 1)",
+	"P0155": "O2 sensor heater circuit (bank 2 sensor 1)",
+	"P0161": "O2 sensor heater circuit (bank 2 sensor 2)",
+	"P0171": "System too lean (bank 1)",
+	"P0172": "System too rich (bank 1)",
+	"P0174": "System too lean (bank 2)",
+	"P0175": "System too rich (bank 2)",
+	"P0190": "Fuel rail pressure sensor circuit",
+	"P0191": "Fuel rail pressure sensor circuit range/performance",
+	"P0201": "Injector circuit/open - cylinder 1",
+	"P0202": "Injector circuit/open - cylinder 2",
+	"P0203": "Injector circuit/open - cylinder 3",
+	"P0204": "Injector circuit/open - cylinder 4",
+	"P0205": "Injector circuit/open - cylinder 5",
+	"P0206": "Injector circuit/open - cylinder 6",
+	"P0217": "Engine coolant over temperature condition",
+	"P0219": "Engine overspeed condition",
+	"P0220": "Throttle/pedal position sensor B circuit",
+	"P0221": "Throttle/pedal position sensor B circuit range/performance",
+	"P0234": "Turbocharger/supercharger overboost condition",
+	"P0299": "Turbocharger/supercharger underboost",
+	"P0300": "Random/multiple cylinder misfire detected",
+	"P0301": "Cylinder 1 misfire detected",
+	"P0302": "Cylinder 2 misfire detected",
+	"P0303": "Cylinder 3 misfire detected",
+	"P0304": "Cylinder 4 misfire detected",
+	"P0305": "Cylinder 5 misfire detected",
+	"P0306": "Cylinder 6 misfire detected",
+	"P0307": "Cylinder 7 misfire detected",
+	"P0308": "Cylinder 8 misfire detected",
+	"P0325": "Knock sensor 1 circuit (bank 1)",
+	"P0327": "Knock sensor 1 circuit low (bank 1)",
+	"P0328": "Knock sensor 1 circuit high (bank 1)",
+	"P0335": "Crankshaft position sensor A circuit",
+	"P0336": "Crankshaft position sensor A circuit range/performance",
+	"P0340": "Camshaft position sensor A circuit (bank 1)",
+	"P0341": "Camshaft position sensor A circuit range/performance (bank 1)",
+	"P0351": "Ignition coil A primary/secondary circuit",
+	"P0352": "Ignition coil B primary/secondary circuit",
+	"P0353": "Ignition coil C primary/secondary circuit",
+	"P0354": "Ignition coil D primary/secondary circuit",
+	"P0400": "Exhaust gas recirculation flow",
+	"P0401": "Exhaust gas recirculation flow insufficient detected",
+	"P0402": "Exhaust gas recirculation flow excessive detected",
+	"P0403": "Exhaust gas recirculation control circuit",
+	"P0404": "Exhaust gas recirculation control circuit range/performance",
+	"P0410": "Secondary air injection system",
+	"P0411": "Secondary air injection system incorrect flow detected",
+	"P0420": "Catalyst system efficiency below threshold (bank 1)",
+	"P0421": "Warm up catalyst efficiency below threshold (bank 1)",
+	"P0430": "Catalyst system efficiency below threshold (bank 2)",
+	"P0440": "Evaporative emission system",
+	"P0441": "Evaporative emission system incorrect purge flow",
+	"P0442": "Evaporative emission system leak detected (small leak)",
+	"P0443": "Evaporative emission system purge control valve circuit",
+	"P0446": "Evaporative emission system vent control circuit",
+	"P0449": "Evaporative emission system vent valve/solenoid circuit",
+	"P0451": "Evaporative emission system pressure sensor range/performance",
+	"P0452": "Evaporative emission system pressure sensor low",
+	"P0453": "Evaporative emission system pressure sensor high",
+	"P0455": "Evaporative emission system leak detected (large leak)",
+	"P0456": "Evaporative emission system leak detected (very small leak)",
+	"P0460": "Fuel level sensor A circuit",
+	"P0461": "Fuel level sensor A circuit range/performance",
+	"P0480": "Fan 1 control circuit",
+	"P0500": "Vehicle speed sensor A",
+	"P0501": "Vehicle speed sensor A range/performance",
+	"P0505": "Idle air control system",
+	"P0506": "Idle air control system RPM lower than expected",
+	"P0507": "Idle air control system RPM higher than expected",
+	"P0520": "Engine oil pressure sensor/switch circuit",
+	"P0530": "A/C refrigerant pressure sensor A circuit",
+	"P0562": "System voltage low",
+	"P0563": "System voltage high",
+	"P0571": "Brake switch A circuit",
+	"P0600": "Serial communication link",
+	"P0601": "Internal control module memory checksum error",
+	"P0602": "Control module programming error",
+	"P0603": "Internal control module keep alive memory (KAM) error",
+	"P0604": "Internal control module random access memory (RAM) error",
+	"P0605": "Internal control module read only memory (ROM) error",
+	"P0606": "Control module processor",
+	"P0700": "Transmission control system (MIL request)",
+	"P0705": "Transmission range sensor A circuit (PRNDL input)",
+	"P0710": "Transmission fluid temperature sensor A circuit",
+	"P0715": "Input/turbine speed sensor A circuit",
+	"P0720": "Output speed sensor circuit",
+	"P0730": "Incorrect gear ratio",
+	"P0740": "Torque converter clutch solenoid circuit/open",
+	"P0750": "Shift solenoid A",
+	"P0755": "Shift solenoid B",
+	"C0035": "Left front wheel speed sensor circuit",
+	"C0040": "Right front wheel speed sensor circuit",
+	"C0045": "Left rear wheel speed sensor circuit",
+	"C0050": "Right rear wheel speed sensor circuit",
+	"C0110": "Pump motor circuit",
+	"C0121": "Valve relay circuit",
+	"C0131": "ABS/TCS system pressure circuit",
+	"C0161": "ABS/TCS brake switch circuit",
+	"C0196": "Yaw rate circuit",
+	"C0561": "System disabled information stored",
+	"B0001": "Driver frontal stage 1 deployment control",
+	"B0002": "Driver frontal stage 2 deployment control",
+	"B0010": "Passenger frontal stage 1 deployment control",
+	"B0020": "Left side airbag deployment control",
+	"B0028": "Right side airbag deployment control",
+	"B0051": "Deployment commanded",
+	"B0081": "Occupant classification system fault",
+	"U0001": "High speed CAN communication bus",
+	"U0073": "Control module communication bus A off",
+	"U0100": "Lost communication with ECM/PCM A",
+	"U0101": "Lost communication with TCM",
+	"U0121": "Lost communication with anti-lock brake system (ABS) control module",
+	"U0140": "Lost communication with body control module",
+	"U0151": "Lost communication with restraints control module",
+	"U0155": "Lost communication with instrument panel cluster (IPC) control module",
+	"U0164": "Lost communication with HVAC control module",
+	"U0401": "Invalid data received from ECM/PCM A",
+	"U0402": "Invalid data received from TCM",
+	"U0415": "Invalid data received from anti-lock brake system (ABS) control module",
+}
@@ -0,0 +1,386 @@
+package obd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	MODE_CURRENT_DATA = 0x01
+	MODE_RESPONSE     = 0x40 // Added to the mode in positive responses
+)
+
+// PIDInfo describes how to decode one SAE J1979 Mode 01 PID.  Value is nil
+// for PIDs that only make sense as text, Text is nil for plain numbers
+type PIDInfo struct {
+	Name  string
+	Units string
+	Bytes int
+	Value func(d []byte) float64
+	Text  func(d []byte) string
+}
+
+// PIDValue is a decoded Mode 01 response
+type PIDValue struct {
+	PID   uint8
+	Name  string
+	Value float64
+	Units string
+	Text  string
+}
+
+func (v PIDValue) String() string {
+	if v.Text != "" {
+		return v.Text
+	}
+	val := strconv.FormatFloat(math.Round(v.Value*100)/100, 'f', -1, 64)
+	if v.Units == "" {
+		return val
+	}
+	return val + " " + v.Units
+}
+
+func word(d []byte) float64 {
+	return float64(int(d[0])<<8 | int(d[1]))
+}
+
+func percent(d []byte) float64 {
+	return float64(d[0]) * 100 / 255
+}
+
+func temp(d []byte) float64 {
+	return float64(d[0]) - 40
+}
+
+func trim(d []byte) float64 {
+	return (float64(d[0]) - 128) * 100 / 128
+}
+
+func count(d []byte) float64 {
+	return float64(d[0])
+}
+
+func catalystTemp(d []byte) float64 {
+	return word(d)/10 - 40
+}
+
+func equivalenceRatio(d []byte) float64 {
+	return word(d) * 2 / 65536
+}
+
+func supportedText(base uint8) func(d []byte) string {
+	return func(d []byte) string {
+		pids := SupportedPIDs(base, d)
+		names := make([]string, len(pids))
+		for i := range pids {
+			names[i] = fmt.Sprintf("%02X", pids[i])
+		}
+		return strings.Join(names, " ")
+	}
+}
+
+func lookupText(table map[uint8]string) func(d []byte) string {
+	return func(d []byte) string {
+		text, ok := table[d[0]]
+		if !ok {
+			return fmt.Sprintf("Unknown (%d)", d[0])
+		}
+		return text
+	}
+}
+
+// o2Sensor is for PIDs 14-1B, voltage and short term fuel trim
+func o2Sensor(d []byte) string {
+	volts := strconv.FormatFloat(float64(d[0])/200, 'f', 3, 64)
+	if d[1] == 0xFF {
+		return volts + " V"
+	}
+	return volts + " V, trim " + strconv.FormatFloat(math.Round(trim(d[1:])*100)/100, 'f', -1, 64) + " %"
+}
+
+func monitorStatus(d []byte) string {
+	mil := "off"
+	if d[0]&0x80 != 0 {
+		mil = "on"
+	}
+	return fmt.Sprintf("MIL %s, %d DTCs", mil, d[0]&0x7F)
+}
+
+func fuelSystemStatus(d []byte) string {
+	text := FuelSystemStatus[d[0]]
+	if d[1] != 0 {
+		text += " / " + FuelSystemStatus[d[1]]
+	}
+	return text
+}
+
+var FuelSystemStatus = map[uint8]string{
+	0:  "Off",
+	1:  "Open loop, insufficient temperature",
+	2:  "Closed loop",
+	4:  "Open loop, engine load or decel",
+	8:  "Open loop, system failure",
+	16: "Closed loop, feedback fault",
+}
+
+var SecondaryAirStatus = map[uint8]string{
+	1: "Upstream",
+	2: "Downstream of catalytic converter",
+	4: "From outside atmosphere or off",
+	8: "Pump commanded on for diagnostics",
+}
+
+var OBDStandards = map[uint8]string{
+	1:  "OBD-II (CARB)",
+	2:  "OBD (EPA)",
+	3:  "OBD and OBD-II",
+	4:  "OBD-I",
+	5:  "Not OBD compliant",
+	6:  "EOBD",
+	7:  "EOBD and OBD-II",
+	8:  "EOBD and OBD",
+	9:  "EOBD, OBD and OBD-II",
+	10: "JOBD",
+	11: "JOBD and OBD-II",
+	12: "JOBD and EOBD",
+	13: "JOBD, EOBD and OBD-II",
+	17: "EMD",
+	18: "EMD+",
+	19: "HD OBD-C",
+	20: "HD OBD",
+	21: "WWH OBD",
+	23: "HD EOBD-I",
+	24: "HD EOBD-I N",
+	25: "HD EOBD-II",
+	26: "HD EOBD-II N",
+	28: "OBDBr-1",
+	29: "OBDBr-2",
+	30: "KOBD",
+	31: "IOBD I",
+	32: "IOBD II",
+	33: "HD EOBD-IV",
+}
+
+var FuelTypes = map[uint8]string{
+	0:  "Not available",
+	1:  "Gasoline",
+	2:  "Methanol",
+	3:  "Ethanol",
+	4:  "Diesel",
+	5:  "LPG",
+	6:  "CNG",
+	7:  "Propane",
+	8:  "Electric",
+	9:  "Bifuel gasoline",
+	10: "Bifuel methanol",
+	11: "Bifuel ethanol",
+	12: "Bifuel LPG",
+	13: "Bifuel CNG",
+	14: "Bifuel propane",
+	15: "Bifuel electric",
+	16: "Bifuel electric and combustion",
+	17: "Hybrid gasoline",
+	18: "Hybrid ethanol",
+	19: "Hybrid diesel",
+	20: "Hybrid electric",
+	21: "Hybrid electric and combustion",
+	22: "Hybrid regenerative",
+	23: "Bifuel diesel",
+}
+
+// Mode01PIDs is the SAE J1979 Mode 01 table
+var Mode01PIDs = map[uint8]PIDInfo{
+	0x00: {Name: "PIDs supported 01-20", Bytes: 4, Text: supportedText(0x00)},
+	0x01: {Name: "Monitor status since DTCs cleared", Bytes: 4, Text: monitorStatus},
+	0x02: {Name: "DTC that caused freeze frame", Bytes: 2, Text: func(d []byte) string { return fmt.Sprintf("%02X%02X", d[0], d[1]) }},
+	0x03: {Name: "Fuel system status", Bytes: 2, Text: fuelSystemStatus},
+	0x04: {Name: "Calculated engine load", Units: "%", Bytes: 1, Value: percent},
+	0x05: {Name: "Engine coolant temperature", Units: "°C", Bytes: 1, Value: temp},
+	0x06: {Name: "Short term fuel trim bank 1", Units: "%", Bytes: 1, Value: trim},
+	0x07: {Name: "Long term fuel trim bank 1", Units: "%", Bytes: 1, Value: trim},
+	0x08: {Name: "Short term fuel trim bank 2", Units: "%", Bytes: 1, Value: trim},
+	0x09: {Name: "Long term fuel trim bank 2", Units: "%", Bytes: 1, Value: trim},
+	0x0A: {Name: "Fuel pressure", Units: "kPa", Bytes: 1, Value: func(d []byte) float64 { return float64(d[0]) * 3 }},
+	0x0B: {Name: "Intake manifold pressure", Units: "kPa", Bytes: 1, Value: count},
+	0x0C: {Name: "Engine RPM", Units: "rpm", Bytes: 2, Value: func(d []byte) float64 { return word(d) / 4 }},
+	0x0D: {Name: "Vehicle speed", Units: "km/h", Bytes: 1, Value: count},
+	0x0E: {Name: "Timing advance", Units: "° before TDC", Bytes: 1, Value: func(d []byte) float64 { return float64(d[0])/2 - 64 }},
+	0x0F: {Name: "Intake air temperature", Units: "°C", Bytes: 1, Value: temp},
+	0x10: {Name: "MAF air flow rate", Units: "g/s", Bytes: 2, Value: func(d []byte) float64 { return word(d) / 100 }},
+	0x11: {Name: "Throttle position", Units: "%", Bytes: 1, Value: percent},
+	0x12: {Name: "Commanded secondary air status", Bytes: 1, Text: lookupText(SecondaryAirStatus)},
+	0x13: {Name: "Oxygen sensors present", Bytes: 1, Text: func(d []byte) string { return fmt.Sprintf("%08b", d[0]) }},
+	0x14: {Name: "Oxygen sensor 1", Bytes: 2, Text: o2Sensor},
+	0x15: {Name: "Oxygen sensor 2", Bytes: 2, Text: o2Sensor},
+	0x16: {Name: "Oxygen sensor 3", Bytes: 2, Text: o2Sensor},
+	0x17: {Name: "Oxygen sensor 4", Bytes: 2, Text: o2Sensor},
+	0x18: {Name: "Oxygen sensor 5", Bytes: 2, Text: o2Sensor},
+	0x19: {Name: "Oxygen sensor 6", Bytes: 2, Text: o2Sensor},
+	0x1A: {Name: "Oxygen sensor 7", Bytes: 2, Text: o2Sensor},
+	0x1B: {Name: "Oxygen sensor 8", Bytes: 2, Text: o2Sensor},
+	0x1C: {Name: "OBD standard", Bytes: 1, Text: lookupText(OBDStandards)},
+	0x1D: {Name: "Oxygen sensors present (4 banks)", Bytes: 1, Text: func(d []byte) string { return fmt.Sprintf("%08b", d[0]) }},
+	0x1E: {Name: "Auxiliary input status", Bytes: 1, Text: func(d []byte) string {
+		if d[0]&1 != 0 {
+			return "PTO active"
+		}
+		return "PTO inactive"
+	}},
+	0x1F: {Name: "Run time since engine start", Units: "s", Bytes: 2, Value: word},
+	0x20: {Name: "PIDs supported 21-40", Bytes: 4, Text: supportedText(0x20)},
+	0x21: {Name: "Distance traveled with MIL on", Units: "km", Bytes: 2, Value: word},
+	0x22: {Name: "Fuel rail pressure (vacuum)", Units: "kPa", Bytes: 2, Value: func(d []byte) float64 { return word(d) * 0.079 }},
+	0x23: {Name: "Fuel rail gauge pressure", Units: "kPa", Bytes: 2, Value: func(d []byte) float64 { return word(d) * 10 }},
+	0x24: {Name: "Oxygen sensor 1 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x25: {Name: "Oxygen sensor 2 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x26: {Name: "Oxygen sensor 3 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x27: {Name: "Oxygen sensor 4 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x28: {Name: "Oxygen sensor 5 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x29: {Name: "Oxygen sensor 6 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x2A: {Name: "Oxygen sensor 7 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x2B: {Name: "Oxygen sensor 8 equivalence ratio", Bytes: 4, Value: equivalenceRatio},
+	0x2C: {Name: "Commanded EGR", Units: "%", Bytes: 1, Value: percent},
+	0x2D: {Name: "EGR error", Units: "%", Bytes: 1, Value: trim},
+	0x2E: {Name: "Commanded evaporative purge", Units: "%", Bytes: 1, Value: percent},
+	0x2F: {Name: "Fuel tank level input", Units: "%", Bytes: 1, Value: percent},
+	0x30: {Name: "Warm-ups since codes cleared", Bytes: 1, Value: count},
+	0x31: {Name: "Distance traveled since codes cleared", Units: "km", Bytes: 2, Value: word},
+	0x32: {Name: "Evap system vapor pressure", Units: "Pa", Bytes: 2, Value: func(d []byte) float64 { return float64(int16(uint16(word(d)))) / 4 }},
+	0x33: {Name: "Absolute barometric pressure", Units: "kPa", Bytes: 1, Value: count},
+	0x34: {Name: "Oxygen sensor 1 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x35: {Name: "Oxygen sensor 2 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x36: {Name: "Oxygen sensor 3 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x37: {Name: "Oxygen sensor 4 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x38: {Name: "Oxygen sensor 5 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x39: {Name: "Oxygen sensor 6 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x3A: {Name: "Oxygen sensor 7 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x3B: {Name: "Oxygen sensor 8 equivalence ratio (current)", Bytes: 4, Value: equivalenceRatio},
+	0x3C: {Name: "Catalyst temperature bank 1 sensor 1", Units: "°C", Bytes: 2, Value: catalystTemp},
+	0x3D: {Name: "Catalyst temperature bank 2 sensor 1", Units: "°C", Bytes: 2, Value: catalystTemp},
+	0x3E: {Name: "Catalyst temperature bank 1 sensor 2", Units: "°C", Bytes: 2, Value: catalystTemp},
+	0x3F: {Name: "Catalyst temperature bank 2 sensor 2", Units: "°C", Bytes: 2, Value: catalystTemp},
+	0x40: {Name: "PIDs supported 41-60", Bytes: 4, Text: supportedText(0x40)},
+	0x41: {Name: "Monitor status this drive cycle", Bytes: 4, Text: monitorStatus},
+	0x42: {Name: "Control module voltage", Units: "V", Bytes: 2, Value: func(d []byte) float64 { return word(d) / 1000 }},
+	0x43: {Name: "Absolute load value", Units: "%", Bytes: 2, Value: func(d []byte) float64 { return word(d) * 100 / 255 }},
+	0x44: {Name: "Commanded air-fuel equivalence ratio", Bytes: 2, Value: equivalenceRatio},
+	0x45: {Name: "Relative throttle position", Units: "%", Bytes: 1, Value: percent},
+	0x46: {Name: "Ambient air temperature", Units: "°C", Bytes: 1, Value: temp},
+	0x47: {Name: "Absolute throttle position B", Units: "%", Bytes: 1, Value: percent},
+	0x48: {Name: "Absolute throttle position C", Units: "%", Bytes: 1, Value: percent},
+	0x49: {Name: "Accelerator pedal position D", Units: "%", Bytes: 1, Value: percent},
+	0x4A: {Name: "Accelerator pedal position E", Units: "%", Bytes: 1, Value: percent},
+	0x4B: {Name: "Accelerator pedal position F", Units: "%", Bytes: 1, Value: percent},
+	0x4C: {Name: "Commanded throttle actuator", Units: "%", Bytes: 1, Value: percent},
+	0x4D: {Name: "Time run with MIL on", Units: "min", Bytes: 2, Value: word},
+	0x4E: {Name: "Time since trouble codes cleared", Units: "min", Bytes: 2, Value: word},
+	0x50: {Name: "Maximum MAF air flow rate", Units: "g/s", Bytes: 1, Value: func(d []byte) float64 { return float64(d[0]) * 10 }},
+	0x51: {Name: "Fuel type", Bytes: 1, Text: lookupText(FuelTypes)},
+	0x52: {Name: "Ethanol fuel", Units: "%", Bytes: 1, Value: percent},
+	0x53: {Name: "Absolute evap system vapor pressure", Units: "kPa", Bytes: 2, Value: func(d []byte) float64 { return word(d) / 200 }},
+	0x54: {Name: "Evap system vapor pressure", Units: "Pa", Bytes: 2, Value: func(d []byte) float64 { return float64(int16(uint16(word(d)))) }},
+	0x55: {Name: "Short term secondary oxygen sensor trim bank 1", Units: "%", Bytes: 1, Value: trim},
+	0x56: {Name: "Long term secondary oxygen sensor trim bank 1", Units: "%", Bytes: 1, Value: trim},
+	0x57: {Name: "Short term secondary oxygen sensor trim bank 2", Units: "%", Bytes: 1, Value: trim},
+	0x58: {Name: "Long term secondary oxygen sensor trim bank 2", Units: "%", Bytes: 1, Value: trim},
+	0x59: {Name: "Fuel rail absolute pressure", Units: "kPa", Bytes: 2, Value: func(d []byte) float64 { return word(d) * 10 }},
+	0x5A: {Name: "Relative accelerator pedal position", Units: "%", Bytes: 1, Value: percent},
+	0x5B: {Name: "Hybrid battery pack remaining life", Units: "%", Bytes: 1, Value: percent},
+	0x5C: {Name: "Engine oil temperature", Units: "°C", Bytes: 1, Value: temp},
+	0x5D: {Name: "Fuel injection timing", Units: "°", Bytes: 2, Value: func(d []byte) float64 { return word(d)/128 - 210 }},
+	0x5E: {Name: "Engine fuel rate", Units: "L/h", Bytes: 2, Value: func(d []byte) float64 { return word(d) / 20 }},
+	0x60: {Name: "PIDs supported 61-80", Bytes: 4, Text: supportedText(0x60)},
+	0x61: {Name: "Driver's demand engine torque", Units: "%", Bytes: 1, Value: func(d []byte) float64 { return float64(d[0]) - 125 }},
+	0x62: {Name: "Actual engine torque", Units: "%", Bytes: 1, Value: func(d []byte) float64 { return float64(d[0]) - 125 }},
+	0x63: {Name: "Engine reference torque", Units: "Nm", Bytes: 2, Value: word},
+	0x80: {Name: "PIDs supported 81-A0", Bytes: 4, Text: supportedText(0x80)},
+	0xA0: {Name: "PIDs supported A1-C0", Bytes: 4, Text: supportedText(0xA0)},
+	0xA6: {Name: "Odometer", Units: "km", Bytes: 4, Value: func(d []byte) float64 {
+		return float64(uint32(d[0])<<24|uint32(d[1])<<16|uint32(d[2])<<8|uint32(d[3])) / 10
+	}},
+	0xC0: {Name: "PIDs supported C1-E0", Bytes: 4, Text: supportedText(0xC0)},
+}
+
+// SupportedPIDs lists the PIDs set in a 4 byte "PIDs supported" bitmap.
+// base is the PID that returned the bitmap (0x00, 0x20, ...)
+func SupportedPIDs(base uint8, bitmap []byte) []uint8 {
+	var pids []uint8
+	for i := 0; i < 32 && i/8 < len(bitmap); i++ {
+		if bitmap[i/8]&(0x80>>uint(i%8)) != 0 {
+			pids = append(pids, base+uint8(i)+1)
+		}
+	}
+	return pids
+}
+
+// ParsePIDList reads a list of hex PIDs such as "0C,0D 05"
+func ParsePIDList(list string) ([]uint8, error) {
+	var pids []uint8
+	fields := strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' })
+	for i := range fields {
+		pid, err := strconv.ParseUint(strings.TrimPrefix(fields[i], "0x"), 16, 8)
+		if err != nil {
+			return nil, logger.Err("Invalid PID: " + fields[i])
+		}
+		pids = append(pids, uint8(pid))
+	}
+	return pids, nil
+}
+
+// DecodeMode01 decodes the data bytes that follow the PID in a Mode 01 response
+func DecodeMode01(pid uint8, data []byte) (PIDValue, error) {
+	info, ok := Mode01PIDs[pid]
+	if !ok {
+		return PIDValue{PID: pid}, logger.Err(fmt.Sprintf("Unknown PID %02X", pid))
+	}
+	if len(data) < info.Bytes {
+		return PIDValue{PID: pid, Name: info.Name}, logger.Err(fmt.Sprintf("Short response for PID %02X", pid))
+	}
+	val := PIDValue{PID: pid, Name: info.Name, Units: info.Units}
+	if info.Value != nil {
+		val.Value = info.Value(data)
+	}
+	if info.Text != nil {
+		val.Text = info.Text(data)
+	}
+	return val, nil
+}
+
+// IsResponseId reports whether an ArbID is one of the OBD-II ECU response IDs 7E8-7EF
+func IsResponseId(arbId string) bool {
+	id, err := api.Hextoui32(arbId)
+	return err == nil && id >= 0x7E8 && id <= 0x7EF
+}
+
+// DescribePacket fills in Desc and Value for Mode 01 responses on 7E8-7EF.
+// Packets that already have a Desc are left alone.  Returns true if the
+// packet was recognised
+func DescribePacket(pkt *api.CanData) bool {
+	if pkt.Desc != "" || pkt.Extended || !IsResponseId(pkt.ArbID) {
+		return false
+	}
+	data := pkt.Data()
+	if len(data) < 3 {
+		return false
+	}
+	// ISO-TP single frame: length, mode, PID, data
+	length := int(data[0])
+	if data[0]&0xF0 != 0 || length < 2 || length > len(data)-1 {
+		return false
+	}
+	if data[1] != MODE_CURRENT_DATA+MODE_RESPONSE {
+		return false
+	}
+	val, err := DecodeMode01(data[2], data[3:1+length])
+	if err != nil {
+		return false
+	}
+	pkt.Desc = val.Name
+	pkt.Value = val.String()
+	return true
+}
@@ -0,0 +1,93 @@
+package obd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ghetzel/canibus/api"
+)
+
+func TestDecodeMode01(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  uint8
+		data []byte
+		want string
+		err  bool
+	}{
+		{"rpm", 0x0C, []byte{0x1A, 0xF8}, "1726 rpm", false},
+		{"rpm zero", 0x0C, []byte{0x00, 0x00}, "0 rpm", false},
+		{"rpm max", 0x0C, []byte{0xFF, 0xFF}, "16383.75 rpm", false},
+		{"speed", 0x0D, []byte{0x3C}, "60 km/h", false},
+		{"coolant", 0x05, []byte{0x7B}, "83 °C", false},
+		{"coolant below zero", 0x05, []byte{0x00}, "-40 °C", false},
+		{"fuel level", 0x2F, []byte{0x80}, "50.2 %", false},
+		{"fuel level full", 0x2F, []byte{0xFF}, "100 %", false},
+		{"extra bytes ignored", 0x0D, []byte{0x3C, 0xAA, 0xAA}, "60 km/h", false},
+		{"supported 01-20", 0x00, []byte{0xBE, 0x1F, 0xA8, 0x13}, "01 03 04 05 06 07 0C 0D 0E 0F 10 11 13 15 1C 1F 20", false},
+		{"supported 41-60", 0x40, []byte{0x80, 0, 0, 0x01}, "41 60", false},
+		{"rpm short", 0x0C, []byte{0x1A}, "", true},
+		{"speed empty", 0x0D, nil, "", true},
+		{"supported short", 0x00, []byte{0xBE, 0x1F}, "", true},
+		{"unknown PID", 0xFE, []byte{0x00}, "", true},
+	}
+	for _, tt := range tests {
+		val, err := DecodeMode01(tt.pid, tt.data)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error, got %q", tt.name, val)
+			}
+			continue
+		}
+		if err != nil || val.PID != tt.pid || val.String() != tt.want {
+			t.Errorf("%s: got %q err %v, want %q", tt.name, val, err, tt.want)
+		}
+	}
+}
+
+func TestSupportedPIDs(t *testing.T) {
+	tests := []struct {
+		base   uint8
+		bitmap []byte
+		want   []uint8
+	}{
+		{0x00, []byte{0x80, 0, 0, 0}, []uint8{0x01}},
+		{0x00, []byte{0, 0, 0, 0x01}, []uint8{0x20}},
+		{0x20, []byte{0x40, 0x00, 0x80, 0x00}, []uint8{0x22, 0x31}},
+		{0xC0, []byte{0xFF}, []uint8{0xC1, 0xC2, 0xC3, 0xC4, 0xC5, 0xC6, 0xC7, 0xC8}},
+		{0x20, []byte{0, 0, 0, 0}, nil},
+		{0x00, nil, nil},
+	}
+	for _, tt := range tests {
+		if got := SupportedPIDs(tt.base, tt.bitmap); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%02X % X: got % X, want % X", tt.base, tt.bitmap, got, tt.want)
+		}
+	}
+}
+
+func TestDescribePacket(t *testing.T) {
+	tests := []struct {
+		name  string
+		arbId string
+		data  []byte
+		desc  string
+		value string
+	}{
+		{"rpm", "7E8", []byte{0x04, 0x41, 0x0C, 0x1A, 0xF8, 0xAA, 0xAA, 0xAA}, "Engine RPM", "1726 rpm"},
+		{"speed from second ECU", "7E9", []byte{0x03, 0x41, 0x0D, 0x3C}, "Vehicle speed", "60 km/h"},
+		{"not a response ID", "7E0", []byte{0x03, 0x41, 0x0D, 0x3C}, "", ""},
+		{"other mode", "7E8", []byte{0x03, 0x62, 0xF1, 0x90}, "", ""},
+		{"length past data", "7E8", []byte{0x05, 0x41, 0x0C, 0x1A}, "", ""},
+		{"length too short for PID data", "7E8", []byte{0x03, 0x41, 0x0C, 0x1A, 0xF8}, "", ""},
+		{"first frame", "7E8", []byte{0x10, 0x14, 0x41, 0x00, 0xBE, 0x1F, 0xA8, 0x13}, "", ""},
+		{"too short", "7E8", []byte{0x01, 0x41}, "", ""},
+	}
+	for _, tt := range tests {
+		pkt := api.CanData{ArbID: tt.arbId}
+		pkt.SetData(tt.data)
+		ok := DescribePacket(&pkt)
+		if ok != (tt.desc != "") || pkt.Desc != tt.desc || pkt.Value != tt.value {
+			t.Errorf("%s: got %v %q %q, want %q %q", tt.name, ok, pkt.Desc, pkt.Value, tt.desc, tt.value)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package obd
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ghetzel/canibus/logger"
+)
+
+// VIN is read with Mode 09 PID 02
+const (
+	MODE_VEHICLE_INFO = 0x09
+	PID_VIN           = 0x02
+)
+
+var vinRegexp = regexp.MustCompile(`^[A-HJ-NPR-Z0-9]{17}$`)
+
+// ValidVIN reports whether vin is 17 characters without I, O or Q
+func ValidVIN(vin string) bool {
+	return vinRegexp.MatchString(vin)
+}
+
+// ReadVIN requests the VIN.  The answer is 49 02, the number of data items,
+// then the 17 VIN characters
+func ReadVIN(request Requester) (string, error) {
+	resps, err := request([]byte{MODE_VEHICLE_INFO, PID_VIN})
+	if err != nil {
+		return "", err
+	}
+	for i := range resps {
+		data := resps[i].Data
+		if len(data) < 3 || data[0] != MODE_VEHICLE_INFO+MODE_RESPONSE || data[1] != PID_VIN {
+			continue
+		}
+		return strings.Trim(string(data[3:]), "\x00 "), nil
+	}
+	return "", logger.Err("No ECU reported a VIN")
+}
@@ -2,7 +2,6 @@ package serialbuffer
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 	"time"
 
@@ -25,6 +24,7 @@ type SerialBuffer struct {
 	CurPtr     int
 	PromptChar byte
 	GotPrompt  bool
+	pending    chan []byte // Background read in progress, shared by ReadLn calls
 }
 
 func (s *SerialBuffer) SetSerial(port string) {
@@ -77,17 +77,33 @@ func (s *SerialBuffer) ReadLn() (string, bool) {
 		}
 		return line, true
 	}
-	c := make(chan []byte, 1)
-	go func() { d, _ := s.Read(); c <- d }()
-	select {
-	case data := <-c:
-		if len(data) > 0 {
-			//fmt.Println("DEBUG: data ",data)
+	// Data a timed out call left behind comes first
+	if s.pending != nil {
+		select {
+		case data := <-s.pending:
+			s.pending = nil
+			s.TmpBuf = append(s.TmpBuf, data...)
+		default:
 		}
-	case <-time.After(2 * time.Second):
-		fmt.Println("DEBUG: Timeout")
 	}
+	// A prompt that already arrived means there is nothing more to wait for
 	s.ParseLines()
+	if s.CurPtr == s.BufPtr && !s.GotPrompt {
+		// Only one read is outstanding at a time, so a read left over from
+		// a timed out call still wakes the next caller.  The reader only
+		// hands its data over, TmpBuf is never touched outside ReadLn
+		if s.pending == nil {
+			s.pending = make(chan []byte, 1)
+			go func(c chan []byte) { d, _ := s.readSerial(); c <- d }(s.pending)
+		}
+		select {
+		case data := <-s.pending:
+			s.pending = nil
+			s.TmpBuf = append(s.TmpBuf, data...)
+		case <-time.After(2 * time.Second):
+		}
+		s.ParseLines()
+	}
 	// Check again.  If BufPtr is different we got a new line
 	if s.CurPtr != s.BufPtr {
 		line = s.Lines[s.CurPtr]
@@ -105,7 +121,7 @@ func (s *SerialBuffer) ParseLines() {
 	newLine := make([]byte, 128)
 	idx := 0
 	newIdx := 0
-	lastEOL := 0
+	lastEOL := -1
 	for idx < bufLen {
 		if s.TmpBuf[idx] == 13 {
 			lastEOL = idx
@@ -113,19 +129,19 @@ func (s *SerialBuffer) ParseLines() {
 				//fmt.Println("DEBUG add newLine", newLine)
 				s.AddLine(newLine)
 				newLine = make([]byte, 128)
-				newIdx = -1
 			}
-			newIdx += 1
+			// Empty lines (bare CRs) must not shift the next line
+			newIdx = 0
 		} else if s.TmpBuf[idx] == 10 {
 			// SKip \n
-		} else {
+		} else if newIdx < len(newLine) {
 			newLine[newIdx] = s.TmpBuf[idx]
 			newIdx += 1
 			//fmt.Println("DEBUG: newLine idx", newLine[newIdx])
 		}
 		idx += 1
 	}
-	if lastEOL > 0 {
+	if lastEOL >= 0 {
 		s.TmpBuf = s.TmpBuf[lastEOL+1:]
 	}
 	if s.PromptChar > 0 && len(s.TmpBuf) > 0 && s.TmpBuf[len(s.TmpBuf)-1] == s.PromptChar {
@@ -133,20 +149,24 @@ func (s *SerialBuffer) ParseLines() {
 	}
 }
 
-func (s *SerialBuffer) Read() ([]byte, error) {
+// readSerial reads what the port has without touching TmpBuf, so it can
+// run in the background
+func (s *SerialBuffer) readSerial() ([]byte, error) {
 	buf := make([]byte, 128)
 	n, err := s.Serial.Read(buf)
-	//fmt.Println("DEBUG read n bytes: ", n)
 	if err != nil {
 		return nil, err
 	}
-	idx := 0
-	for idx < n {
-		s.TmpBuf = append(s.TmpBuf, buf[idx])
-		idx += 1
+	return buf[:n], nil
+}
+
+func (s *SerialBuffer) Read() ([]byte, error) {
+	data, err := s.readSerial()
+	if err != nil {
+		return nil, err
 	}
-	//fmt.Println("DEBUG s.TmpBuf=",string(s.TmpBuf), s.TmpBuf)
-	return buf[:n], err
+	s.TmpBuf = append(s.TmpBuf, data...)
+	return data, err
 }
 
 func (s *SerialBuffer) AddLine(line []byte) {
@@ -158,6 +178,11 @@ func (s *SerialBuffer) AddLine(line []byte) {
 }
 
 func (s *SerialBuffer) Write(data []byte) error {
+	// The prompt left over from the last command does not belong to this one
+	if s.PromptChar > 0 && len(s.TmpBuf) > 0 && s.TmpBuf[len(s.TmpBuf)-1] == s.PromptChar {
+		s.TmpBuf = s.TmpBuf[:len(s.TmpBuf)-1]
+	}
+	s.GotPrompt = false
 	_, err := s.Serial.Write(data)
 	return err
 }
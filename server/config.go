@@ -8,13 +8,29 @@ import (
 
 	"github.com/ghetzel/canibus/api"
 	"github.com/ghetzel/canibus/candevice"
+	"github.com/ghetzel/canibus/core"
+	"github.com/ghetzel/canibus/dbc"
 	"github.com/ghetzel/canibus/logger"
+	"github.com/ghetzel/canibus/obd"
 )
 
 type ConfigElement struct {
-	DeviceType   string
-	DeviceFile   string
-	DeviceSerial string
+	DeviceType      string
+	DeviceFile      string
+	DeviceSerial    string
+	DeviceInterface string
+	DeviceBitrate   int
+	DeviceBitrate2  int // Second bus on multi-bus devices
+	DeviceBus       string
+	DeviceHost      string
+	DevicePort      int
+	DeviceLocalPort int
+	DeviceSpeed     float64 // Simulator replay speed, -1 as fast as possible
+	DeviceStopAtEnd bool
+	DeviceResponder string // Simulator responder rules file
+	DevicePollPIDs  string // ELM327 Mode 01 PIDs to poll, such as "0C,0D"
+	DevicePollRate  int    // Milliseconds between polling cycles
+	DeviceDBC       string // Signal database decoded in the sniff view
 }
 
 type Config struct {
@@ -43,17 +59,77 @@ func (c *Config) LoadConfig(conf string) {
 				break
 			}
 			for i := range elem {
+				before := len(c.Drivers)
 				if elem[i].DeviceType == "simulator" {
 					dev := &candevice.Simulator{}
 					dev.SetPacketFile(elem[i].DeviceFile)
+					dev.SetBus(elem[i].DeviceBus)
+					dev.SetSpeed(elem[i].DeviceSpeed)
+					dev.SetStopAtEnd(elem[i].DeviceStopAtEnd)
+					dev.SetResponderFile(elem[i].DeviceResponder)
 					c.AppendDriver(dev)
 				} else if elem[i].DeviceType == "elm327" {
 					dev := &candevice.Elm327{}
 					dev.SetSerial(elem[i].DeviceSerial)
+					dev.SetPollRate(elem[i].DevicePollRate)
+					if elem[i].DevicePollPIDs != "" {
+						pids, err := obd.ParsePIDList(elem[i].DevicePollPIDs)
+						if err != nil {
+							logger.Log(err.Error())
+						} else {
+							dev.SetPollPIDs(pids)
+							dev.SetPolling(true)
+						}
+					}
+					c.AppendDriver(dev)
+				} else if elem[i].DeviceType == "slcan" {
+					dev := &candevice.SLCAN{}
+					dev.SetSerial(elem[i].DeviceSerial)
+					dev.SetBitrate(elem[i].DeviceBitrate)
+					c.AppendDriver(dev)
+				} else if elem[i].DeviceType == "goodthopter" {
+					dev := &candevice.GoodThopter{}
+					dev.SetSerial(elem[i].DeviceSerial)
+					dev.SetBitrate(elem[i].DeviceBitrate)
+					c.AppendDriver(dev)
+				} else if elem[i].DeviceType == "gvret" {
+					dev := &candevice.GVRET{}
+					dev.SetSerial(elem[i].DeviceSerial)
+					dev.SetBusSpeed(0, elem[i].DeviceBitrate)
+					dev.SetBusSpeed(1, elem[i].DeviceBitrate2)
+					c.AppendDriver(dev)
+				} else if elem[i].DeviceType == "virtualbus" {
+					dev := &candevice.VirtualBus{}
+					dev.SetBus(elem[i].DeviceBus)
+					dev.SetBitrate(elem[i].DeviceBitrate)
+					c.AppendDriver(dev)
+				} else if elem[i].DeviceType == "socketcand" {
+					dev := &candevice.Socketcand{}
+					dev.SetHost(elem[i].DeviceHost)
+					dev.SetPort(elem[i].DevicePort)
+					dev.SetInterface(elem[i].DeviceInterface)
+					c.AppendDriver(dev)
+				} else if elem[i].DeviceType == "cannelloni" {
+					dev := &candevice.Cannelloni{}
+					dev.SetHost(elem[i].DeviceHost)
+					dev.SetPort(elem[i].DevicePort)
+					dev.SetLocalPort(elem[i].DeviceLocalPort)
+					c.AppendDriver(dev)
+				} else if elem[i].DeviceType == "socketcan" {
+					dev := &candevice.SocketCAN{}
+					dev.SetInterface(elem[i].DeviceInterface)
 					c.AppendDriver(dev)
 				} else {
 					fmt.Printf("Unknown config setting: %+v\n", elem[i])
 				}
+				if elem[i].DeviceDBC != "" && len(c.Drivers) > before {
+					db, err := dbc.LoadFile(elem[i].DeviceDBC)
+					if err != nil {
+						logger.Log(err.Error())
+					} else {
+						core.SetSignalDB(c.Drivers[len(c.Drivers)-1].GetId(), db)
+					}
+				}
 			}
 		}
 	}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/candevice"
+	"github.com/ghetzel/canibus/canibususer"
+	"github.com/ghetzel/canibus/core"
+	"github.com/ghetzel/canibus/hacksession"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const SOCKETCAND_POLL = 20 * time.Millisecond
+
+// SocketcandClient is a tool such as Kayak or SavvyCAN connected over the
+// socketcand protocol.  It joins the device's HackSession like a web user
+type SocketcandClient struct {
+	Conn       net.Conn
+	User       canibususer.CanibusUser
+	Device     api.CanDevice
+	streaming  bool
+	streamLock sync.Mutex // Guards streaming
+	writeLock  sync.Mutex
+}
+
+// StartSocketcandListener exports every CAN device as a socketcand bus.
+// Bus names are the device IDs from /candevices, optionally prefixed with "can"
+func StartSocketcandListener(ip string, port string) error {
+	remote := ip + ":" + port
+	logger.Log("Starting socketcand server on " + remote)
+	ln, err := net.Listen("tcp", remote)
+	if err != nil {
+		return logger.Err("Could not bind socketcand to port: " + err.Error())
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return logger.Err("socketcand listener closed")
+		}
+		if err != nil {
+			logger.Log("socketcand accept failed: " + err.Error())
+			continue
+		}
+		go handleSocketcandConnection(conn)
+	}
+}
+
+func handleSocketcandConnection(conn net.Conn) {
+	logger.Log(fmt.Sprintf("Incoming socketcand connection from %s", conn.RemoteAddr()))
+	c := &SocketcandClient{Conn: conn}
+	c.User.SetName("socketcand@" + conn.RemoteAddr().String())
+	defer c.Close()
+	r := bufio.NewReader(conn)
+	c.send("hi")
+	for {
+		msg, err := candevice.ReadSocketcandMsg(r)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(msg)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "open":
+			c.open(fields)
+		case "rawmode":
+			c.rawmode()
+		case "send":
+			c.inject(fields)
+		case "echo":
+			c.send("echo")
+		default:
+			c.send("error unsupported command " + fields[0])
+		}
+	}
+}
+
+func (c *SocketcandClient) send(msg string) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.Conn.Write([]byte("< " + msg + " >"))
+}
+
+// open joins the HackSession of the named device, creating it if needed
+func (c *SocketcandClient) open(fields []string) {
+	if c.Device != nil {
+		c.send("error bus already open")
+		return
+	}
+	if len(fields) != 2 {
+		c.send("error open needs a bus name")
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(fields[1], "can"))
+	if err != nil {
+		c.send("error unknown bus " + fields[1])
+		return
+	}
+	dev, err := core.GetDeviceById(id)
+	if err != nil {
+		c.send("error unknown bus " + fields[1])
+		return
+	}
+	hax := dev.GetHackSession()
+	if hax == nil {
+		hacks := &hacksession.HackSession{}
+		hacks.SetState(hacksession.STATE_CONFIG)
+		hacks.SetDevice(dev)
+		dev.SetHackSession(hacks)
+		hax = hacks
+	}
+	hax.AddUser(&c.User)
+	c.User.SetDeviceId(dev.GetId())
+	c.Device = dev
+	logger.Log(c.User.GetName() + " opened " + dev.DeviceType())
+	c.send("ok")
+}
+
+// rawmode starts the sniffer if needed and streams every frame to the client
+func (c *SocketcandClient) rawmode() {
+	if c.Device == nil {
+		c.send("error no bus open")
+		return
+	}
+	hax := c.Device.GetHackSession()
+	if hax == nil {
+		c.send("error session closed")
+		return
+	}
+	if hax.GetStateValue() != hacksession.STATE_SNIFF {
+		hax.SetState(hacksession.STATE_SNIFF)
+		c.Device.StartSniffing()
+	}
+	c.send("ok")
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	if !c.streaming {
+		c.streaming = true
+		go c.stream()
+	}
+}
+
+func (c *SocketcandClient) isStreaming() bool {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	return c.streaming
+}
+
+func (c *SocketcandClient) stream() {
+	for c.isStreaming() {
+		hax := c.Device.GetHackSession()
+		if hax == nil {
+			c.send("error session closed")
+			c.streamLock.Lock()
+			c.streaming = false
+			c.streamLock.Unlock()
+			return
+		}
+		pkts := hax.GetPackets(&c.User)
+		for i := range pkts {
+			// Do not echo our own transmits back
+			if pkts[i].Src == c.User.GetName() {
+				continue
+			}
+			when := time.Now()
+			if pkts[i].RxTime != 0 {
+				when = time.Unix(0, pkts[i].RxTime)
+			}
+			c.send(FormatSocketcandFrame(pkts[i], when))
+		}
+		time.Sleep(SOCKETCAND_POLL)
+	}
+}
+
+// FormatSocketcandFrame builds "frame <id> <sec.usec> <data>" for a packet
+func FormatSocketcandFrame(pkt api.CanData, when time.Time) string {
+	data := strings.ToUpper(hex.EncodeToString(pkt.Data()))
+	return fmt.Sprintf("frame %s %d.%06d %s", pkt.ArbID, when.Unix(), when.Nanosecond()/1000, data)
+}
+
+// inject handles "send <id> <dlc> <byte>*" through the HackSession
+func (c *SocketcandClient) inject(fields []string) {
+	if c.Device == nil {
+		c.send("error no bus open")
+		return
+	}
+	hax := c.Device.GetHackSession()
+	if hax == nil || !hax.IsActiveUser(&c.User) {
+		c.send("error not part of this session")
+		return
+	}
+	if len(fields) < 3 {
+		c.send("error send needs an id and dlc")
+		return
+	}
+	dlc, err := strconv.Atoi(fields[2])
+	if err != nil || dlc < 0 || dlc > 8 || len(fields) < 3+dlc {
+		c.send("error bad dlc")
+		return
+	}
+	data := make([]string, 8)
+	for i := 0; i < dlc; i++ {
+		b, err := strconv.ParseUint(fields[3+i], 16, 8)
+		if err != nil {
+			c.send("error bad data byte " + fields[3+i])
+			return
+		}
+		data[i] = strconv.Itoa(int(b))
+	}
+	tx := api.TransmitPacket{ArbId: strings.ToUpper(fields[1]), Extended: len(fields[1]) > 3, DLC: fields[2]}
+	tx.B1, tx.B2, tx.B3, tx.B4 = data[0], data[1], data[2], data[3]
+	tx.B5, tx.B6, tx.B7, tx.B8 = data[4], data[5], data[6], data[7]
+	err = hax.InjectPacket(&c.User, tx)
+	if err != nil {
+		logger.Log("socketcand transmit error: " + err.Error())
+		c.send("error " + err.Error())
+	}
+}
+
+// Close leaves the HackSession the same way a web user leaving the device does
+func (c *SocketcandClient) Close() {
+	c.streamLock.Lock()
+	c.streaming = false
+	c.streamLock.Unlock()
+	if c.Device != nil {
+		hax := c.Device.GetHackSession()
+		if hax != nil {
+			hax.RemoveUser(&c.User)
+			if hax.NumOfUsers() == 0 {
+				hax.Close()
+				c.Device.SetHackSession(nil)
+			}
+		}
+	}
+	Close(c.Conn)
+}
@@ -0,0 +1,307 @@
+package uds
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	ENUM_P2       = 250 * time.Millisecond // Most ECUs refuse within a few milliseconds
+	ENUM_DID_FROM = 0xF180
+	ENUM_DID_TO   = 0xF19F
+	OBD_SID_MAX   = 0x0F // SIDs up to here are OBD-II modes, 04 clears DTCs
+	OEM_SESSION   = 0x40 // Vehicle manufacturer and supplier sessions up to 0x7E
+)
+
+// UnsafeServices can change ECU state even when sent without parameters on
+// a badly behaved ECU, they are only probed when Unsafe is set
+var UnsafeServices = map[uint8]bool{
+	SID_ECU_RESET:               true,
+	SID_CLEAR_DTC:               true,
+	SID_COMMUNICATION_CONTROL:   true,
+	SID_REQUEST_DOWNLOAD:        true,
+	SID_TRANSFER_DATA:           true,
+	SID_WRITE_MEMORY_BY_ADDRESS: true,
+	SID_CONTROL_DTC_SETTING:     true,
+}
+
+// ServiceReport says whether an ECU knows a service.  Any answer other than
+// serviceNotSupported means it does, NRC tells why it was refused
+type ServiceReport struct {
+	SID       uint8
+	Name      string
+	Supported bool
+	NRC       uint8
+	NRCName   string
+}
+
+// DIDReport is a DataIdentifier the ECU did not reject as out of range
+type DIDReport struct {
+	DID     string
+	Name    string
+	Value   string // Hex
+	Text    string // Value as text when it is printable
+	NRC     uint8
+	NRCName string
+}
+
+// SessionReport says whether DiagnosticSessionControl could enter a session
+type SessionReport struct {
+	Session   uint8
+	Name      string
+	Reachable bool
+	NRC       uint8
+	NRCName   string
+}
+
+// Report is everything learned about one ECU
+type Report struct {
+	TxID     string
+	RxID     string
+	Time     string
+	Sessions []SessionReport
+	Services []ServiceReport
+	DIDs     []DIDReport
+	Error    string
+}
+
+// EnumStatus is the progress of an enumeration
+type EnumStatus struct {
+	Running bool
+	Current string // ECU being probed
+	Done    int
+	Total   int
+	Reports []Report
+}
+
+// Target is a request and response ID pair to enumerate
+type Target struct {
+	TxID string
+	RxID string
+}
+
+// EnumConfig is which ECUs to enumerate and what to probe on them
+type EnumConfig struct {
+	Targets  []Target
+	DIDFrom  uint16
+	DIDTo    uint16
+	Services []uint8 // Probed as given, every service when nil
+	Sessions []uint8 // Probed as given, every session when nil
+	Unsafe   bool    // Also probe UnsafeServices, OBD modes, programming and OEM sessions
+}
+
+// DefaultEnumConfig reads the identification DIDs
+var DefaultEnumConfig = EnumConfig{DIDFrom: ENUM_DID_FROM, DIDTo: ENUM_DID_TO}
+
+// Enumerator probes the services, DIDs and sessions of one or more ECUs.
+// The device must be sniffing
+type Enumerator struct {
+	Device api.CanDevice
+	status EnumStatus
+	stop   chan bool
+	lock   sync.Mutex
+}
+
+// NewEnumerator returns an enumerator for a device
+func NewEnumerator(dev api.CanDevice) *Enumerator {
+	return &Enumerator{Device: dev}
+}
+
+func (c *EnumConfig) services() []uint8 {
+	if c.Services != nil {
+		return c.Services
+	}
+	var sids []uint8
+	for sid := 0x01; sid <= 0xBF; sid++ {
+		if sid >= 0x40 && sid < 0x80 {
+			continue // Response IDs
+		}
+		if (UnsafeServices[uint8(sid)] || sid <= OBD_SID_MAX) && !c.Unsafe {
+			continue
+		}
+		sids = append(sids, uint8(sid))
+	}
+	return sids
+}
+
+func (c *EnumConfig) sessions() []uint8 {
+	if c.Sessions != nil {
+		return c.Sessions
+	}
+	var sessions []uint8
+	for session := 0x01; session <= 0x7F; session++ {
+		if (session == PROGRAMMING_SESSION || session >= OEM_SESSION && session < 0x7F) && !c.Unsafe {
+			continue
+		}
+		sessions = append(sessions, uint8(session))
+	}
+	return sessions
+}
+
+// steps is the number of requests per target, used for progress
+func (c *EnumConfig) steps() int {
+	return len(c.sessions()) + len(c.services()) + int(c.DIDTo) - int(c.DIDFrom) + 1
+}
+
+// Start enumerates every target in the background.  The config is copied
+// so the caller may reuse it
+func (e *Enumerator) Start(config EnumConfig) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.status.Running {
+		return logger.Err("Enumeration already running")
+	}
+	if len(config.Targets) == 0 {
+		return logger.Err("Nothing to enumerate")
+	}
+	if config.DIDTo < config.DIDFrom {
+		return logger.Err("DID range is backwards")
+	}
+	config.Targets = append([]Target{}, config.Targets...)
+	config.Services = append([]uint8{}, config.services()...)
+	config.Sessions = append([]uint8{}, config.sessions()...)
+	e.status = EnumStatus{Running: true, Total: len(config.Targets) * config.steps()}
+	e.stop = make(chan bool)
+	go e.run(config, e.stop)
+	return nil
+}
+
+// Stop ends a running enumeration, finished reports are kept
+func (e *Enumerator) Stop() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.status.Running {
+		close(e.stop)
+		e.status.Running = false
+	}
+}
+
+// Status returns a copy of the progress and the reports so far
+func (e *Enumerator) Status() EnumStatus {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	status := e.status
+	status.Reports = append([]Report{}, e.status.Reports...)
+	return status
+}
+
+func (e *Enumerator) run(config EnumConfig, stop chan bool) {
+	targets := config.Targets
+	for i := range targets {
+		e.lock.Lock()
+		e.status.Current = targets[i].TxID
+		e.lock.Unlock()
+		report, ok := e.Enumerate(config, targets[i], stop)
+		e.lock.Lock()
+		if e.stop == stop {
+			e.status.Reports = append(e.status.Reports, report)
+		}
+		e.lock.Unlock()
+		if !ok {
+			return
+		}
+	}
+	e.lock.Lock()
+	if e.stop == stop {
+		e.status.Running = false
+	}
+	e.lock.Unlock()
+}
+
+// tick counts a finished request.  Returns false once stop was closed
+func (e *Enumerator) tick(stop chan bool) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	e.lock.Lock()
+	if e.stop == stop {
+		e.status.Done += 1
+	}
+	e.lock.Unlock()
+	return true
+}
+
+// Enumerate probes one ECU as config says, the Targets are ignored.
+// Returns false when stopped part way through
+func (e *Enumerator) Enumerate(config EnumConfig, target Target, stop chan bool) (Report, bool) {
+	report := Report{TxID: target.TxID, RxID: target.RxID, Time: time.Now().Format(time.RFC3339)}
+	client, err := NewClient(e.Device, target.TxID, target.RxID)
+	if err != nil {
+		report.Error = err.Error()
+		return report, true
+	}
+	client.P2 = ENUM_P2
+	for _, session := range config.sessions() {
+		result := SessionReport{Session: session, Name: SessionNames[session]}
+		_, err := client.DiagnosticSessionControl(session)
+		result.Reachable = err == nil
+		result.NRC = NRC(err)
+		if result.NRC != 0 {
+			result.NRCName = NRCName(result.NRC)
+		}
+		if err == nil || (result.NRC != NRC_SUBFUNCTION_NOT_SUPPORTED && result.NRC != NRC_REQUEST_OUT_OF_RANGE && result.NRC != 0) {
+			report.Sessions = append(report.Sessions, result)
+		}
+		if err == nil && session != DEFAULT_SESSION {
+			client.DiagnosticSessionControl(DEFAULT_SESSION)
+		}
+		if !e.tick(stop) {
+			return report, false
+		}
+	}
+	for _, sid := range config.services() {
+		result := ServiceReport{SID: sid, Name: ServiceName(sid)}
+		_, err := client.Request([]byte{sid})
+		result.NRC = NRC(err)
+		if result.NRC != 0 {
+			result.NRCName = NRCName(result.NRC)
+		}
+		// Silence means unsupported too, ECUs may ignore unknown services
+		result.Supported = err == nil || (result.NRC != 0 && result.NRC != NRC_SERVICE_NOT_SUPPORTED)
+		if result.Supported {
+			report.Services = append(report.Services, result)
+		}
+		if !e.tick(stop) {
+			return report, false
+		}
+	}
+	for did := int(config.DIDFrom); did <= int(config.DIDTo); did++ {
+		value, err := client.ReadDataByIdentifier(uint16(did))
+		nrc := NRC(err)
+		if err == nil || (nrc != 0 && nrc != NRC_REQUEST_OUT_OF_RANGE && nrc != NRC_SERVICE_NOT_SUPPORTED) {
+			result := DIDReport{DID: fmt.Sprintf("%04X", did), Name: DIDNames[uint16(did)], NRC: nrc}
+			if nrc != 0 {
+				result.NRCName = NRCName(nrc)
+			}
+			if err == nil {
+				result.Value = fmt.Sprintf("% X", value)
+				if printable(value) {
+					result.Text = string(value)
+				}
+			}
+			report.DIDs = append(report.DIDs, result)
+		}
+		if !e.tick(stop) {
+			return report, false
+		}
+	}
+	return report, true
+}
+
+func printable(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for _, b := range data {
+		if b < 0x20 || b > 0x7E {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,250 @@
+package uds
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/isotp"
+	"github.com/ghetzel/canibus/logger"
+)
+
+const (
+	SCAN_SRC  = "Scanner"
+	SCAN_WAIT = UDS_P2 // Time each ID gets to answer
+	SCAN_POLL = 2 * time.Millisecond
+)
+
+// Requests a scan can send.  Both are harmless, TesterPresent does not
+// change session and 01 00 only lists the supported OBD PIDs
+var (
+	SCAN_UDS = []byte{SID_TESTER_PRESENT, 0x00}
+	SCAN_OBD = []byte{0x01, 0x00}
+)
+
+// ScanResult is an answer seen to the request sent on RequestID
+type ScanResult struct {
+	RequestID  string
+	ResponseID string
+	Response   string
+}
+
+// ScanStatus is the progress and findings of a scan
+type ScanStatus struct {
+	Running bool
+	Current string // Last ID probed
+	Done    int
+	Total   int
+	Results []ScanResult
+	Pairs   map[string][]string // Request ID to the IDs that answered it
+	Error   string
+}
+
+// ScanConfig is what a scan sends and where.  Standard IDs From-To are
+// probed, plus 18DAxxF1 for every target address when Extended is set.
+// Wait defaults to SCAN_WAIT
+type ScanConfig struct {
+	Request  []byte
+	From     uint32
+	To       uint32
+	Extended bool
+	Wait     time.Duration
+}
+
+// DefaultScanConfig sends TesterPresent to every standard ID
+var DefaultScanConfig = ScanConfig{Request: SCAN_UDS, From: 0x000, To: 0x7FF, Wait: SCAN_WAIT}
+
+// Scanner sweeps request IDs looking for ECUs that answer diagnostics.
+// The device must be sniffing
+type Scanner struct {
+	Device api.CanDevice
+	status ScanStatus
+	stop   chan bool
+	lock   sync.Mutex
+}
+
+// NewScanner returns a scanner for a device
+func NewScanner(dev api.CanDevice) *Scanner {
+	return &Scanner{Device: dev}
+}
+
+func (c *ScanConfig) ids() []uint32 {
+	var ids []uint32
+	for id := c.From; id <= c.To && id <= 0x7FF; id++ {
+		if id == 0x7DF {
+			continue // Functional, every ECU would answer it
+		}
+		ids = append(ids, id)
+	}
+	if c.Extended {
+		for ta := uint32(0); ta <= 0xFF; ta++ {
+			if ta == 0xF1 {
+				continue // Our own tester address
+			}
+			ids = append(ids, 0x18DA00F1|ta<<8)
+		}
+	}
+	return ids
+}
+
+// Start begins a scan in the background.  The config is copied so the
+// caller may reuse it
+func (s *Scanner) Start(config ScanConfig) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status.Running {
+		return logger.Err("Scan already running")
+	}
+	if len(config.Request) == 0 || len(config.Request) > 7 {
+		return logger.Err("Scan request must fit in a single frame")
+	}
+	config.Request = append([]byte{}, config.Request...)
+	if config.Wait <= 0 {
+		config.Wait = SCAN_WAIT
+	}
+	ids := config.ids()
+	s.status = ScanStatus{Running: true, Total: len(ids), Pairs: map[string][]string{}}
+	s.stop = make(chan bool)
+	go s.run(config, ids, s.stop)
+	return nil
+}
+
+// Stop ends a running scan, the results so far are kept
+func (s *Scanner) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status.Running {
+		close(s.stop)
+		s.status.Running = false
+	}
+}
+
+// Status returns a copy of the scan progress
+func (s *Scanner) Status() ScanStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := s.status
+	status.Results = append([]ScanResult{}, s.status.Results...)
+	status.Pairs = map[string][]string{}
+	for k, v := range s.status.Pairs {
+		status.Pairs[k] = append([]string{}, v...)
+	}
+	return status
+}
+
+// answers reports whether a frame is a single frame answer, positive or
+// negative, to the scan request
+func (c *ScanConfig) answers(data []byte) bool {
+	if isotp.FrameType(data) != isotp.SINGLE_FRAME || len(data) < 2 {
+		return false
+	}
+	if data[1] == c.Request[0]+POSITIVE_RESPONSE {
+		return true
+	}
+	return len(data) >= 4 && data[1] == NEGATIVE_RESPONSE && data[2] == c.Request[0]
+}
+
+// busyIDs listens for wait and returns the IDs already sending.  Their
+// traffic is only taken as an answer when it pairs with the probe
+func (s *Scanner) busyIDs(wait time.Duration, stop chan bool) map[string]bool {
+	busy := map[string]bool{}
+	idx := s.Device.GetPacketIdx()
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-stop:
+			return busy
+		default:
+		}
+		var pkts []api.CanData
+		pkts, idx = s.Device.GetPacketsFrom(idx)
+		for j := range pkts {
+			busy[pkts[j].ArbID] = true
+		}
+		time.Sleep(SCAN_POLL)
+	}
+	return busy
+}
+
+func (s *Scanner) run(config ScanConfig, ids []uint32, stop chan bool) {
+	frames, _ := isotp.Segment(config.Request, 0x00)
+	busy := s.busyIDs(config.Wait, stop)
+	for i, id := range ids {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		pkt := api.CanData{Extended: id > 0x7FF, Src: SCAN_SRC}
+		pkt.ArbID = api.FormatArbId(id, pkt.Extended)
+		pkt.SetData(frames[0])
+		idx := s.Device.GetPacketIdx()
+		err := s.Device.InjectPacket(pkt)
+		if err != nil {
+			s.lock.Lock()
+			if s.stop == stop {
+				s.status.Error = err.Error()
+				s.status.Running = false
+			}
+			s.lock.Unlock()
+			return
+		}
+		// Answers on the ID the probe pairs with are preferred, others are
+		// only kept when no ECU answered where it should
+		var paired, others []ScanResult
+		deadline := time.Now().Add(config.Wait)
+		for len(paired) == 0 && time.Now().Before(deadline) {
+			var pkts []api.CanData
+			pkts, idx = s.Device.GetPacketsFrom(idx)
+			for j := range pkts {
+				if pkts[j].ArbID == pkt.ArbID || !config.answers(pkts[j].Data()) {
+					continue
+				}
+				result := ScanResult{RequestID: pkt.ArbID, ResponseID: pkts[j].ArbID, Response: fmt.Sprintf("% X", pkts[j].Data())}
+				if isotp.Pairs(pkt.ArbID, pkts[j].ArbID) {
+					paired = append(paired, result)
+				} else if !busy[pkts[j].ArbID] {
+					others = append(others, result)
+				}
+			}
+			if len(paired) == 0 {
+				time.Sleep(SCAN_POLL)
+			}
+		}
+		if len(paired) == 0 {
+			paired = others
+		}
+		for j := range paired {
+			s.addResult(stop, paired[j])
+		}
+		s.lock.Lock()
+		if s.stop == stop {
+			s.status.Current = pkt.ArbID
+			s.status.Done = i + 1
+		}
+		s.lock.Unlock()
+	}
+	s.lock.Lock()
+	if s.stop == stop {
+		s.status.Running = false
+	}
+	s.lock.Unlock()
+}
+
+// addResult records an answer unless a newer scan has been started
+func (s *Scanner) addResult(stop chan bool, result ScanResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != stop {
+		return
+	}
+	for _, id := range s.status.Pairs[result.RequestID] {
+		if id == result.ResponseID {
+			return
+		}
+	}
+	logger.Log(fmt.Sprintf("Scan: %s answered on %s", result.RequestID, result.ResponseID))
+	s.status.Results = append(s.status.Results, result)
+	s.status.Pairs[result.RequestID] = append(s.status.Pairs[result.RequestID], result.ResponseID)
+}
@@ -0,0 +1,385 @@
+// Package uds is an ISO 14229 Unified Diagnostic Services client running
+// over ISO-TP
+package uds
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/canibus/api"
+	"github.com/ghetzel/canibus/isotp"
+	"github.com/ghetzel/canibus/logger"
+)
+
+// Service IDs
+const (
+	SID_DIAGNOSTIC_SESSION_CONTROL = 0x10
+	SID_ECU_RESET                  = 0x11
+	SID_CLEAR_DTC                  = 0x14
+	SID_READ_DTC                   = 0x19
+	SID_READ_DATA_BY_ID            = 0x22
+	SID_READ_MEMORY_BY_ADDRESS     = 0x23
+	SID_SECURITY_ACCESS            = 0x27
+	SID_COMMUNICATION_CONTROL      = 0x28
+	SID_WRITE_DATA_BY_ID           = 0x2E
+	SID_IO_CONTROL_BY_ID           = 0x2F
+	SID_ROUTINE_CONTROL            = 0x31
+	SID_REQUEST_DOWNLOAD           = 0x34
+	SID_REQUEST_UPLOAD             = 0x35
+	SID_TRANSFER_DATA              = 0x36
+	SID_REQUEST_TRANSFER_EXIT      = 0x37
+	SID_WRITE_MEMORY_BY_ADDRESS    = 0x3D
+	SID_TESTER_PRESENT             = 0x3E
+	SID_CONTROL_DTC_SETTING        = 0x85
+	NEGATIVE_RESPONSE              = 0x7F
+	POSITIVE_RESPONSE              = 0x40 // Added to the SID in a positive response
+	SUPPRESS_POSITIVE_RESPONSE     = 0x80 // Set in the sub-function to skip the answer
+)
+
+// Sub-functions
+const (
+	DEFAULT_SESSION       = 0x01
+	PROGRAMMING_SESSION   = 0x02
+	EXTENDED_SESSION      = 0x03
+	SAFETY_SYSTEM_SESSION = 0x04
+	HARD_RESET            = 0x01
+	KEY_OFF_ON_RESET      = 0x02
+	SOFT_RESET            = 0x03
+	ROUTINE_START         = 0x01
+	ROUTINE_STOP          = 0x02
+	ROUTINE_RESULTS       = 0x03
+)
+
+// Negative response codes callers commonly act on, see NRCNames for all
+const (
+	NRC_SERVICE_NOT_SUPPORTED                = 0x11
+	NRC_SUBFUNCTION_NOT_SUPPORTED            = 0x12
+	NRC_CONDITIONS_NOT_CORRECT               = 0x22
+	NRC_REQUEST_OUT_OF_RANGE                 = 0x31
+	NRC_SECURITY_ACCESS_DENIED               = 0x33
+	NRC_RESPONSE_PENDING                     = 0x78
+	NRC_SUBFUNCTION_NOT_SUPPORTED_IN_SESSION = 0x7E
+	NRC_SERVICE_NOT_SUPPORTED_IN_SESSION     = 0x7F
+)
+
+const (
+	UDS_P2            = 1 * time.Second // Wait for the first answer
+	UDS_P2_STAR       = 5 * time.Second // Wait after a response pending answer
+	UDS_KEEPALIVE     = 2 * time.Second
+	MAX_PENDING_WAITS = 10
+)
+
+var ServiceNames = map[uint8]string{
+	SID_DIAGNOSTIC_SESSION_CONTROL: "DiagnosticSessionControl",
+	SID_ECU_RESET:                  "ECUReset",
+	SID_CLEAR_DTC:                  "ClearDiagnosticInformation",
+	SID_READ_DTC:                   "ReadDTCInformation",
+	SID_READ_DATA_BY_ID:            "ReadDataByIdentifier",
+	SID_READ_MEMORY_BY_ADDRESS:     "ReadMemoryByAddress",
+	SID_SECURITY_ACCESS:            "SecurityAccess",
+	SID_COMMUNICATION_CONTROL:      "CommunicationControl",
+	SID_WRITE_DATA_BY_ID:           "WriteDataByIdentifier",
+	SID_IO_CONTROL_BY_ID:           "InputOutputControlByIdentifier",
+	SID_ROUTINE_CONTROL:            "RoutineControl",
+	SID_REQUEST_DOWNLOAD:           "RequestDownload",
+	SID_REQUEST_UPLOAD:             "RequestUpload",
+	SID_TRANSFER_DATA:              "TransferData",
+	SID_REQUEST_TRANSFER_EXIT:      "RequestTransferExit",
+	SID_WRITE_MEMORY_BY_ADDRESS:    "WriteMemoryByAddress",
+	SID_TESTER_PRESENT:             "TesterPresent",
+	SID_CONTROL_DTC_SETTING:        "ControlDTCSetting",
+}
+
+var SessionNames = map[uint8]string{
+	DEFAULT_SESSION:       "default",
+	PROGRAMMING_SESSION:   "programming",
+	EXTENDED_SESSION:      "extended",
+	SAFETY_SYSTEM_SESSION: "safetySystem",
+}
+
+var NRCNames = map[uint8]string{
+	0x10: "generalReject",
+	0x11: "serviceNotSupported",
+	0x12: "subFunctionNotSupported",
+	0x13: "incorrectMessageLengthOrInvalidFormat",
+	0x14: "responseTooLong",
+	0x21: "busyRepeatRequest",
+	0x22: "conditionsNotCorrect",
+	0x24: "requestSequenceError",
+	0x25: "noResponseFromSubnetComponent",
+	0x26: "failurePreventsExecutionOfRequestedAction",
+	0x31: "requestOutOfRange",
+	0x33: "securityAccessDenied",
+	0x35: "invalidKey",
+	0x36: "exceedNumberOfAttempts",
+	0x37: "requiredTimeDelayNotExpired",
+	0x70: "uploadDownloadNotAccepted",
+	0x71: "transferDataSuspended",
+	0x72: "generalProgrammingFailure",
+	0x73: "wrongBlockSequenceCounter",
+	0x78: "requestCorrectlyReceivedResponsePending",
+	0x7E: "subFunctionNotSupportedInActiveSession",
+	0x7F: "serviceNotSupportedInActiveSession",
+	0x81: "rpmTooHigh",
+	0x82: "rpmTooLow",
+	0x83: "engineIsRunning",
+	0x84: "engineIsNotRunning",
+	0x85: "engineRunTimeTooLow",
+	0x86: "temperatureTooHigh",
+	0x87: "temperatureTooLow",
+	0x88: "vehicleSpeedTooHigh",
+	0x89: "vehicleSpeedTooLow",
+	0x8A: "throttlePedalTooHigh",
+	0x8B: "throttlePedalTooLow",
+	0x8C: "transmissionRangeNotInNeutral",
+	0x8D: "transmissionRangeNotInGear",
+	0x8F: "brakeSwitchesNotClosed",
+	0x90: "shifterLeverNotInPark",
+	0x91: "torqueConverterClutchLocked",
+	0x92: "voltageTooHigh",
+	0x93: "voltageTooLow",
+}
+
+// DIDNames are the standard identification DataIdentifiers
+var DIDNames = map[uint16]string{
+	0xF180: "Boot software identification",
+	0xF181: "Application software identification",
+	0xF182: "Application data identification",
+	0xF183: "Boot software fingerprint",
+	0xF184: "Application software fingerprint",
+	0xF186: "Active diagnostic session",
+	0xF187: "Spare part number",
+	0xF188: "ECU software number",
+	0xF189: "ECU software version",
+	0xF18A: "System supplier identifier",
+	0xF18B: "ECU manufacturing date",
+	0xF18C: "ECU serial number",
+	0xF190: "VIN",
+	0xF191: "ECU hardware number",
+	0xF192: "System supplier ECU hardware number",
+	0xF193: "System supplier ECU hardware version",
+	0xF194: "System supplier ECU software number",
+	0xF195: "System supplier ECU software version",
+	0xF197: "System name or engine type",
+	0xF198: "Repair shop code or tester serial number",
+	0xF199: "Programming date",
+	0xF19E: "ODX file identifier",
+}
+
+// subFunctionServices take a sub-function byte whose top bit suppresses
+// the positive response
+var subFunctionServices = map[uint8]bool{
+	SID_DIAGNOSTIC_SESSION_CONTROL: true,
+	SID_ECU_RESET:                  true,
+	SID_SECURITY_ACCESS:            true,
+	SID_COMMUNICATION_CONTROL:      true,
+	SID_ROUTINE_CONTROL:            true,
+	SID_TESTER_PRESENT:             true,
+	SID_CONTROL_DTC_SETTING:        true,
+}
+
+// ServiceName returns the name of a service ID
+func ServiceName(sid uint8) string {
+	name, ok := ServiceNames[sid]
+	if !ok {
+		return fmt.Sprintf("Service %02X", sid)
+	}
+	return name
+}
+
+// NRCName returns the name of a negative response code
+func NRCName(nrc uint8) string {
+	name, ok := NRCNames[nrc]
+	if !ok {
+		return fmt.Sprintf("NRC %02X", nrc)
+	}
+	return name
+}
+
+// NegativeResponse is the error returned when an ECU refuses a request
+type NegativeResponse struct {
+	Service uint8
+	Code    uint8
+}
+
+func (n *NegativeResponse) Error() string {
+	return fmt.Sprintf("%s refused: %s (%02X)", ServiceName(n.Service), NRCName(n.Code), n.Code)
+}
+
+// NRC returns the negative response code of an error, or 0 when it is not
+// a negative response
+func NRC(err error) uint8 {
+	if n, ok := err.(*NegativeResponse); ok {
+		return n.Code
+	}
+	return 0
+}
+
+// Client talks to one ECU.  Requests are serialized so the keep-alive can
+// run alongside them
+type Client struct {
+	Conn      *isotp.Conn
+	P2        time.Duration
+	P2Star    time.Duration
+	lock      sync.Mutex
+	keepAlive chan bool
+}
+
+// NewClient opens a link to the ECU listening on txId and answering on rxId.
+// The device must be sniffing
+func NewClient(dev api.CanDevice, txId string, rxId string) (*Client, error) {
+	conn, err := isotp.NewConn(dev, txId, rxId)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Conn: conn, P2: UDS_P2, P2Star: UDS_P2_STAR}, nil
+}
+
+// Request sends a raw request and returns the positive response.  Response
+// pending answers are waited out, other negative responses come back as a
+// *NegativeResponse.  Requests with the suppress bit set return nil
+func (c *Client) Request(req []byte) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(req) == 0 {
+		return nil, logger.Err("Empty UDS request")
+	}
+	c.Conn.Config.ResponseTimeout = c.P2
+	err := c.Conn.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	suppress := len(req) > 1 && subFunctionServices[req[0]] && req[1]&SUPPRESS_POSITIVE_RESPONSE != 0
+	for waits := 0; waits <= MAX_PENDING_WAITS; waits++ {
+		resp, err := c.Conn.Recv()
+		if err != nil {
+			if suppress {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if len(resp) >= 3 && resp[0] == NEGATIVE_RESPONSE && resp[1] == req[0] {
+			if resp[2] == NRC_RESPONSE_PENDING {
+				c.Conn.Config.ResponseTimeout = c.P2Star
+				continue
+			}
+			return nil, &NegativeResponse{Service: req[0], Code: resp[2]}
+		}
+		if resp[0] != req[0]+POSITIVE_RESPONSE {
+			continue // Answer to something else
+		}
+		return resp, nil
+	}
+	return nil, logger.Err("ECU kept answering response pending")
+}
+
+// DiagnosticSessionControl switches session and returns the timing
+// parameters the ECU reported
+func (c *Client) DiagnosticSessionControl(session uint8) ([]byte, error) {
+	resp, err := c.Request([]byte{SID_DIAGNOSTIC_SESSION_CONTROL, session})
+	if err != nil || resp == nil {
+		return nil, err // resp is nil when the positive response is suppressed
+	}
+	if len(resp) < 2 {
+		return nil, logger.Err("Short DiagnosticSessionControl answer")
+	}
+	return resp[2:], nil
+}
+
+// ECUReset resets the ECU, kind is HARD_RESET, KEY_OFF_ON_RESET or SOFT_RESET
+func (c *Client) ECUReset(kind uint8) error {
+	_, err := c.Request([]byte{SID_ECU_RESET, kind})
+	return err
+}
+
+// ReadDataByIdentifier returns the value of a DID
+func (c *Client) ReadDataByIdentifier(did uint16) ([]byte, error) {
+	resp, err := c.Request([]byte{SID_READ_DATA_BY_ID, uint8(did >> 8), uint8(did)})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 3 || binary.BigEndian.Uint16(resp[1:3]) != did {
+		return nil, logger.Err(fmt.Sprintf("Answer is not for DID %04X", did))
+	}
+	return resp[3:], nil
+}
+
+// WriteDataByIdentifier sets the value of a DID
+func (c *Client) WriteDataByIdentifier(did uint16, data []byte) error {
+	_, err := c.Request(append([]byte{SID_WRITE_DATA_BY_ID, uint8(did >> 8), uint8(did)}, data...))
+	return err
+}
+
+// ReadMemoryByAddress reads size bytes using a 4 byte address and 2 byte
+// length (addressAndLengthFormatIdentifier 24)
+func (c *Client) ReadMemoryByAddress(addr uint32, size uint16) ([]byte, error) {
+	req := []byte{SID_READ_MEMORY_BY_ADDRESS, 0x24, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(req[2:], addr)
+	binary.BigEndian.PutUint16(req[6:], size)
+	resp, err := c.Request(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp[1:], nil
+}
+
+// RoutineControl starts, stops or gets the results of a routine and
+// returns the routine status record
+func (c *Client) RoutineControl(kind uint8, routine uint16, params []byte) ([]byte, error) {
+	resp, err := c.Request(append([]byte{SID_ROUTINE_CONTROL, kind, uint8(routine >> 8), uint8(routine)}, params...))
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	if len(resp) < 4 {
+		return nil, logger.Err("Short RoutineControl answer")
+	}
+	return resp[4:], nil
+}
+
+// TesterPresent keeps a non-default session from timing out
+func (c *Client) TesterPresent() error {
+	_, err := c.Request([]byte{SID_TESTER_PRESENT, 0x00})
+	return err
+}
+
+// StartKeepAlive sends TesterPresent, with the answer suppressed, every
+// interval until StopKeepAlive
+func (c *Client) StartKeepAlive(interval time.Duration) {
+	if c.keepAlive != nil {
+		return
+	}
+	c.keepAlive = make(chan bool)
+	go func(stop chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.lock.Lock()
+				err := c.Conn.Send([]byte{SID_TESTER_PRESENT, SUPPRESS_POSITIVE_RESPONSE})
+				c.lock.Unlock()
+				if err != nil {
+					logger.Log("TesterPresent failed: " + err.Error())
+				}
+			}
+		}
+	}(c.keepAlive)
+}
+
+// StopKeepAlive stops the TesterPresent keep-alive
+func (c *Client) StopKeepAlive() {
+	if c.keepAlive == nil {
+		return
+	}
+	close(c.keepAlive)
+	c.keepAlive = nil
+}
+
+// KeepingAlive reports whether the keep-alive is running
+func (c *Client) KeepingAlive() bool {
+	return c.keepAlive != nil
+}
@@ -1,16 +1,25 @@
 package webserver
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ghetzel/canibus/analysis"
 	"github.com/ghetzel/canibus/api"
 	"github.com/ghetzel/canibus/candevice"
 	"github.com/ghetzel/canibus/core"
+	"github.com/ghetzel/canibus/dbc"
 	"github.com/ghetzel/canibus/hacksession"
+	"github.com/ghetzel/canibus/isotp"
 	"github.com/ghetzel/canibus/logger"
+	"github.com/ghetzel/canibus/obd"
+	"github.com/ghetzel/canibus/uds"
 	"github.com/gorilla/mux"
 )
 
@@ -24,6 +33,54 @@ type CanDeviceJSON struct {
 	Model       string
 }
 
+type ObdStatusJSON struct {
+	Polling bool
+	PIDs    []string // Hex, as given in pids
+	Rate    int64    // Milliseconds between polling cycles
+	Samples []candevice.ObdSample
+	Next    int
+}
+
+type DtcJSON struct {
+	DTCs   []obd.DTC
+	Errors map[string]string // Modes that could not be read, by DTC type
+}
+
+type UdsJSON struct {
+	TxID      string
+	RxID      string
+	Request   string
+	Response  string
+	Service   string
+	NRC       uint8
+	Error     string
+	KeepAlive bool
+}
+
+type TransactionsJSON struct {
+	Transactions []isotp.Transaction
+	Next         int
+}
+
+type VehicleJSON struct {
+	VIN      string
+	Year     string
+	Make     string
+	Model    string
+	Messages []*dbc.Message
+}
+
+type StatsJSON struct {
+	Running bool
+	Since   string
+	IDs     []analysis.IdStats
+}
+
+type IntegrityJSON struct {
+	AutoFill bool
+	IDs      []analysis.Integrity
+}
+
 type ConfigJSSON struct {
 	Id         int
 	DeviceType string
@@ -214,6 +271,865 @@ func haxPacketsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", j)
 }
 
+// activeDevice does the checks shared by handlers that act on a device:
+// the user is logged in and part of the device's HackSession.  An error
+// has already been written when the bool is false
+func activeDevice(w http.ResponseWriter, r *http.Request) (api.CanDevice, api.HackSession, bool) {
+	auth_err := checkAuth(w, r)
+	if auth_err != nil {
+		return nil, nil, false
+	}
+	vars := mux.Vars(r)
+	canId, canId_err := strconv.Atoi(vars["id"])
+	if canId_err != nil {
+		http.Error(w, canId_err.Error(), http.StatusNotFound)
+		return nil, nil, false
+	}
+	dev, dev_err := core.GetDeviceById(canId)
+	if dev_err != nil {
+		http.Error(w, dev_err.Error(), http.StatusNotFound)
+		return nil, nil, false
+	}
+	session, _ := store.Get(r, "canibus")
+	userName := session.Values["user"].(string)
+	user, _ := core.GetUserByName(userName)
+
+	hax := dev.GetHackSession()
+	if hax == nil {
+		http.Error(w, "Session not configured", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if !hax.IsActiveUser(user) {
+		http.Error(w, "You are not a part of this hacksession", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return dev, hax, true
+}
+
+// haxReplayHandler controls a Simulator replay.  Optional form values:
+// speed (multiplier, -1 as fast as possible), pause (1 or 0), seek (packet
+// index) and stopAtEnd (1 or 0).  Returns the replay status
+func haxReplayHandler(w http.ResponseWriter, r *http.Request) {
+	dev, _, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	sim, ok := dev.(*candevice.Simulator)
+	if !ok {
+		http.Error(w, "Device is not a simulator", http.StatusBadRequest)
+		return
+	}
+	if speed := r.FormValue("speed"); speed != "" {
+		val, err := strconv.ParseFloat(speed, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sim.SetSpeed(val)
+	}
+	if pause := r.FormValue("pause"); pause == "1" {
+		sim.Pause()
+	} else if pause == "0" {
+		sim.Resume()
+	}
+	if seek := r.FormValue("seek"); seek != "" {
+		pos, err := strconv.Atoi(seek)
+		if err == nil {
+			err = sim.Seek(pos)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if stop := r.FormValue("stopAtEnd"); stop != "" {
+		sim.SetStopAtEnd(stop == "1")
+	}
+	j, err := json.Marshal(sim.GetStatus())
+	if err != nil {
+		logger.Log("Could not convert replay status to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// haxObdHandler controls ELM327 PID polling and returns the polled values.
+// Optional form values: pids (hex list such as "0C,0D"), rate (ms between
+// cycles), poll (1 or 0) and from (sample index returned as Next last time)
+func haxObdHandler(w http.ResponseWriter, r *http.Request) {
+	dev, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	elm, ok := dev.(*candevice.Elm327)
+	if !ok {
+		http.Error(w, "Device is not an ELM327", http.StatusBadRequest)
+		return
+	}
+	if pids := r.FormValue("pids"); pids != "" {
+		list, err := obd.ParsePIDList(pids)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		elm.SetPollPIDs(list)
+	}
+	if rate := r.FormValue("rate"); rate != "" {
+		ms, err := strconv.Atoi(rate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		elm.SetPollRate(ms)
+	}
+	if poll := r.FormValue("poll"); poll == "1" {
+		elm.SetPolling(true)
+		if hax.GetStateValue() != hacksession.STATE_SNIFF {
+			hax.SetState(hacksession.STATE_SNIFF)
+			dev.StartSniffing()
+		}
+	} else if poll == "0" {
+		elm.SetPolling(false)
+	}
+	from, _ := strconv.Atoi(r.FormValue("from"))
+	samples, next := elm.GetObdSamplesFrom(from)
+	pidList := []string{}
+	for _, pid := range elm.PollPIDs {
+		pidList = append(pidList, fmt.Sprintf("%02X", pid))
+	}
+	status := ObdStatusJSON{
+		Polling: elm.IsPolling(),
+		PIDs:    pidList,
+		Rate:    int64(elm.PollRate / time.Millisecond),
+		Samples: samples,
+		Next:    next,
+	}
+	j, err := json.Marshal(status)
+	if err != nil {
+		logger.Log("Could not convert OBD samples to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// haxTransactionsHandler returns the ISO-TP requests and responses
+// reassembled from the sniffed traffic since from
+func haxTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not track transactions", http.StatusBadRequest)
+		return
+	}
+	from, _ := strconv.Atoi(r.FormValue("from"))
+	txs, next := hacks.GetTransactionsFrom(from)
+	j, err := json.Marshal(TransactionsJSON{Transactions: txs, Next: next})
+	if err != nil {
+		logger.Log("Could not convert transactions to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// obdReady makes sure a raw CAN device is sniffing so OBD answers reach its
+// packet buffer.  Adapters that do their own OBD framing are left alone
+func obdReady(dev api.CanDevice, hax api.HackSession) {
+	if _, ok := dev.(candevice.OBDRequestDevice); ok {
+		return
+	}
+	if hax.GetStateValue() != hacksession.STATE_SNIFF {
+		hax.SetState(hacksession.STATE_SNIFF)
+		dev.StartSniffing()
+	}
+}
+
+// candeviceDtcHandler reads trouble codes.  The optional type form value
+// is stored, pending or permanent, all three are read by default.  Modes
+// that fail are listed in Errors, and it is an error if none could be read
+func candeviceDtcHandler(w http.ResponseWriter, r *http.Request) {
+	dev, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	modes := []uint8{obd.MODE_STORED_DTCS, obd.MODE_PENDING_DTCS, obd.MODE_PERMANENT_DTCS}
+	if kind := r.FormValue("type"); kind != "" {
+		modes = nil
+		for mode, name := range obd.DTCModeNames {
+			if name == kind {
+				modes = append(modes, mode)
+			}
+		}
+		if len(modes) == 0 {
+			http.Error(w, "Unknown DTC type "+kind, http.StatusBadRequest)
+			return
+		}
+	}
+	obdReady(dev, hax)
+	request := candevice.OBDRequester(dev)
+	result := DtcJSON{DTCs: []obd.DTC{}, Errors: map[string]string{}}
+	for i := range modes {
+		codes, err := obd.ReadDTCs(request, modes[i])
+		if err != nil {
+			name := obd.DTCModeNames[modes[i]]
+			logger.Log(fmt.Sprintf("Reading %s DTCs: %s", name, err.Error()))
+			result.Errors[name] = err.Error()
+			continue
+		}
+		result.DTCs = append(result.DTCs, codes...)
+	}
+	if len(result.Errors) == len(modes) {
+		var errs []string
+		for i := range modes {
+			name := obd.DTCModeNames[modes[i]]
+			errs = append(errs, name+": "+result.Errors[name])
+		}
+		http.Error(w, "Could not read DTCs: "+strings.Join(errs, ", "), http.StatusBadRequest)
+		return
+	}
+	j, err := json.Marshal(result)
+	if err != nil {
+		logger.Log("Could not convert DTCs to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// candeviceDtcClearHandler clears trouble codes with Mode 04.  Needs a POST
+// with confirm=1 since it also wipes freeze frames and readiness monitors
+func candeviceDtcClearHandler(w http.ResponseWriter, r *http.Request) {
+	dev, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Clearing DTCs needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	obdReady(dev, hax)
+	ecus, err := obd.ClearDTCs(candevice.OBDRequester(dev), r.FormValue("confirm") == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := json.Marshal(ecus)
+	if err != nil {
+		logger.Log("Could not convert ECU list to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// rawReady starts sniffing for features that need a device's raw frames.
+// Adapters doing their own framing, such as the ELM327, are refused
+func rawReady(w http.ResponseWriter, dev api.CanDevice, hax api.HackSession) bool {
+	if _, ok := dev.(candevice.OBDRequestDevice); ok {
+		http.Error(w, "Device does not pass raw CAN frames", http.StatusBadRequest)
+		return false
+	}
+	obdReady(dev, hax)
+	return true
+}
+
+// haxUdsHandler is a UDS console.  req is a hex request such as "22 F1 90"
+// sent from tx (default 7E0) with the answer expected on rx (default the
+// usual response ID for tx).  keepalive=1/0 starts or stops TesterPresent
+func haxUdsHandler(w http.ResponseWriter, r *http.Request) {
+	dev, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not support UDS", http.StatusBadRequest)
+		return
+	}
+	if !rawReady(w, dev, hax) {
+		return
+	}
+	status := UdsJSON{TxID: r.FormValue("tx"), RxID: r.FormValue("rx")}
+	if status.TxID == "" {
+		status.TxID = "7E0"
+	}
+	if status.RxID == "" {
+		rx, err := isotp.ResponseId(status.TxID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status.RxID = rx
+	}
+	client, err := hacks.UDSClient(status.TxID, status.RxID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if keepAlive := r.FormValue("keepalive"); keepAlive == "1" {
+		client.StartKeepAlive(uds.UDS_KEEPALIVE)
+	} else if keepAlive == "0" {
+		client.StopKeepAlive()
+	}
+	if req := r.FormValue("req"); req != "" {
+		data, err := hex.DecodeString(strings.Replace(req, " ", "", -1))
+		if err != nil || len(data) == 0 {
+			http.Error(w, "Bad UDS request "+req, http.StatusBadRequest)
+			return
+		}
+		status.Request = fmt.Sprintf("% X", data)
+		status.Service = uds.ServiceName(data[0])
+		resp, err := client.Request(data)
+		if err != nil {
+			status.Error = err.Error()
+			status.NRC = uds.NRC(err)
+		}
+		status.Response = fmt.Sprintf("% X", resp)
+	}
+	status.KeepAlive = client.KeepingAlive()
+	j, err := json.Marshal(status)
+	if err != nil {
+		logger.Log("Could not convert UDS response to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// candeviceScanHandler reports the ECU scan progress.  start=1 begins a
+// scan with mode=uds|obd, from/to hex standard ID range, extended=1 to
+// also sweep 29-bit IDs and wait in milliseconds per ID.  stop=1 ends it
+func candeviceScanHandler(w http.ResponseWriter, r *http.Request) {
+	dev, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not support scanning", http.StatusBadRequest)
+		return
+	}
+	scanner := hacks.GetScanner()
+	if scanner == nil {
+		http.Error(w, "Device not set", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("stop") == "1" {
+		scanner.Stop()
+	}
+	if r.FormValue("start") == "1" && !scanner.Status().Running {
+		if !rawReady(w, dev, hax) {
+			return
+		}
+		config := uds.DefaultScanConfig
+		if r.FormValue("mode") == "obd" {
+			config.Request = uds.SCAN_OBD
+		}
+		if from := r.FormValue("from"); from != "" {
+			id, err := api.Hextoui32(from)
+			if err != nil {
+				http.Error(w, "Bad from ID "+from, http.StatusBadRequest)
+				return
+			}
+			config.From = id
+		}
+		if to := r.FormValue("to"); to != "" {
+			id, err := api.Hextoui32(to)
+			if err != nil {
+				http.Error(w, "Bad to ID "+to, http.StatusBadRequest)
+				return
+			}
+			config.To = id
+		}
+		config.Extended = r.FormValue("extended") == "1"
+		if wait := r.FormValue("wait"); wait != "" {
+			ms, err := strconv.Atoi(wait)
+			if err != nil || ms <= 0 {
+				http.Error(w, "Bad wait "+wait, http.StatusBadRequest)
+				return
+			}
+			config.Wait = time.Duration(ms) * time.Millisecond
+		}
+		err := scanner.Start(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	j, err := json.Marshal(scanner.Status())
+	if err != nil {
+		logger.Log("Could not convert scan status to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// haxUdsEnumerateHandler reports UDS enumeration progress.  start=1
+// probes tx/rx (default 7E0 and its usual response ID), or every ECU the
+// last scan found with all=1.  dids=F180-F19F sets the DID range and
+// unsafe=1 also probes services that may change ECU state.  stop=1 ends
+// it, export=1 downloads the reports
+func haxUdsEnumerateHandler(w http.ResponseWriter, r *http.Request) {
+	dev, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not support UDS", http.StatusBadRequest)
+		return
+	}
+	enum := hacks.GetEnumerator()
+	if enum == nil {
+		http.Error(w, "Device not set", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("stop") == "1" {
+		enum.Stop()
+	}
+	if r.FormValue("start") == "1" && !enum.Status().Running {
+		if !rawReady(w, dev, hax) {
+			return
+		}
+		config := uds.DefaultEnumConfig
+		if r.FormValue("all") == "1" {
+			for _, result := range hacks.GetScanner().Status().Results {
+				config.Targets = append(config.Targets, uds.Target{TxID: result.RequestID, RxID: result.ResponseID})
+			}
+		} else {
+			target := uds.Target{TxID: r.FormValue("tx"), RxID: r.FormValue("rx")}
+			if target.TxID == "" {
+				target.TxID = "7E0"
+			}
+			if target.RxID == "" {
+				rx, err := isotp.ResponseId(target.TxID)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				target.RxID = rx
+			}
+			config.Targets = append(config.Targets, target)
+		}
+		if dids := r.FormValue("dids"); dids != "" {
+			ends := strings.SplitN(dids, "-", 2)
+			from, err := strconv.ParseUint(ends[0], 16, 16)
+			to := from
+			if err == nil && len(ends) == 2 {
+				to, err = strconv.ParseUint(ends[1], 16, 16)
+			}
+			if err != nil {
+				http.Error(w, "Bad DID range "+dids, http.StatusBadRequest)
+				return
+			}
+			config.DIDFrom, config.DIDTo = uint16(from), uint16(to)
+		}
+		config.Unsafe = r.FormValue("unsafe") == "1"
+		err := enum.Start(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var j []byte
+	var err error
+	if r.FormValue("export") == "1" {
+		w.Header().Set("Content-Disposition", "attachment; filename=uds-report.json")
+		j, err = json.MarshalIndent(enum.Status().Reports, "", "  ")
+	} else {
+		j, err = json.Marshal(enum.Status())
+	}
+	if err != nil {
+		logger.Log("Could not convert UDS reports to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// haxDbcHandler lists the messages of the session's signal database.  A
+// POST of a DBC, KCD or ARXML file, as the body or a "file" form upload,
+// attaches it
+func haxDbcHandler(w http.ResponseWriter, r *http.Request) {
+	_, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not support signal databases", http.StatusBadRequest)
+		return
+	}
+	if r.Method == "POST" {
+		var data []byte
+		var err error
+		file, _, ferr := r.FormFile("file")
+		if ferr == nil {
+			data, err = ioutil.ReadAll(file)
+			file.Close()
+		} else {
+			data, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, "Could not read signal database", http.StatusBadRequest)
+			return
+		}
+		db, err := dbc.Load(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hacks.SignalDB = db
+	}
+	db := hacks.GetSignalDB()
+	if db == nil {
+		http.Error(w, "No signal database attached", http.StatusNotFound)
+		return
+	}
+	j, err := json.Marshal(db.SortedMessages())
+	if err != nil {
+		logger.Log("Could not convert signal database to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// haxStatsHandler returns per ArbID counts, periods and bit flip heat.
+// Counting starts with the first call, reset=1 starts over and stop=1
+// stops counting
+func haxStatsHandler(w http.ResponseWriter, r *http.Request) {
+	_, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not support statistics", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("stop") == "1" {
+		hacks.Stats.Stop()
+	} else {
+		if r.FormValue("reset") == "1" {
+			hacks.Stats.Reset()
+		}
+		hacks.GetStats()
+	}
+	ids, since := hacks.Stats.GetStats()
+	stats := StatsJSON{Running: hacks.Stats.Running(), IDs: ids}
+	if !since.IsZero() {
+		stats.Since = since.Format(time.RFC3339)
+	}
+	j, err := json.Marshal(stats)
+	if err != nil {
+		logger.Log("Could not convert statistics to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// haxIntegrityHandler returns the counters and checksums found in sniffed
+// traffic.  autofill=1 sets them in injected packets, autofill=0 stops it
+func haxIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	_, hax, ok := activeDevice(w, r)
+	if !ok {
+		return
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not support integrity detection", http.StatusBadRequest)
+		return
+	}
+	switch r.FormValue("autofill") {
+	case "1":
+		hacks.AutoFill = true
+	case "0":
+		hacks.AutoFill = false
+	}
+	integrity := IntegrityJSON{AutoFill: hacks.AutoFill, IDs: hacks.GetStats().GetIntegrity()}
+	j, err := json.Marshal(integrity)
+	if err != nil {
+		logger.Log("Could not convert integrity to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// captureUpload reads and parses an uploaded capture file
+func captureUpload(r *http.Request, field string) ([]api.CanData, error) {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return nil, logger.Err("Missing capture " + field)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, logger.Err("Could not read capture " + field)
+	}
+	return candevice.ParseCaptureFile(header.Filename, data)
+}
+
+// captureDiffHandler compares two captures POSTed as the a and b file
+// uploads, in any format the Simulator replays.  min is the lowest score
+// reported
+func captureDiffHandler(w http.ResponseWriter, r *http.Request) {
+	auth_err := checkAuth(w, r)
+	if auth_err != nil {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Upload the captures with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := captureUpload(r, "a")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := captureUpload(r, "b")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	min := analysis.DIFF_MIN_SCORE
+	if value := r.FormValue("min"); value != "" {
+		min, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, "Invalid min", http.StatusBadRequest)
+			return
+		}
+	}
+	j, err := json.Marshal(analysis.Diff(a, b, min))
+	if err != nil {
+		logger.Log("Could not convert capture diff to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// vehicleDB returns the session and the signal database of the vehicle
+// named by the vin form value, or else the vehicle already chosen, or else
+// the VIN read from the car
+func vehicleDB(w http.ResponseWriter, r *http.Request) (*hacksession.HackSession, *dbc.Database, bool) {
+	dev, hax, ok := activeDevice(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	hacks, ok := hax.(*hacksession.HackSession)
+	if !ok {
+		http.Error(w, "Session does not support signal databases", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	vin := strings.ToUpper(strings.TrimSpace(r.FormValue("vin")))
+	if vin == "" {
+		vin = hacks.VIN
+	}
+	if vin == "" {
+		obdReady(dev, hax)
+		var err error
+		vin, err = obd.ReadVIN(candevice.OBDRequester(dev))
+		if err != nil {
+			http.Error(w, "Could not read the VIN, give one with vin", http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+	if !obd.ValidVIN(vin) {
+		http.Error(w, "Invalid VIN "+vin, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	db, err := hacks.VehicleDB(vin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return hacks, db, true
+}
+
+// haxVehicleHandler lists the messages defined for the vehicle, export=1
+// downloads them as a DBC file
+func haxVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	hacks, db, ok := vehicleDB(w, r)
+	if !ok {
+		return
+	}
+	if r.FormValue("export") == "1" {
+		w.Header().Set("Content-Disposition", "attachment; filename="+hacks.VIN+".dbc")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(db.DBC())
+		return
+	}
+	vehicle := VehicleJSON{VIN: hacks.VIN, Messages: db.SortedMessages()}
+	vehicle.Year = obd.GetYearFromVIN(hacks.VIN)
+	vehicle.Make = obd.GetMakeFromVIN(hacks.VIN)
+	vehicle.Model = obd.GetModelFromVIN(hacks.VIN).Model
+	j, err := json.Marshal(vehicle)
+	if err != nil {
+		logger.Log("Could not convert vehicle to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// haxVehicleMessageHandler defines a message on id (hex) with name, dlc,
+// transmitter and comment.  delete=1 removes it
+func haxVehicleMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Changing messages needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	hacks, db, ok := vehicleDB(w, r)
+	if !ok {
+		return
+	}
+	id, err := api.Hextoui32(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+	extended := r.FormValue("extended") == "1" || id > 0x7FF
+	edit := db.Clone()
+	if r.FormValue("delete") == "1" {
+		err = edit.RemoveMessage(id, extended)
+	} else {
+		msg := &dbc.Message{ID: id, Extended: extended, Name: r.FormValue("name"), DLC: 8}
+		msg.Transmitter = r.FormValue("transmitter")
+		msg.Comment = r.FormValue("comment")
+		if dlc := r.FormValue("dlc"); dlc != "" {
+			msg.DLC, err = strconv.Atoi(dlc)
+		}
+		if err == nil {
+			err = edit.SetMessage(msg)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = hacks.SaveVehicleDB(edit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	j, err := json.Marshal(edit.SortedMessages())
+	if err != nil {
+		logger.Log("Could not convert signal database to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
+// signalForm reads a signal definition.  start is the LSB for little
+// endian (Intel) and the MSB for big endian (Motorola) signals, as in DBC
+func signalForm(r *http.Request) (*dbc.Signal, error) {
+	sig := &dbc.Signal{Name: r.FormValue("name"), Unit: r.FormValue("unit"), Comment: r.FormValue("comment"), Factor: 1}
+	var err error
+	sig.StartBit, err = strconv.Atoi(r.FormValue("start"))
+	if err != nil {
+		return nil, logger.Err("Invalid start bit")
+	}
+	sig.Length, err = strconv.Atoi(r.FormValue("length"))
+	if err != nil {
+		return nil, logger.Err("Invalid length")
+	}
+	switch r.FormValue("order") {
+	case "", "little", "intel":
+		sig.LittleEndian = true
+	case "big", "motorola":
+	default:
+		return nil, logger.Err("Byte order must be little or big")
+	}
+	sig.Signed = r.FormValue("signed") == "1"
+	switch r.FormValue("type") {
+	case "float":
+		sig.Type = dbc.SIGNAL_FLOAT
+	case "double":
+		sig.Type = dbc.SIGNAL_DOUBLE
+	}
+	for field, dst := range map[string]*float64{"factor": &sig.Factor, "offset": &sig.Offset, "min": &sig.Min, "max": &sig.Max} {
+		if value := r.FormValue(field); value != "" {
+			*dst, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, logger.Err("Invalid " + field)
+			}
+		}
+	}
+	// mux is M for the multiplexor, mN for signals present when it is N
+	if mux := r.FormValue("mux"); mux != "" {
+		sig.Multiplexor = strings.HasSuffix(mux, "M")
+		mux = strings.TrimSuffix(mux, "M")
+		if strings.HasPrefix(mux, "m") {
+			sig.Multiplexed = true
+			sig.MuxValue, err = strconv.Atoi(mux[1:])
+			if err != nil {
+				return nil, logger.Err("Invalid multiplex value")
+			}
+		}
+	}
+	for _, node := range strings.Split(r.FormValue("receivers"), ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			sig.Receivers = append(sig.Receivers, node)
+		}
+	}
+	// values is a list of raw=description such as "0=Park,1=Reverse"
+	for _, pair := range strings.Split(r.FormValue("values"), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(kv[0]), 0, 64)
+		if err != nil {
+			return nil, logger.Err("Invalid value " + kv[0])
+		}
+		if sig.Values == nil {
+			sig.Values = map[int64]string{}
+		}
+		sig.Values[n] = strings.TrimSpace(kv[1])
+	}
+	return sig, nil
+}
+
+// haxVehicleSignalHandler defines a signal of the message with ID message
+// (hex).  See signalForm for the fields.  delete=1 removes it by name
+func haxVehicleSignalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Changing signals needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	hacks, db, ok := vehicleDB(w, r)
+	if !ok {
+		return
+	}
+	edit := db.Clone()
+	msg := edit.Lookup(r.FormValue("message"), r.FormValue("extended") == "1")
+	if msg == nil {
+		http.Error(w, "No message "+r.FormValue("message"), http.StatusNotFound)
+		return
+	}
+	var err error
+	if r.FormValue("delete") == "1" {
+		err = msg.RemoveSignal(r.FormValue("name"))
+	} else {
+		var sig *dbc.Signal
+		sig, err = signalForm(r)
+		if err == nil {
+			err = msg.SetSignal(sig)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = hacks.SaveVehicleDB(edit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	j, err := json.Marshal(msg)
+	if err != nil {
+		logger.Log("Could not convert message to json")
+		return
+	}
+	fmt.Fprintf(w, "%s", j)
+}
+
 func configCanHandler(w http.ResponseWriter, r *http.Request) {
 	logger.Log("Config CAN Device, checking auth...")
 	auth_err := checkAuth(w, r)
@@ -366,11 +1282,26 @@ func StartSPAWebListener(root string, ip string, port string) error {
 	r.HandleFunc("/candevice/{id}/config", configCanHandler)
 	r.HandleFunc("/candevice/{id}/join", joinHaxHandler)
 	r.HandleFunc("/candevice/{id}/info", candeviceInfoHandler)
+	r.HandleFunc("/candevice/{id}/dtc", candeviceDtcHandler)
+	r.HandleFunc("/candevice/{id}/dtc/clear", candeviceDtcClearHandler)
+	r.HandleFunc("/candevice/{id}/scan", candeviceScanHandler)
 	r.HandleFunc("/hax/{id}/packets", haxPacketsHandler)
 	r.HandleFunc("/hax/{id}/start", haxStartHandler)
 	r.HandleFunc("/hax/{id}/stop", haxStopHandler)
 	r.HandleFunc("/hax/{id}/transmit", haxTransmitHandler)
+	r.HandleFunc("/hax/{id}/replay", haxReplayHandler)
+	r.HandleFunc("/hax/{id}/obd", haxObdHandler)
+	r.HandleFunc("/hax/{id}/transactions", haxTransactionsHandler)
+	r.HandleFunc("/hax/{id}/uds", haxUdsHandler)
+	r.HandleFunc("/hax/{id}/uds/enumerate", haxUdsEnumerateHandler)
+	r.HandleFunc("/hax/{id}/dbc", haxDbcHandler)
+	r.HandleFunc("/hax/{id}/stats", haxStatsHandler)
+	r.HandleFunc("/hax/{id}/integrity", haxIntegrityHandler)
+	r.HandleFunc("/hax/{id}/vehicle", haxVehicleHandler)
+	r.HandleFunc("/hax/{id}/vehicle/message", haxVehicleMessageHandler)
+	r.HandleFunc("/hax/{id}/vehicle/signal", haxVehicleSignalHandler)
 	r.HandleFunc("/candevices", candevicesHandler)
+	r.HandleFunc("/capture/diff", captureDiffHandler)
 	r.HandleFunc("/lobby/AddSimulator", addSimHandler)
 
 	http.Handle("/partials/", http.FileServer(FS(false)))
@@ -183,6 +183,7 @@ func leaveDevice(user api.User) {
 	}
 	hax.RemoveUser(user)
 	if hax.NumOfUsers() == 0 {
+		hax.Close()
 		dev.SetHackSession(nil)
 	}
 }
@@ -143,7 +143,7 @@ controllers.haxController = function($scope, $filter, $http, $timeout, $routePar
   $scope.reverse = false;
   $scope.transmitCount = 0;
   $scope.transmitErr = "";
-  $scope.tx = {ArbId: '', Network: '', B1: '', B2: '', B3: '', B4: '', B5: '', B6: '', B7: '', B8: ''};
+  $scope.tx = {ArbId: '', Extended: false, Network: '', B1: '', B2: '', B3: '', B4: '', B5: '', B6: '', B7: '', B8: ''};
 
   $scope.viewType = "ArbView";
   var snifferPromise;
@@ -305,6 +305,7 @@ controllers.haxController = function($scope, $filter, $http, $timeout, $routePar
 
   $scope.copyPacket = function(pkt) {
     this.tx.ArbId = pkt.ArbID;
+    $scope.tx.Extended = pkt.Extended;
     $scope.tx.Network = pkt.Network;
     $scope.tx.B1 = pkt.B1;
     $scope.tx.B2 = pkt.B2;